@@ -0,0 +1,140 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/luci/luci-go/common/errors"
+	"github.com/luci/luci-go/common/logging"
+
+	"github.com/riannucci/sarchive/sar"
+	"github.com/riannucci/sarchive/sar/sardata"
+)
+
+var dataOrders = map[string]sar.DataOrder{
+	"toc":        sar.DataOrderTOC,
+	"extension":  sar.DataOrderExtension,
+	"size":       sar.DataOrderSize,
+	"similarity": sar.DataOrderSimilarity,
+}
+
+var cmdCreate = &subcommand{
+	args:  "<archive> <dir>",
+	help:  "Creates a new archive from the contents of dir.",
+	nargs: 2,
+	flags: func(fs *flag.FlagSet) func(context.Context, []string) error {
+		compression := fs.String("compression", "flate",
+			"The compression scheme to use; one of: "+keys(compressionSchemes)+". "+
+				"'auto' picks one by compressing a sample of the data, ignoring -level.")
+		level := fs.Int("level", 9,
+			"The compression level to use; -2 to 9 for flate, 1 to 22 for zstd, "+
+				"0 to 9 (or a dictionary size in bytes) for xz, 0 to 11 for brotli, "+
+				"and 0 to 9 for lz4.")
+		checksum := fs.String("checksum", "",
+			"The checksum scheme to use; one of: "+keys(checksumSchemes)+". "+
+				"Defaults to sha2-512 on amd64 and sha2-256 elsewhere.")
+		chunkSize := fs.Uint64("chunk-size", 0,
+			"If nonzero, split the archive data into independently compressed chunks "+
+				"of this many bytes, to allow random access.")
+		chunkAtFiles := fs.Bool("chunk-at-files", false,
+			"Only split chunks between files (each chunk holds at least -chunk-size bytes).")
+		workers := fs.Int("workers", 1,
+			"The number of goroutines to compress the archive data on.")
+		dict := fs.String("dict", "",
+			"A zstd dictionary file (see train-dict) to compress with. Requires -compression zstd.")
+		embedDict := fs.Bool("embed-dict", true,
+			"Store the -dict dictionary in the archive. Otherwise, it must be supplied "+
+				"to read the archive.")
+		order := fs.String("order", "toc",
+			"The order to store the files' data in; one of: "+keys(dataOrders)+". "+
+				"Grouping similar files can improve compression, but any order other "+
+				"than 'toc' requires a newer reader.")
+		progress := progressFlag(fs)
+
+		return func(ctx context.Context, args []string) error {
+			cKind, ok := compressionSchemes[*compression]
+			if !ok {
+				return errors.Reason("unknown compression scheme %(c)q").
+					D("c", *compression).Err()
+			}
+			dataOrder, ok := dataOrders[*order]
+			if !ok {
+				return errors.Reason("unknown data order %(o)q").D("o", *order).Err()
+			}
+			opts := []sar.CreateOption{
+				sar.WithCompression(cKind, *level),
+				sar.WithDataOrder(dataOrder),
+				sar.WithChunking(*chunkSize, *chunkAtFiles),
+				sar.WithCompressionWorkers(*workers),
+			}
+			if *checksum != "" {
+				csum, ok := checksumSchemes[*checksum]
+				if !ok {
+					return errors.Reason("unknown checksum scheme %(c)q").
+						D("c", *checksum).Err()
+				}
+				opts = append(opts, sar.WithChecksum(csum))
+			}
+			if *dict != "" {
+				dictData, err := readDicts([]string{*dict})
+				if err != nil {
+					return err
+				}
+				opts = append(opts, sar.WithZstdDict(dictData[0], *embedDict))
+			}
+			rpt := &sar.ScanReport{}
+			createRpt := &sar.CreateReport{}
+			opts = append(opts, sar.WithScanReport(rpt), sar.WithCreateReport(createRpt))
+			if *progress > 0 {
+				opts = append(opts, sar.WithCreateProgress(printProgress, *progress))
+			}
+
+			archive, dir := args[0], args[1]
+			out := io.WriteCloser(os.Stdout)
+			if archive != "-" {
+				f, err := os.Create(archive)
+				if err != nil {
+					return err
+				}
+				out = f
+			}
+			bufOut := bufio.NewWriter(out)
+
+			err := sar.CreateFromPath(bufOut, dir, opts...)
+			if err == nil {
+				err = bufOut.Flush()
+			}
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				if archive != "-" {
+					os.Remove(archive)
+				}
+				return err
+			}
+
+			for _, s := range rpt.Skipped {
+				path := strings.Join(s.Path, "/")
+				if s.Err != nil {
+					logging.Warningf(ctx, "skipped %q (%s): %s", path, s.Reason, s.Err)
+				} else {
+					logging.Warningf(ctx, "skipped %q (%s)", path, s.Reason)
+				}
+			}
+			if cKind == sardata.CompressionAuto {
+				logging.Infof(ctx, "chose %s at level %d (compressed to %.1f%%)",
+					createRpt.Compression, createRpt.CompressionLevel, 100*createRpt.Ratio())
+			}
+			return nil
+		}
+	},
+}
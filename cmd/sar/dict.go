@@ -0,0 +1,69 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar"
+	"github.com/riannucci/sarchive/sar/sardata"
+)
+
+// dictFlag registers the -dict flag on fs.
+func dictFlag(fs *flag.FlagSet) *stringList {
+	ret := &stringList{}
+	fs.Var(ret, "dict",
+		"A zstd dictionary file, for archives which were created with -dict but "+
+			"without -embed-dict (may be repeated).")
+	return ret
+}
+
+// readDicts reads the dictionary files at paths.
+func readDicts(paths []string) ([][]byte, error) {
+	ret := make([][]byte, len(paths))
+	for i, path := range paths {
+		var err error
+		if ret[i], err = ioutil.ReadFile(path); err != nil {
+			return nil, errors.Annotate(err).Reason("reading dictionary").Err()
+		}
+	}
+	return ret, nil
+}
+
+var cmdTrainDict = &subcommand{
+	args: "<dict> <sample>...",
+	help: "Trains a zstd dictionary for 'create -dict' and writes it to dict. Each sample " +
+		"may be a file, a directory or an archive.",
+	nargs: -2,
+	flags: func(fs *flag.FlagSet) func(context.Context, []string) error {
+		size := fs.Int("size", 112640, "The maximum size of the dictionary, in bytes.")
+		dicts := dictFlag(fs)
+
+		return func(ctx context.Context, args []string) error {
+			dictData, err := readDicts(*dicts)
+			if err != nil {
+				return err
+			}
+			dict, err := sar.TrainZstdDict(args[1:], *size, sar.WithZstdDicts(dictData...))
+			if err != nil {
+				return err
+			}
+			id, err := sardata.ZstdDictID(dict)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(args[0], dict, 0666); err != nil {
+				return err
+			}
+			fmt.Printf("wrote dictionary %d (%d bytes)\n", id, len(dict))
+			return nil
+		}
+	},
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar"
+)
+
+var existingPolicies = map[string]sar.ExistingPolicy{
+	"fail":      sar.ExistingFail,
+	"overwrite": sar.ExistingOverwrite,
+	"skip":      sar.ExistingSkip,
+	"replace":   sar.ExistingReplaceIfDifferent,
+	"mirror":    sar.ExistingMirror,
+}
+
+var symlinkPolicies = map[string]sar.SymlinkPolicy{
+	"allow":  sar.SymlinksAllow,
+	"skip":   sar.SymlinksSkip,
+	"reject": sar.SymlinksReject,
+}
+
+var verifyStates = map[string]sar.VerifyStateEnum{
+	"late":  sar.VerifyLate,
+	"early": sar.VerifyEarly,
+	"never": sar.VerifyNever,
+}
+
+// stringList is a flag.Value which collects every occurrence of a repeated
+// flag.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringList) Set(val string) error {
+	*s = append(*s, val)
+	return nil
+}
+
+var cmdExtract = &subcommand{
+	args:  "<archive> <dir>",
+	help:  "Extracts the archive to dir, which must not exist or be empty (see -existing).",
+	nargs: 2,
+	flags: func(fs *flag.FlagSet) func(context.Context, []string) error {
+		bufferSize := fs.Int("buffer", 16*1024*1024,
+			"The number of bytes to decompress ahead of the file writes.")
+		workers := fs.Int("workers", 1,
+			"For chunked archives, the number of chunks to decompress (and small "+
+				"files to write) concurrently.")
+		verify := fs.String("verify", "late",
+			"When to verify the archive checksum; one of: early, late, never. "+
+				"'early' verifies the whole archive before extracting anything.")
+		existing := fs.String("existing", "fail",
+			"What to do with existing entries in dir; one of: fail, overwrite, skip, "+
+				"replace, mirror. 'replace' only overwrites entries which differ, and "+
+				"'mirror' also deletes entries which aren't in the archive.")
+		compareContents := fs.Bool("compare-contents", false,
+			"Compare the contents of existing files for -existing replace and mirror.")
+		report := fs.Bool("report", false,
+			"Print the action taken for every path.")
+		atomic := fs.Bool("atomic", false,
+			"Extract to a staging directory next to dir, and only move it into place "+
+				"once the archive is verified.")
+		backup := fs.String("backup", "",
+			"Implies -atomic. If dir isn't empty, it's moved to this path before the "+
+				"staging directory is moved into place.")
+		symlinks := fs.String("symlinks", "allow",
+			"What to do with symlinks in the archive; one of: allow, skip, reject. "+
+				"'reject' fails before extracting anything if there are any.")
+		progress := progressFlag(fs)
+		dicts := dictFlag(fs)
+		maxSize := fs.Uint64("max-size", 0,
+			"If nonzero, refuse archives whose files total more than this many bytes.")
+		maxRatio := fs.Float64("max-ratio", 0,
+			"If nonzero, refuse archives whose compression ratio is higher than this.")
+		maxEntries := fs.Int("max-entries", 0,
+			"If nonzero, refuse archives with more than this many entries.")
+		maxMemory := fs.Uint64("max-memory", 0,
+			"If nonzero, refuse archives which need more than this many bytes of "+
+				"memory for the decompressor's window or dictionary (default 256MB).")
+		var include, exclude stringList
+		fs.Var(&include, "include",
+			"Only extract entries matching this glob (may be repeated). '**' matches "+
+				"any number of path components.")
+		fs.Var(&exclude, "exclude",
+			"Don't extract entries matching this glob (may be repeated).")
+
+		return func(ctx context.Context, args []string) error {
+			verifyState, ok := verifyStates[*verify]
+			if !ok {
+				return errors.Reason("unknown verification mode %(v)q").
+					D("v", *verify).Err()
+			}
+
+			existingPolicy, ok := existingPolicies[*existing]
+			if !ok {
+				return errors.Reason("unknown existing policy %(p)q").
+					D("p", *existing).Err()
+			}
+
+			symlinkPolicy, ok := symlinkPolicies[*symlinks]
+			if !ok {
+				return errors.Reason("unknown symlink policy %(p)q").
+					D("p", *symlinks).Err()
+			}
+
+			dictData, err := readDicts(*dicts)
+			if err != nil {
+				return err
+			}
+
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			openOpts := []sar.OpenOption{
+				sar.WithZstdDicts(dictData...),
+				sar.WithVerification(verifyState),
+				sar.WithUnpackBufferSize(*bufferSize),
+				sar.WithUnpackWorkers(*workers),
+				sar.WithMaxTotalSize(*maxSize),
+				sar.WithMaxCompressionRatio(*maxRatio),
+				sar.WithMaxEntries(*maxEntries),
+				sar.WithMaxDecoderMemory(*maxMemory),
+			}
+			if *progress > 0 {
+				openOpts = append(openOpts, sar.WithProgress(printProgress, *progress))
+			}
+			ar, err := sar.Open(f, openOpts...)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			rpt := &sar.UnpackReport{}
+			opts := []sar.UnpackOption{
+				sar.WithInclude(include...), sar.WithExclude(exclude...),
+				sar.WithExistingPolicy(existingPolicy),
+				sar.WithSymlinkPolicy(symlinkPolicy),
+				sar.WithCompareContents(*compareContents),
+				sar.WithAtomic(*atomic),
+				sar.WithUnpackReport(rpt),
+			}
+			if *backup != "" {
+				opts = append(opts, sar.WithAtomicBackup(*backup))
+			}
+			err = ar.UnpackTo(ctx, args[1], opts...)
+			if *report {
+				for _, e := range rpt.Entries {
+					fmt.Printf("%-11s %s\n", strings.TrimPrefix(e.Action.String(), "Action"),
+						strings.Join(e.Path, "/"))
+				}
+			}
+			return err
+		}
+	},
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar"
+	"github.com/riannucci/sarchive/sar/sardata"
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+var cmdList = &subcommand{
+	args:  "<archive>",
+	help:  "Lists the entries in the archive's table of contents.",
+	nargs: 1,
+	flags: func(fs *flag.FlagSet) func(context.Context, []string) error {
+		long := fs.Bool("l", false, "Show entry types, modes and sizes.")
+		dicts := dictFlag(fs)
+
+		return func(ctx context.Context, args []string) error {
+			dictData, err := readDicts(*dicts)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			// Closing the archive would decompress (and discard) all of the data,
+			// which listing doesn't need, so just close the file.
+			defer f.Close()
+			ar, err := sar.Open(f, sar.WithVerification(sar.VerifyNever), sar.WithZstdDicts(dictData...))
+			if err != nil {
+				return err
+			}
+
+			return ar.TOC.LoopItems(func(path []string, ent *toc.Entry) error {
+				rel := strings.Join(path, "/")
+				if !*long {
+					if ent.GetTree() != nil {
+						rel += "/"
+					}
+					_, err := fmt.Println(rel)
+					return err
+				}
+
+				switch x := ent.Etype.(type) {
+				case *toc.Entry_File:
+					mode := []byte("f--")
+					if x.File.GetPosixMode().GetExecutable() {
+						mode[1] = 'x'
+					}
+					if x.File.GetCommonMode().GetReadonly() {
+						mode[2] = 'r'
+					}
+					_, err = fmt.Printf("%s %12d %s\n", mode, x.File.Size, rel)
+				case *toc.Entry_Tree:
+					_, err = fmt.Printf("d-- %12s %s/\n", "-", rel)
+				case *toc.Entry_Symlink:
+					_, err = fmt.Printf("l-- %12s %s -> %s\n", "-", rel,
+						strings.Join(x.Symlink.Target, "/"))
+				}
+				return err
+			})
+		}
+	},
+}
+
+var cmdVerify = &subcommand{
+	args:  "<archive>",
+	help:  "Verifies the archive's checksum and table of contents.",
+	nargs: 1,
+	flags: func(fs *flag.FlagSet) func(context.Context, []string) error {
+		progress := progressFlag(fs)
+		dicts := dictFlag(fs)
+
+		return func(ctx context.Context, args []string) error {
+			dictData, err := readDicts(*dicts)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			opts := []sar.OpenOption{
+				sar.WithVerification(sar.VerifyEarly),
+				sar.WithZstdDicts(dictData...),
+			}
+			if *progress > 0 {
+				opts = append(opts, sar.WithProgress(printProgress, *progress))
+			}
+			ar, err := sar.Open(f, opts...)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			if err := ar.Close(); err != nil {
+				return err
+			}
+			fmt.Println("OK")
+			return nil
+		}
+	},
+}
+
+var cmdInfo = &subcommand{
+	args:  "<archive>",
+	help:  "Prints information about the archive's format and contents.",
+	nargs: 1,
+	flags: func(fs *flag.FlagSet) func(context.Context, []string) error {
+		dicts := dictFlag(fs)
+
+		return func(ctx context.Context, args []string) error {
+			dictData, err := readDicts(*dicts)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			c, _, _, nominalCsum, err := sardata.ParseTrailer(f)
+			if err != nil {
+				return errors.Annotate(err).Reason("parsing trailer").Err()
+			}
+
+			version, err := sardata.ReadMagic(f)
+			if err != nil {
+				return errors.Annotate(err).Reason("checking magic").Err()
+			}
+
+			var dictSec *sardata.DictSection
+			var dict []byte
+			hasDataOrder := version&sardata.VersionDataOrderFlag != 0
+			if version&sardata.VersionDictFlag != 0 {
+				dictSec = &sardata.DictSection{}
+				if err := dictSec.Read(f); err != nil {
+					return errors.Annotate(err).Reason("reading dictionary section").Err()
+				}
+				if dict = dictSec.Embedded; dict == nil {
+					for _, d := range dictData {
+						if id, err := sardata.ZstdDictID(d); err == nil && id == dictSec.ID {
+							dict = d
+						}
+					}
+				}
+				if dict == nil {
+					return errors.Reason("archive requires zstd dictionary %(id)d; supply it with -dict").
+						D("id", dictSec.ID).Err()
+				}
+			}
+
+			version &^= sardata.VersionFlags
+
+			tocStart, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			tocHeader := sardata.BlockHeader{}
+			if err := tocHeader.Read(f); err != nil {
+				return errors.Annotate(err).Reason("reading TOC header").Err()
+			}
+			if _, err := f.Seek(tocStart, io.SeekStart); err != nil {
+				return err
+			}
+			t, err := sardata.ReadTOCConfig(f, 0, sardata.DecoderConfig{Dict: dict})
+			if err != nil {
+				return errors.Annotate(err).Reason("reading TOC").Err()
+			}
+
+			// ReadTOC isn't guaranteed to consume the whole TOC block, so seek
+			// past it using the header.
+			if _, err := f.Seek(tocStart, io.SeekStart); err != nil {
+				return err
+			}
+			if err := tocHeader.Read(f); err != nil {
+				return err
+			}
+			if _, err := f.Seek(int64(tocHeader.Length), io.SeekCurrent); err != nil {
+				return err
+			}
+			dataHeader := sardata.BlockHeader{}
+			var chunks *sardata.ChunkIndex
+			if version == sardata.VersionChunked {
+				if chunks, err = sardata.ReadChunkIndex(f); err != nil {
+					return errors.Annotate(err).Reason("reading chunk index").Err()
+				}
+				dataHeader = sardata.BlockHeader{
+					Length: chunks.CompressedSize(), Compression: chunks.Compression,
+					SampleRatio: chunks.SampleRatio}
+			} else if err := dataHeader.Read(f); err != nil {
+				return errors.Annotate(err).Reason("reading data header").Err()
+			}
+
+			var files, trees, links int
+			var totalSize uint64
+			t.LoopItems(func(path []string, ent *toc.Entry) error {
+				switch x := ent.Etype.(type) {
+				case *toc.Entry_File:
+					files++
+					totalSize += x.File.Size
+				case *toc.Entry_Tree:
+					trees++
+				case *toc.Entry_Symlink:
+					links++
+				}
+				return nil
+			})
+
+			fmt.Printf("version:    %d\n", version)
+			fmt.Printf("toc:        %s, %d bytes\n", tocHeader.Compression, tocHeader.Length)
+			fmt.Printf("data:       %s, %d bytes (%d uncompressed)\n",
+				dataHeader.Compression, dataHeader.Length, totalSize)
+			if dataHeader.SampleRatio != 0 {
+				fmt.Printf("auto:       sample ratio %.3f\n", dataHeader.SampleRatio)
+			}
+			if chunks != nil {
+				fmt.Printf("chunks:     %d\n", len(chunks.Chunks))
+			}
+			if dictSec != nil {
+				where := "external"
+				if dictSec.Embedded != nil {
+					where = fmt.Sprintf("embedded, %d bytes", len(dictSec.Embedded))
+				}
+				fmt.Printf("dictionary: %d (%s)\n", dictSec.ID, where)
+			}
+			fmt.Printf("entries:    %d files, %d dirs, %d symlinks\n", files, trees, links)
+			if hasDataOrder {
+				fmt.Printf("data order: explicit\n")
+			}
+			fmt.Printf("case safe:  %t\n", t.CaseSafe)
+			fmt.Printf("checksum:   %s %x\n", c, nominalCsum)
+			return nil
+		}
+	},
+}
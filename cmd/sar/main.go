@@ -0,0 +1,166 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Command sar creates, extracts and inspects SARchive files.
+//
+// Usage:
+//
+//	sar create [flags] <archive> <dir>
+//	sar extract [flags] <archive> <dir>
+//	sar list [flags] <archive>
+//	sar verify <archive>
+//	sar info [flags] <archive>
+//	sar train-dict [flags] <dict> <sample>...
+//
+// An <archive> of "-" for create means stdout.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/luci/luci-go/common/logging/gologger"
+
+	"github.com/riannucci/sarchive/sar"
+	"github.com/riannucci/sarchive/sar/sardata"
+)
+
+// subcommand is a single sar subcommand.
+type subcommand struct {
+	args  string
+	help  string
+	flags func(fs *flag.FlagSet) func(ctx context.Context, args []string) error
+
+	// nargs is the number of positional args. If it's negative, -nargs is the
+	// minimum number.
+	nargs int
+}
+
+var subcommands = map[string]*subcommand{
+	"create":  cmdCreate,
+	"extract": cmdExtract,
+	"list":    cmdList,
+	"verify":  cmdVerify,
+	"info":    cmdInfo,
+
+	"train-dict": cmdTrainDict,
+}
+
+// compressionSchemes are the registered compression schemes (see
+// sardata.RegisterCompression) and "auto", by name.
+var compressionSchemes = func() map[string]sardata.CompressionScheme {
+	ret := map[string]sardata.CompressionScheme{"auto": sardata.CompressionAuto}
+	for _, c := range sardata.CompressionSchemes() {
+		ret[c.String()] = c
+	}
+	return ret
+}()
+
+var checksumSchemes = map[string]sardata.ChecksumScheme{
+	"sha2-256": sardata.ChecksumSHA2_256,
+	"sha2-512": sardata.ChecksumSHA2_512,
+	"blake2s":  sardata.ChecksumBLAKE2s,
+	"blake2b":  sardata.ChecksumBLAKE2b,
+	"sha3-256": sardata.ChecksumSHA3_256,
+	"sha3-512": sardata.ChecksumSHA3_512,
+	"null":     sardata.ChecksumNULL,
+}
+
+// keys returns the sorted, comma separated keys of one of the scheme maps
+// above, for use in flag help and error messages.
+func keys(m interface{}) string {
+	var ret []string
+	switch x := m.(type) {
+	case map[string]sardata.CompressionScheme:
+		for k := range x {
+			ret = append(ret, k)
+		}
+	case map[string]sardata.ChecksumScheme:
+		for k := range x {
+			ret = append(ret, k)
+		}
+	case map[string]sar.DataOrder:
+		for k := range x {
+			ret = append(ret, k)
+		}
+	case map[string]*subcommand:
+		for k := range x {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return strings.Join(ret, ", ")
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: sar <command> [flags] [args]\n\n")
+	fmt.Fprintf(os.Stderr, "commands: %s\n", keys(subcommands))
+	fmt.Fprintf(os.Stderr, "use 'sar <command> -help' for more information.\n")
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run executes the subcommand named by args[0], and returns the process exit
+// code.
+func run(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "sar: unknown command %q\n", args[0])
+		usage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet("sar "+args[0], flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: sar %s [flags] %s\n\n%s\n\n", args[0], cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	runFn := cmd.flags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if (cmd.nargs >= 0 && fs.NArg() != cmd.nargs) || fs.NArg() < -cmd.nargs {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(gologger.StdConfig.Use(context.Background()))
+	defer cancel()
+	// The first interrupt cancels the operation, the second one kills the
+	// process.
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, os.Interrupt)
+	go func() {
+		<-sigC
+		cancel()
+		signal.Stop(sigC)
+	}()
+
+	if err := runFn(ctx, fs.Args()); err != nil {
+		switch x := err.(type) {
+		case *sardata.ErrMismatchedChecksum:
+			fmt.Fprintf(os.Stderr, "sar %s: archive is corrupt: %s\n", args[0], x)
+		case *sar.UnpackError:
+			fmt.Fprintf(os.Stderr, "sar %s: %d errors while unpacking:\n", args[0], len(x.Entries))
+			for _, e := range x.Entries {
+				fmt.Fprintf(os.Stderr, "  %s\n", e)
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "sar %s: %s\n", args[0], err)
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// runCaptured calls run with args, and returns its exit code along with
+// everything it printed to stdout and stderr.
+//
+// This swaps os.Stdout and os.Stderr, so tests which use it can't be parallel.
+func runCaptured(args ...string) (code int, stdout, stderr string) {
+	capture := func(f **os.File) func() string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			panic(err)
+		}
+		orig := *f
+		*f = w
+		buf := &bytes.Buffer{}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			io.Copy(buf, r)
+		}()
+		return func() string {
+			*f = orig
+			w.Close()
+			<-done
+			r.Close()
+			return buf.String()
+		}
+	}
+	outFn, errFn := capture(&os.Stdout), capture(&os.Stderr)
+	code = run(args)
+	return code, outFn(), errFn()
+}
+
+func TestCLI(t *testing.T) {
+	Convey("sar", t, func() {
+		tmp, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmp)
+
+		src := filepath.Join(tmp, "src")
+		So(os.MkdirAll(filepath.Join(src, "sub"), 0777), ShouldBeNil)
+		files := map[string]string{
+			"someFile":    "someFile data",
+			"sub/subFile": "sub/subFile data",
+		}
+		for path, data := range files {
+			So(ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(path)), []byte(data), 0666), ShouldBeNil)
+		}
+		archive := filepath.Join(tmp, "archive.sar")
+
+		Convey("create, list, extract and verify", func() {
+			code, _, stderr := runCaptured("create", archive, src)
+			So(stderr, ShouldEqual, "")
+			So(code, ShouldEqual, 0)
+
+			code, stdout, _ := runCaptured("list", archive)
+			So(code, ShouldEqual, 0)
+			So(stdout, ShouldEqual, "someFile\nsub/\nsub/subFile\n")
+
+			dst := filepath.Join(tmp, "dst")
+			code, _, stderr = runCaptured("extract", archive, dst)
+			So(stderr, ShouldEqual, "")
+			So(code, ShouldEqual, 0)
+			for path, data := range files {
+				actual, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(path)))
+				So(err, ShouldBeNil)
+				So(string(actual), ShouldEqual, data)
+			}
+
+			code, stdout, _ = runCaptured("verify", archive)
+			So(code, ShouldEqual, 0)
+			So(stdout, ShouldEqual, "OK\n")
+		})
+
+		Convey("corrupt archive", func() {
+			code, _, _ := runCaptured("create", "-compression", "none", archive, src)
+			So(code, ShouldEqual, 0)
+
+			data, err := ioutil.ReadFile(archive)
+			So(err, ShouldBeNil)
+			idx := bytes.Index(data, []byte("sub/subFile data"))
+			So(idx, ShouldBeGreaterThan, 0)
+			data[idx] = 'S'
+			So(ioutil.WriteFile(archive, data, 0666), ShouldBeNil)
+
+			code, stdout, stderr := runCaptured("verify", archive)
+			So(code, ShouldEqual, 1)
+			So(stdout, ShouldEqual, "")
+			So(stderr, ShouldContainSubstring, "sar verify: archive is corrupt")
+
+			code, _, stderr = runCaptured("extract", archive, filepath.Join(tmp, "dst"))
+			So(code, ShouldEqual, 1)
+			So(stderr, ShouldContainSubstring, "sar extract: archive is corrupt")
+		})
+
+		Convey("usage errors", func() {
+			code, _, _ := runCaptured("bogus")
+			So(code, ShouldEqual, 2)
+			code, _, _ = runCaptured("list")
+			So(code, ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/riannucci/sarchive/sar"
+)
+
+// progressFlag registers the -progress flag on fs.
+func progressFlag(fs *flag.FlagSet) *time.Duration {
+	return fs.Duration("progress", 0,
+		"If nonzero, print progress to stderr at this interval (e.g. 1s).")
+}
+
+func mb(n int64) string {
+	return fmt.Sprintf("%.1fMB", float64(n)/(1024*1024))
+}
+
+// printProgress prints a single-line status for p to stderr.
+func printProgress(p sar.Progress) {
+	var status string
+	switch {
+	case p.CompressedTotal > 0:
+		status = fmt.Sprintf("%s / %s (%d%%)", mb(p.CompressedBytes), mb(p.CompressedTotal),
+			p.CompressedBytes*100/p.CompressedTotal)
+	case p.UncompressedTotal > 0:
+		status = fmt.Sprintf("%s / %s (%d%%), %d / %d entries", mb(p.UncompressedBytes),
+			mb(p.UncompressedTotal), p.UncompressedBytes*100/p.UncompressedTotal,
+			p.Entries, p.EntriesTotal)
+	default:
+		status = fmt.Sprintf("%s, %d entries", mb(p.UncompressedBytes), p.Entries)
+	}
+	if p.Path != nil {
+		status += " " + strings.Join(p.Path, "/")
+	}
+	if len(status) > 100 {
+		status = status[:97] + "..."
+	}
+	end := ""
+	if p.Done {
+		end = "\n"
+	}
+	// \033[K clears the rest of the line.
+	fmt.Fprintf(os.Stderr, "\r%s: %s\033[K%s", p.Stage, status, end)
+}
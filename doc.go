@@ -29,7 +29,9 @@
 //
 // archive_data is all of the file data noted in the table_of_contents,
 // concatenated and compressed. The offsets and sizes in table_of_contents refer
-// to locations in the uncompressed archive_data stream.
+// to locations in the uncompressed archive_data stream. The files appear in the
+// depth-first order of table_of_contents, unless it has a data_order (in which
+// case the magic header's version has VersionDataOrderFlag set).
 //
 // checksum indicates the type of checksum, followed by the bytes of the
 // checksum, followed by the length of the checksum (as a single byte). The
@@ -37,9 +39,6 @@
 // inidicator. The length at the end of the checksum allows the checksum to be
 // validated simply by reading from the end of the archive without parsing it.
 //
-// TODO(riannucci): implement better compression scheme like brotli or zstd...
-// this depends on better compression support becoming available in golang.
-//
 // TODO(riannucci): if the format requires greater extensibility, implement
 // a PNG-like chunk scheme (i.e. with FourCC identifiers for sections).
 package sarchive
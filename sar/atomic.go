@@ -0,0 +1,124 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/luci/luci-go/common/errors"
+)
+
+// mkStagingDir makes a new, uniquely named directory next to root.
+//
+// Unlike ioutil.TempDir, the directory is made with mode 0777 (subject to the
+// umask), since it will become root.
+func mkStagingDir(root string) (string, error) {
+	dir, base := filepath.Split(root)
+	for i := 0; i < 10000; i++ {
+		ret := filepath.Join(dir, "."+base+".sar-staging-"+strconv.FormatUint(uint64(rand.Uint32()), 36))
+		err := os.Mkdir(ret, 0777)
+		if err == nil {
+			return ret, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+	return "", errors.New("could not find an unused staging directory name")
+}
+
+// isEmptyDir returns true iff path is an existing, empty directory. Returns an
+// error if path exists, but isn't a directory.
+func isEmptyDir(path string) (exists, empty bool, err error) {
+	st, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return false, false, nil
+	case err != nil:
+		return false, false, err
+	case !st.IsDir():
+		return true, false, errors.New("not a directory")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return true, false, err
+	}
+	defer f.Close()
+	if _, err = f.Readdirnames(1); err == io.EOF {
+		return true, true, nil
+	}
+	return true, false, err
+}
+
+// unpackAtomic unpacks to a staging directory next to root, and then renames it
+// to root. If opts.backup is set, any existing root is renamed to it first.
+func (a *OpenedArchive) unpackAtomic(ctx context.Context, root string, opts unpackOptions) (err error) {
+	exists, empty, err := isEmptyDir(root)
+	if err != nil {
+		return errors.Annotate(err).Reason("checking root").Err()
+	}
+	if exists && !empty {
+		if opts.backup == "" {
+			return errors.New("checking root: dir not empty")
+		}
+		if _, err := os.Lstat(opts.backup); !os.IsNotExist(err) {
+			if err == nil {
+				err = errors.New("already exists")
+			}
+			return errors.Annotate(err).Reason("checking backup %(backup)q").
+				D("backup", opts.backup).Err()
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(root), 0777); err != nil {
+		return errors.Annotate(err).Reason("making root's parent dir").Err()
+	}
+
+	staging, err := mkStagingDir(root)
+	if err != nil {
+		return errors.Annotate(err).Reason("making staging dir").Err()
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(staging)
+		}
+	}()
+
+	if err = a.unpackTo(ctx, staging, opts); err != nil {
+		return
+	}
+
+	removedEmpty, backedUp := false, false
+	switch {
+	case exists && empty:
+		if err = os.Remove(root); err != nil {
+			return errors.Annotate(err).Reason("removing empty root").Err()
+		}
+		removedEmpty = true
+	case exists:
+		if err = os.Rename(root, opts.backup); err != nil {
+			return errors.Annotate(err).Reason("moving root to backup").Err()
+		}
+		backedUp = true
+	}
+	if err = os.Rename(staging, root); err != nil {
+		if removedEmpty {
+			os.Mkdir(root, 0777)
+		}
+		if backedUp {
+			if rerr := os.Rename(opts.backup, root); rerr != nil {
+				return errors.Annotate(err).Reason(
+					"moving staging dir to root (and restoring backup: %(rerr)s)").
+					D("rerr", rerr).Err()
+			}
+		}
+		return errors.Annotate(err).Reason("moving staging dir to root").Err()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+)
+
+func TestUnpackAtomic(tst *testing.T) {
+	tst.Parallel()
+
+	Convey("UnpackTo WithAtomic", tst, func() {
+		buf := &bytes.Buffer{}
+		b, err := NewBuilder(buf)
+		So(err, ShouldBeNil)
+		So(b.AddFile([]string{"file"}, 9, 0644, strings.NewReader("file data")), ShouldBeNil)
+		So(b.Finish(), ShouldBeNil)
+
+		parent, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(parent)
+		root := filepath.Join(parent, "root")
+		backup := filepath.Join(parent, "backup")
+
+		listParent := func() []string {
+			fis, err := ioutil.ReadDir(parent)
+			So(err, ShouldBeNil)
+			ret := []string{}
+			for _, fi := range fis {
+				ret = append(ret, fi.Name())
+			}
+			return ret
+		}
+
+		unpack := func(data []byte, opts ...UnpackOption) error {
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(data)})
+			So(err, ShouldBeNil)
+			return ar.UnpackTo(context.Background(), root, opts...)
+		}
+
+		Convey("missing root", func() {
+			So(unpack(buf.Bytes(), WithAtomic(true)), ShouldBeNil)
+			So(readTree(root), ShouldResemble, map[string]string{"file": "file data"})
+			So(listParent(), ShouldResemble, []string{"root"})
+		})
+
+		Convey("empty root", func() {
+			So(os.Mkdir(root, 0777), ShouldBeNil)
+			So(unpack(buf.Bytes(), WithAtomic(true)), ShouldBeNil)
+			So(readTree(root), ShouldResemble, map[string]string{"file": "file data"})
+			So(listParent(), ShouldResemble, []string{"root"})
+		})
+
+		Convey("non-empty root", func() {
+			mkTree(root, map[string]string{"old": "old data"})
+
+			Convey("without backup", func() {
+				So(unpack(buf.Bytes(), WithAtomic(true)), ShouldErrLike, "dir not empty")
+				So(listParent(), ShouldResemble, []string{"root"})
+			})
+
+			Convey("with backup", func() {
+				So(unpack(buf.Bytes(), WithAtomicBackup(backup)), ShouldBeNil)
+				So(readTree(root), ShouldResemble, map[string]string{"file": "file data"})
+				So(readTree(backup), ShouldResemble, map[string]string{"old": "old data"})
+				So(listParent(), ShouldResemble, []string{"backup", "root"})
+			})
+
+			Convey("with existing backup", func() {
+				So(os.Mkdir(backup, 0777), ShouldBeNil)
+				So(unpack(buf.Bytes(), WithAtomicBackup(backup)), ShouldErrLike, "already exists")
+			})
+
+			Convey("bad checksum", func() {
+				newBytes := make([]byte, buf.Len())
+				copy(newBytes, buf.Bytes())
+				newBytes[len(newBytes)-10]++ // break the checksum
+
+				So(unpack(newBytes, WithAtomicBackup(backup)), ShouldErrLike, "mismatched checksum")
+				So(readTree(root), ShouldResemble, map[string]string{"old": "old data"})
+				So(listParent(), ShouldResemble, []string{"root"})
+			})
+		})
+
+		Convey("with an existing policy", func() {
+			So(unpack(buf.Bytes(), WithAtomic(true), WithExistingPolicy(ExistingOverwrite)),
+				ShouldErrLike, "may not be combined")
+		})
+	})
+}
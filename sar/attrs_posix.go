@@ -13,3 +13,7 @@ import (
 func setWinFileAttributes(path string, m *toc.WinMode) error {
 	return nil
 }
+
+func getWinFileAttributes(path string) (*toc.WinMode, error) {
+	return nil, nil
+}
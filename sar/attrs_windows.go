@@ -38,3 +38,21 @@ func setWinFileAttributes(path string, m *toc.WinMode) error {
 	}
 	return syscall.SetFileAttributes(p, uint32(attrs))
 }
+
+func getWinFileAttributes(path string) (*toc.WinMode, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return nil, err
+	}
+	if attrs&(winAttrHidden|winAttrSystem) == 0 {
+		return nil, nil
+	}
+	return &toc.WinMode{
+		Hidden: attrs&winAttrHidden != 0,
+		System: attrs&winAttrSystem != 0,
+	}, nil
+}
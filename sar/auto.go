@@ -0,0 +1,93 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+)
+
+// autoWriter implements sardata.CompressionAuto for an archiveWriter. It
+// buffers the first sardata.AutoSampleSize bytes of the data, and then chooses
+// the compression scheme with them, opens the data block, and writes them to
+// it.
+type autoWriter struct {
+	w *archiveWriter
+
+	sample bytes.Buffer
+
+	// boundaries are the lengths of sample at each file boundary, which are
+	// replayed to the data block along with the sample.
+	boundaries []int
+
+	// trials are the sample compressions which the scheme was chosen with.
+	trials []sardata.CompressionTrial
+}
+
+func (a *autoWriter) Write(p []byte) (int, error) {
+	if a.w.block != nil {
+		return a.w.block.Write(p)
+	}
+	room := sardata.AutoSampleSize - a.sample.Len()
+	if len(p) < room {
+		return a.sample.Write(p)
+	}
+	a.sample.Write(p[:room])
+	if err := a.choose(); err != nil {
+		return 0, err
+	}
+	n, err := a.w.block.Write(p[room:])
+	return room + n, err
+}
+
+func (a *autoWriter) fileBoundary() {
+	a.boundaries = append(a.boundaries, a.sample.Len())
+}
+
+// choose chooses the compression scheme with the sample (however big it is so
+// far), and opens the data block. It does nothing if the block is already
+// open.
+func (a *autoWriter) choose() error {
+	w := a.w
+	if w.block != nil {
+		return nil
+	}
+	chosen, trials, err := sardata.ChooseCompression(a.sample.Bytes())
+	if err != nil {
+		return errors.Annotate(err).Reason("choosing compression").Err()
+	}
+	a.trials = trials
+	w.opts.compressKind, w.opts.compressLevel = chosen.Scheme, chosen.Level
+	w.sampleRatio = chosen.Ratio
+	if err := w.openBlock(); err != nil {
+		return err
+	}
+
+	sample, prev := a.sample.Bytes(), 0
+	for _, b := range a.boundaries {
+		if _, err := w.block.Write(sample[prev:b]); err != nil {
+			return err
+		}
+		if err := w.fileBoundary(); err != nil {
+			return err
+		}
+		prev = b
+	}
+	if _, err := w.block.Write(sample[prev:]); err != nil {
+		return err
+	}
+	a.sample, a.boundaries = bytes.Buffer{}, nil
+	return nil
+}
+
+func (a *autoWriter) Close() error {
+	if err := a.choose(); err != nil {
+		return err
+	}
+	return a.w.block.Close()
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/luci/luci-go/common/data/stringset"
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// openTree is a Tree in a Builder which may still have entries added to it.
+type openTree struct {
+	tree       *toc.Tree
+	names      stringset.Set
+	lowerNames stringset.Set
+}
+
+func newOpenTree(t *toc.Tree) *openTree {
+	return &openTree{t, stringset.New(0), stringset.New(0)}
+}
+
+// Builder incrementally writes an archive from entries which don't need to
+// exist on disk.
+//
+// Because the archive data is stored in the depth-first order that
+// TOC.LoopItems traverses, entries must be added in that same order: once an
+// entry has been added to a directory, no more entries may be added to any of
+// that directory's previous subdirectories. In other words, every entry's
+// parent must be the root, the most recently added directory, or one of that
+// directory's ancestors.
+//
+// The archive is written to the output when Finish is called. Until then, the
+// compressed archive data is buffered in memory.
+//
+// Errors for out-of-order or invalid entries leave the Builder unchanged.
+// However, if AddFile fails while copying the file's data, the error is
+// permanent and all subsequent calls will return it.
+type Builder struct {
+	aw *archiveWriter
+	t  *toc.TOC
+
+	// open is the stack of Trees which may still receive new entries. open[0] is
+	// the root Tree, and openPath[i] is the name of open[i+1].
+	open     []*openTree
+	openPath []string
+
+	err error
+}
+
+// NewBuilder returns a new Builder which will write an archive to out. It
+// accepts the same options as CreateFromPath, except for WithDataOrder.
+func NewBuilder(out io.Writer, options ...CreateOption) (*Builder, error) {
+	opts, err := parseCreateOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if opts.dataOrder != DataOrderTOC {
+		return nil, errors.New("WithDataOrder is not supported by Builder")
+	}
+	aw, err := newArchiveWriter(out, opts)
+	if err != nil {
+		return nil, err
+	}
+	aw.progress.start(StageCreate, 0, 0, 0)
+	t := &toc.TOC{CaseSafe: true, Root: &toc.Tree{}}
+	return &Builder{
+		aw:   aw,
+		t:    t,
+		open: []*openTree{newOpenTree(t.Root)},
+	}, nil
+}
+
+// isOpen returns true iff the directory at path may still receive new entries.
+func (b *Builder) isOpen(path []string) bool {
+	if len(path) >= len(b.open) {
+		return false
+	}
+	for i, p := range path {
+		if b.openPath[i] != p {
+			return false
+		}
+	}
+	return true
+}
+
+// add inserts a new Entry at path, which must be a legal (i.e. ordered)
+// location for a new entry.
+func (b *Builder) add(path []string, ent *toc.Entry) error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(path) == 0 {
+		return errors.New("empty path")
+	}
+	name := path[len(path)-1]
+	if err := toc.ValidateName(name); err != nil {
+		return errors.Annotate(err).Reason("adding %(path)q").
+			D("path", strings.Join(path, "/")).Err()
+	}
+	ent.Name = name
+
+	parent := path[:len(path)-1]
+	if !b.isOpen(parent) {
+		return errors.Reason("adding %(path)q: parent is not an open directory").
+			D("path", strings.Join(path, "/")).Err()
+	}
+
+	if sym := ent.GetSymlink(); sym != nil {
+		if err := sym.Validate(len(parent)); err != nil {
+			return errors.Annotate(err).Reason("adding %(path)q").
+				D("path", strings.Join(path, "/")).Err()
+		}
+	}
+
+	dir := b.open[len(parent)]
+	if !dir.names.Add(name) {
+		return errors.Reason("adding %(path)q: duplicate entry").
+			D("path", strings.Join(path, "/")).Err()
+	}
+	if !dir.lowerNames.Add(strings.ToLower(name)) {
+		b.t.CaseSafe = false
+	}
+	dir.tree.Entries = append(dir.tree.Entries, ent)
+	b.aw.progress.entry(path)
+
+	// Adding this entry closes all of the subdirectories which were deeper than
+	// it.
+	b.open, b.openPath = b.open[:len(parent)+1], b.openPath[:len(parent)]
+	if tree := ent.GetTree(); tree != nil {
+		b.open = append(b.open, newOpenTree(tree))
+		b.openPath = append(b.openPath, name)
+	}
+	return nil
+}
+
+// AddDir adds an empty directory to the archive. Subsequent entries may be
+// added to it until an entry is added to one of its ancestors.
+func (b *Builder) AddDir(path []string) error {
+	return b.add(path, &toc.Entry{Etype: &toc.Entry_Tree{Tree: &toc.Tree{}}})
+}
+
+// AddSymlink adds a symlink to the archive. target is relative to the directory
+// containing the symlink, and may not point outside of the archive.
+func (b *Builder) AddSymlink(path []string, target []string) error {
+	return b.add(path, &toc.Entry{Etype: &toc.Entry_Symlink{Symlink: &toc.SymLink{
+		Target: target,
+	}}})
+}
+
+// AddFile adds a file to the archive, whose data is read from r. r must yield
+// exactly size bytes.
+//
+// The executable and readonly modes of the file are derived from the
+// permission bits of mode.
+func (b *Builder) AddFile(path []string, size uint64, mode os.FileMode, r io.Reader) error {
+	file := newTOCFile(size, mode)
+	if err := b.add(path, &toc.Entry{Etype: &toc.Entry_File{File: file}}); err != nil {
+		return err
+	}
+
+	rel := strings.Join(path, "/")
+	if _, err := io.CopyN(b.aw.data, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = errors.New("reader yielded fewer bytes than size")
+		}
+		b.err = errors.Annotate(err).Reason("adding %(path)q").D("path", rel).Err()
+		return b.err
+	}
+	switch n, err := io.CopyN(ioutil.Discard, r, 1); {
+	case n != 0:
+		b.err = errors.Reason("adding %(path)q: reader yielded more bytes than size").
+			D("path", rel).Err()
+		return b.err
+	case err != io.EOF:
+		b.err = errors.Annotate(err).Reason("adding %(path)q").D("path", rel).Err()
+		return b.err
+	}
+	if err := b.aw.fileBoundary(); err != nil {
+		b.err = errors.Annotate(err).Reason("adding %(path)q").D("path", rel).Err()
+		return b.err
+	}
+	return nil
+}
+
+// Finish writes the archive to the output. The Builder may not be used after
+// calling Finish.
+func (b *Builder) Finish() error {
+	if b.err != nil {
+		return b.err
+	}
+	b.err = errors.New("Builder is already finished")
+
+	if err := b.t.Validate(); err != nil {
+		return errors.Annotate(err).Reason("validating TOC").Err()
+	}
+	return b.aw.finish(b.t)
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// stallReader returns 0, nil from every other call to Read.
+type stallReader struct {
+	r     io.Reader
+	stall bool
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	if s.stall = !s.stall; s.stall {
+		return 0, nil
+	}
+	return s.r.Read(p)
+}
+
+// failReader fails every Read with err.
+type failReader struct{ err error }
+
+func (f failReader) Read(p []byte) (int, error) { return 0, f.err }
+
+func TestBuilder(tst *testing.T) {
+	tst.Parallel()
+
+	Convey("Builder", tst, func() {
+		buf := &bytes.Buffer{}
+		b, err := NewBuilder(buf)
+		So(err, ShouldBeNil)
+
+		addFile := func(path, data string) error {
+			return b.AddFile(strings.Split(path, "/"), uint64(len(data)), 0644,
+				strings.NewReader(data))
+		}
+
+		Convey("good", func() {
+			So(addFile("someFile", "someFile data"), ShouldBeNil)
+			So(b.AddDir([]string{"tree"}), ShouldBeNil)
+			So(b.AddDir([]string{"tree", "sub"}), ShouldBeNil)
+			So(addFile("tree/sub/deepFile", "tree/sub/deepFile data"), ShouldBeNil)
+			So(addFile("tree/subFile", "tree/subFile data"), ShouldBeNil)
+			So(b.AddSymlink([]string{"tree", "link"}, []string{"..", "someFile"}), ShouldBeNil)
+			So(b.AddFile([]string{"exe"}, 8, 0755, strings.NewReader("exe data")), ShouldBeNil)
+			So(b.Finish(), ShouldBeNil)
+
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+			So(err, ShouldBeNil)
+			So(ar.TOC, ShouldResemble, &toc.TOC{
+				CaseSafe: true,
+				Root: &toc.Tree{Entries: []*toc.Entry{
+					f("someFile", 13),
+					t("tree",
+						t("sub",
+							f("deepFile", 22),
+						),
+						f("subFile", 17),
+						&toc.Entry{Name: "link", Etype: &toc.Entry_Symlink{Symlink: &toc.SymLink{
+							Target: []string{"..", "someFile"},
+						}}},
+					),
+					{Name: "exe", Etype: &toc.Entry_File{File: &toc.File{
+						Size:      8,
+						PosixMode: &toc.PosixMode{Executable: true},
+					}}},
+				}},
+			})
+
+			dirName, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dirName)
+			So(ar.UnpackTo(context.Background(), dirName), ShouldBeNil)
+
+			for _, path := range []string{"someFile", "tree/sub/deepFile", "tree/subFile"} {
+				data, err := ioutil.ReadFile(filepath.Join(dirName, filepath.FromSlash(path)))
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, path+" data")
+			}
+		})
+
+		Convey("case", func() {
+			So(addFile("someFile", "a"), ShouldBeNil)
+			So(addFile("SOMEFILE", "b"), ShouldBeNil)
+			So(b.Finish(), ShouldBeNil)
+
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+			So(err, ShouldBeNil)
+			So(ar.TOC.CaseSafe, ShouldBeFalse)
+			So(ar.Close(), ShouldBeNil)
+		})
+
+		Convey("bad", func() {
+			Convey("out of order", func() {
+				So(b.AddDir([]string{"tree"}), ShouldBeNil)
+				So(addFile("other", "data"), ShouldBeNil)
+				So(addFile("tree/late", "data"), ShouldErrLike, "parent is not an open directory")
+				So(addFile("missing/file", "data"), ShouldErrLike, "parent is not an open directory")
+				So(b.Finish(), ShouldBeNil)
+			})
+
+			Convey("duplicate", func() {
+				So(addFile("someFile", "a"), ShouldBeNil)
+				So(addFile("someFile", "b"), ShouldErrLike, "duplicate entry")
+			})
+
+			Convey("invalid", func() {
+				So(addFile("some:file", "a"), ShouldErrLike, `bad char ":"`)
+				So(b.AddSymlink([]string{"link"}, []string{"..", "up"}), ShouldErrLike, "escapes root")
+			})
+
+			Convey("short reader", func() {
+				So(b.AddFile([]string{"file"}, 10, 0644, strings.NewReader("short")),
+					ShouldErrLike, "fewer bytes")
+				So(addFile("other", "data"), ShouldErrLike, "fewer bytes")
+				So(b.Finish(), ShouldErrLike, "fewer bytes")
+			})
+
+			Convey("long reader", func() {
+				So(b.AddFile([]string{"file"}, 2, 0644, strings.NewReader("long")),
+					ShouldErrLike, "more bytes")
+			})
+
+			Convey("long reader which stalls", func() {
+				So(b.AddFile([]string{"file"}, 2, 0644, &stallReader{r: strings.NewReader("long")}),
+					ShouldErrLike, "more bytes")
+			})
+
+			Convey("failing reader", func() {
+				r := io.MultiReader(strings.NewReader("ok"), failReader{errors.New("read failed")})
+				So(b.AddFile([]string{"file"}, 2, 0644, r), ShouldErrLike, "read failed")
+			})
+
+			Convey("finish twice", func() {
+				So(b.Finish(), ShouldBeNil)
+				So(b.Finish(), ShouldErrLike, "already finished")
+			})
+		})
+	})
+}
@@ -9,6 +9,10 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
+
+	"github.com/luci/luci-go/common/errors"
+	"github.com/luci/luci-go/common/iotools"
 
 	"github.com/riannucci/sarchive/sar/sardata"
 	"github.com/riannucci/sarchive/sar/sardata/toc"
@@ -18,10 +22,39 @@ type createOptionData struct {
 	compressKind  sardata.CompressionScheme
 	compressLevel int
 	checksumKind  sardata.ChecksumScheme
+	scanReport    *ScanReport
+	report        *CreateReport
+	dataOrder     DataOrder
+
+	chunkSize    uint64
+	chunkAtFiles bool
+	workers      int
+
+	dict      []byte
+	dictID    uint32
+	embedDict bool
+
+	progressFn       ProgressFunc
+	progressInterval time.Duration
 }
 
+// CreateOption functions can be supplied to the CreateFromPath function.
 type CreateOption func(*createOptionData)
 
+// WithCompression sets the compression scheme and level used for both the
+// table of contents and the archive data. Defaults to CompressionFlate at
+// level 9. The meaning of level depends on kind; see sardata.CompressionScheme.
+//
+// For CompressionXZ, level picks the dictionary size. This matters most for
+// solid archives, where a larger dictionary can find matches between files
+// that are further apart. Readers need that much memory to decompress the
+// archive (see WithMaxDecoderMemory).
+//
+// sardata.CompressionAuto compresses the start of the data with a few schemes,
+// and uses the one that sardata.ChooseCompression picks (ignoring level) for
+// both the table of contents and the data. Use WithCreateReport to find out
+// which one it was. The data block's header also records the sample's
+// compression ratio (see sardata.BlockHeader.SampleRatio).
 func WithCompression(kind sardata.CompressionScheme, level int) CreateOption {
 	return func(o *createOptionData) {
 		o.compressKind = kind
@@ -29,28 +62,126 @@ func WithCompression(kind sardata.CompressionScheme, level int) CreateOption {
 	}
 }
 
+// WithChunking causes a VersionChunked archive to be written, whose data block
+// is split into independently compressed chunks of size uncompressed bytes.
+// This allows OpenedArchive.Open, ReadFile and FS to start decompressing at the
+// chunk which contains a file, instead of at the start of the data, at the cost
+// of a somewhat worse compression ratio.
+//
+// If atFileBoundaries is true, chunks are only split between files, once they
+// hold at least size bytes. This keeps every file in a single chunk.
+//
+// A size of 0 (the default) writes a VersionSolid archive, which older readers
+// can also open.
+func WithChunking(size uint64, atFileBoundaries bool) CreateOption {
+	return func(o *createOptionData) {
+		o.chunkSize = size
+		o.chunkAtFiles = atFileBoundaries
+	}
+}
+
+// WithCompressionWorkers compresses the archive data on up to n goroutines at
+// once. Defaults to 1.
+//
+// With WithChunking, whole chunks are compressed concurrently, and the output
+// is the same as with a single worker. Otherwise the data is split into
+// segments which are compressed concurrently and concatenated into a single
+// flate stream (see sardata.ParallelBlockWriter); this is only supported by
+// CompressionFlate, and compresses very slightly worse than a single worker.
+func WithCompressionWorkers(n int) CreateOption {
+	return func(o *createOptionData) {
+		o.workers = n
+	}
+}
+
+// WithZstdDict compresses both the table of contents and the archive data with
+// the zstd dictionary dict (see TrainZstdDict). This requires CompressionZstd.
+//
+// If embed is true, the dictionary is stored in the archive. Otherwise only its
+// ID is stored, and the archive can only be opened if the dictionary is
+// supplied to Open with WithZstdDicts.
+func WithZstdDict(dict []byte, embed bool) CreateOption {
+	return func(o *createOptionData) {
+		o.dict = dict
+		o.embedDict = embed
+	}
+}
+
+// WithChecksum sets the checksum scheme used for the archive trailer. Defaults
+// to ChecksumSHA2_512 on amd64 and ChecksumSHA2_256 everywhere else.
 func WithChecksum(kind sardata.ChecksumScheme) CreateOption {
 	return func(o *createOptionData) {
 		o.checksumKind = kind
 	}
 }
 
-func GenerateTreeFromPath(path string) (*toc.TOC, bool, error) {
-	return nil, false, nil
+// WithScanReport causes CreateFromPath to fill in rpt with the entries that it
+// skipped while scanning the directory (see GenerateTreeFromPath).
+func WithScanReport(rpt *ScanReport) CreateOption {
+	return func(o *createOptionData) {
+		o.scanReport = rpt
+	}
 }
 
-func CreateFromPath(out io.Writer, path string, options ...CreateOption) error {
-	path, err := filepath.Abs(path)
-	if err != nil {
-		return err
+// CreateReport describes an archive written by CreateFromPath or a Builder.
+type CreateReport struct {
+	// Compression and CompressionLevel are what the archive was compressed with.
+	// For sardata.CompressionAuto, they're what it chose.
+	Compression      sardata.CompressionScheme
+	CompressionLevel int
+
+	// Trials are the sample compressions which sardata.CompressionAuto chose
+	// the scheme with, or nil for other schemes.
+	Trials []sardata.CompressionTrial
+
+	// DataSize is the total size of the archive's files, and CompressedSize is
+	// the size of the data block which holds them.
+	DataSize       uint64
+	CompressedSize uint64
+}
+
+// Ratio returns the size of the data block divided by the size of the data it
+// holds.
+func (r *CreateReport) Ratio() float64 {
+	if r.DataSize == 0 {
+		return 1
+	}
+	return float64(r.CompressedSize) / float64(r.DataSize)
+}
+
+// WithCreateReport causes CreateFromPath and Builder.Finish to fill in rpt
+// once the archive is written.
+func WithCreateReport(rpt *CreateReport) CreateOption {
+	return func(o *createOptionData) {
+		o.report = rpt
+	}
+}
+
+// WithCreateProgress causes CreateFromPath and Builder to report their
+// progress to fn. fn is called at the start and end of the archive, and at most
+// once per interval in between.
+func WithCreateProgress(fn ProgressFunc, interval time.Duration) CreateOption {
+	return func(o *createOptionData) {
+		o.progressFn = fn
+		o.progressInterval = interval
 	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
 
+func (nopWriteCloser) Close() error { return nil }
+
+// parseCreateOptions applies options on top of the defaults, and validates the
+// result.
+func parseCreateOptions(options []CreateOption) (opts createOptionData, err error) {
 	defaultChecksum := sardata.ChecksumSHA2_256
 	if runtime.GOARCH == "amd64" {
 		defaultChecksum = sardata.ChecksumSHA2_512
 	}
 
-	opts := createOptionData{
+	opts = createOptionData{
 		compressKind:  sardata.CompressionFlate,
 		compressLevel: 9,
 		checksumKind:  defaultChecksum,
@@ -58,18 +189,248 @@ func CreateFromPath(out io.Writer, path string, options ...CreateOption) error {
 	for _, o := range options {
 		o(&opts)
 	}
+	if opts.compressKind != sardata.CompressionAuto {
+		if err = opts.compressKind.Valid(); err != nil {
+			return
+		}
+	}
+	if opts.dataOrder < DataOrderTOC || opts.dataOrder > DataOrderSimilarity {
+		err = errors.Reason("unknown DataOrder %(o)d").D("o", opts.dataOrder).Err()
+		return
+	}
+	if opts.dict != nil {
+		if opts.compressKind != sardata.CompressionZstd {
+			err = errors.New("WithZstdDict requires CompressionZstd")
+			return
+		}
+		if len(opts.dict) > sardata.MaxDictSize {
+			err = errors.Reason("dictionary is too large (%(size)d bytes)").
+				D("size", len(opts.dict)).Err()
+			return
+		}
+		if opts.dictID, err = sardata.ZstdDictID(opts.dict); err != nil {
+			err = errors.Annotate(err).Reason("parsing dictionary").Err()
+			return
+		}
+	}
+	err = opts.checksumKind.Valid()
+	return
+}
+
+// archiveWriter writes the sections of an archive to an output stream.
+//
+// File data may be written to data before the TOC is known, because the data
+// block is buffered in memory until finish is called.
+type archiveWriter struct {
+	opts createOptionData
 
-	if err := sardata.WriteMagic(out); err != nil {
+	csum io.WriteCloser
+	data io.WriteCloser
+
+	// block is the data block, which data writes to. With CompressionAuto, it's
+	// nil until auto has chosen the compression scheme, and opts is updated to
+	// the chosen one.
+	block io.WriteCloser
+	auto  *autoWriter
+
+	// sampleRatio is the compression ratio which auto measured when it chose
+	// the compression scheme, which is recorded in the data block's header. It's
+	// 0 if the scheme wasn't chosen by auto.
+	sampleRatio float64
+
+	// blockOut counts the bytes of the data block written to csum.
+	blockOut *iotools.CountingWriter
+
+	// chunked is the data block if WithChunking was supplied, and nil otherwise.
+	chunked *sardata.ChunkedWriter
+
+	// progress is nil unless WithCreateProgress was supplied. The caller must
+	// start it.
+	progress *progressTracker
+}
+
+func newArchiveWriter(out io.Writer, opts createOptionData) (*archiveWriter, error) {
+	progress := newProgressTracker(opts.progressFn, opts.progressInterval)
+	outWC := io.WriteCloser(nopWriteCloser{out})
+	if progress != nil {
+		outWC = &progressWriter{outWC, progress, true}
+	}
+	ret := &archiveWriter{opts: opts, progress: progress}
+	ret.csum = opts.checksumKind.Writer(outWC)
+	ret.blockOut = &iotools.CountingWriter{Writer: ret.csum}
+	if opts.compressKind == sardata.CompressionAuto {
+		ret.auto = &autoWriter{w: ret}
+		ret.data = ret.auto
+	} else {
+		if err := ret.openBlock(); err != nil {
+			return nil, err
+		}
+		ret.data = ret.block
+	}
+	if progress != nil {
+		ret.data = &progressWriter{ret.data, progress, false}
+	}
+	return ret, nil
+}
+
+// openBlock opens the data block, compressed as w.opts says.
+func (w *archiveWriter) openBlock() error {
+	opts := w.opts
+	var err error
+	if opts.chunkSize > 0 {
+		if w.chunked, err = sardata.ChunkedBlockWriter(w.blockOut, opts.compressKind, opts.compressLevel,
+			opts.dict, opts.chunkSize, opts.chunkAtFiles, opts.workers); err == nil {
+			w.chunked.SetSampleRatio(w.sampleRatio)
+			w.block = w.chunked
+		}
+	} else if w.sampleRatio != 0 {
+		w.block, err = sardata.SampledBlockWriter(w.blockOut, opts.compressKind, opts.compressLevel,
+			opts.dict, opts.workers, w.sampleRatio)
+	} else if opts.dict != nil {
+		w.block, err = sardata.BlockWriterDict(w.blockOut, opts.compressKind, opts.compressLevel,
+			opts.dict)
+	} else {
+		w.block, err = sardata.ParallelBlockWriter(w.blockOut, opts.compressKind, opts.compressLevel,
+			opts.workers)
+	}
+	if err != nil {
+		return errors.Annotate(err).Reason("opening data block").Err()
+	}
+	return nil
+}
+
+// fileBoundary marks the end of a file's data in the data block.
+func (w *archiveWriter) fileBoundary() error {
+	if w.block == nil {
+		w.auto.fileBoundary()
+		return nil
+	}
+	if w.chunked != nil {
+		return w.chunked.FileBoundary()
+	}
+	return nil
+}
+
+// finish writes the magic, the dictionary section (if any), t, the buffered
+// data block and the checksum trailer to the output stream.
+func (w *archiveWriter) finish(t *toc.TOC) error {
+	if w.auto != nil {
+		if err := w.auto.choose(); err != nil {
+			return err
+		}
+	}
+	version := sardata.VersionSolid
+	if w.chunked != nil {
+		version = sardata.VersionChunked
+	}
+	if w.opts.dict != nil {
+		version |= sardata.VersionDictFlag
+	}
+	if len(t.DataOrder) > 0 {
+		version |= sardata.VersionDataOrderFlag
+	}
+	if err := sardata.WriteMagicVersion(w.csum, version); err != nil {
+		return errors.Annotate(err).Reason("writing magic").Err()
+	}
+	if w.opts.dict != nil {
+		sec := sardata.DictSection{ID: w.opts.dictID}
+		if w.opts.embedDict {
+			sec.Embedded = w.opts.dict
+		}
+		if err := sec.Write(w.csum); err != nil {
+			return errors.Annotate(err).Reason("writing dictionary section").Err()
+		}
+	}
+	if err := sardata.WriteTOCDict(w.csum, t, w.opts.compressKind, w.opts.compressLevel, w.opts.dict); err != nil {
+		return errors.Annotate(err).Reason("writing TOC").Err()
+	}
+	if err := w.data.Close(); err != nil {
+		return errors.Annotate(err).Reason("writing data block").Err()
+	}
+	if rpt := w.opts.report; rpt != nil {
+		size, _ := tocTotals(t)
+		*rpt = CreateReport{
+			Compression:      w.opts.compressKind,
+			CompressionLevel: w.opts.compressLevel,
+			DataSize:         uint64(size),
+			CompressedSize:   uint64(w.blockOut.Count),
+		}
+		if w.auto != nil {
+			rpt.Trials = w.auto.trials
+		}
+	}
+	if err := w.csum.Close(); err != nil {
+		return errors.Annotate(err).Reason("writing checksum").Err()
+	}
+	w.progress.done()
+	return nil
+}
+
+// writeFileData copies the data of every File in t from the directory at root
+// into w's data block, in the order that t.LoopData visits them.
+func writeFileData(w *archiveWriter, root string, t *toc.TOC) error {
+	return t.LoopData(func(path []string, ent *toc.Entry) error {
+		w.progress.entry(path)
+		file := ent.GetFile()
+		if file == nil {
+			return nil
+		}
+		rel := filepath.Join(path...)
+		f, err := os.Open(filepath.Join(root, rel))
+		if err != nil {
+			return errors.Annotate(err).Reason("opening file %(rel)q").
+				D("rel", rel).Err()
+		}
+		defer f.Close()
+		if _, err := io.CopyN(w.data, f, int64(file.Size)); err != nil {
+			if err == io.EOF {
+				err = errors.New("file shrank while archiving")
+			}
+			return errors.Annotate(err).Reason("copying file %(rel)q").
+				D("rel", rel).Err()
+		}
+		return w.fileBoundary()
+	})
+}
+
+// CreateFromPath writes a new archive containing the contents of the directory
+// at path to out.
+//
+// The directory is scanned up front with GenerateTreeFromPath to generate the
+// table of contents, and then every file is read a second time to generate the
+// archive data (in the order given by WithDataOrder). Files which change size
+// between these two passes will cause an error. Entries which cannot be
+// archived are skipped; use WithScanReport to find out which ones.
+func CreateFromPath(out io.Writer, path string, options ...CreateOption) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
 		return err
 	}
 
-	toc := &toc.TOC{}
-	_ = toc
-	f, err := os.Open(path)
+	opts, err := parseCreateOptions(options)
 	if err != nil {
 		return err
 	}
-	_ = f
 
-	return nil
+	t, _, rpt, err := GenerateTreeFromPath(path)
+	if err != nil {
+		return err
+	}
+	if opts.scanReport != nil {
+		*opts.scanReport = *rpt
+	}
+	if err := orderData(t, path, opts.dataOrder); err != nil {
+		return err
+	}
+
+	aw, err := newArchiveWriter(out, opts)
+	if err != nil {
+		return err
+	}
+	size, entries := tocTotals(t)
+	aw.progress.start(StageCreate, 0, size, entries)
+	if err := writeFileData(aw, path, t); err != nil {
+		return err
+	}
+	return aw.finish(t)
 }
@@ -0,0 +1,553 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// mkTree populates the directory dir with the given files. Each key is
+// a slash-separated path, and each value is the file content. Values prefixed
+// with "->" create symlinks instead.
+func mkTree(dir string, files map[string]string) {
+	for path, content := range files {
+		abs := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(abs), 0777); err != nil {
+			panic(err)
+		}
+		if len(content) > 2 && content[:2] == "->" {
+			if err := os.Symlink(filepath.FromSlash(content[2:]), abs); err != nil {
+				panic(err)
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(abs, []byte(content), 0666); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestCreateFromPath(tst *testing.T) {
+	tst.Parallel()
+
+	if runtime.GOOS == "windows" {
+		tst.Skip("symlinks require privileges on windows")
+	}
+
+	Convey("CreateFromPath", tst, func() {
+		srcDir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(srcDir)
+
+		mkTree(srcDir, map[string]string{
+			"someFile":              "someFile data",
+			"exe":                   "#!/bin/sh\necho hi\n",
+			"sub/subFile":           "sub/subFile data",
+			"sub/deeper/deepFile":   "sub/deeper/deepFile data",
+			"sub/deeper/zz_another": "sub/deeper/zz_another data",
+			"sub/uplink":            "->../someFile",
+			"link":                  "->sub/subFile",
+			"lastFile":              "lastFile data",
+		})
+		So(os.Chmod(filepath.Join(srcDir, "exe"), 0755), ShouldBeNil)
+
+		expectedTOC := &toc.TOC{
+			CaseSafe: true,
+			Root: &toc.Tree{Entries: []*toc.Entry{
+				{Name: "exe", Etype: &toc.Entry_File{File: &toc.File{
+					Size:      18,
+					PosixMode: &toc.PosixMode{Executable: true},
+				}}},
+				f("lastFile", 13),
+				{Name: "link", Etype: &toc.Entry_Symlink{Symlink: &toc.SymLink{
+					Target: []string{"sub", "subFile"},
+				}}},
+				f("someFile", 13),
+				t("sub",
+					t("deeper",
+						f("deepFile", 24),
+						f("zz_another", 26),
+					),
+					f("subFile", 16),
+					&toc.Entry{Name: "uplink", Etype: &toc.Entry_Symlink{Symlink: &toc.SymLink{
+						Target: []string{"..", "someFile"},
+					}}},
+				),
+			}},
+		}
+
+		Convey("round trip", func() {
+			buf := &bytes.Buffer{}
+			So(CreateFromPath(buf, srcDir), ShouldBeNil)
+
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+			So(err, ShouldBeNil)
+			So(ar.TOC, ShouldResemble, expectedTOC)
+
+			dstDir, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dstDir)
+
+			So(ar.UnpackTo(context.Background(), dstDir), ShouldBeNil)
+
+			for _, path := range []string{"someFile", "exe", "sub/subFile", "sub/deeper/deepFile", "sub/deeper/zz_another", "lastFile"} {
+				expect, err := ioutil.ReadFile(filepath.Join(srcDir, path))
+				So(err, ShouldBeNil)
+				actual, err := ioutil.ReadFile(filepath.Join(dstDir, path))
+				So(err, ShouldBeNil)
+				So(string(actual), ShouldEqual, string(expect))
+			}
+
+			st, err := os.Stat(filepath.Join(dstDir, "exe"))
+			So(err, ShouldBeNil)
+			So(st.Mode()&0111, ShouldNotEqual, 0)
+
+			target, err := os.Readlink(filepath.Join(dstDir, "sub", "uplink"))
+			So(err, ShouldBeNil)
+			So(target, ShouldEqual, filepath.Join("..", "someFile"))
+		})
+
+		Convey("options", func() {
+			buf := &bytes.Buffer{}
+			So(CreateFromPath(buf, srcDir,
+				WithCompression(sardata.CompressionNone, 0),
+				WithChecksum(sardata.ChecksumBLAKE2s)), ShouldBeNil)
+
+			c, _, _, _, err := sardata.ParseTrailer(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+			So(err, ShouldBeNil)
+			So(c, ShouldEqual, sardata.ChecksumBLAKE2s)
+
+			// uncompressed, so the data should be directly visible.
+			So(bytes.Contains(buf.Bytes(), []byte("sub/deeper/deepFile data")), ShouldBeTrue)
+
+			Convey("bad checksum", func() {
+				data := buf.Bytes()
+				idx := bytes.Index(data, []byte("sub/deeper/deepFile data"))
+				data[idx] = 'S'
+
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(data)})
+				So(err, ShouldBeNil)
+
+				dstDir, err := ioutil.TempDir("", "")
+				So(err, ShouldBeNil)
+				defer os.RemoveAll(dstDir)
+
+				So(ar.UnpackTo(context.Background(), dstDir), ShouldErrLike, "mismatched checksum")
+			})
+		})
+
+		Convey("zstd", func() {
+			for _, chunkSize := range []uint64{0, 20} {
+				buf := &bytes.Buffer{}
+				So(CreateFromPath(buf, srcDir, WithCompression(sardata.CompressionZstd, 19),
+					WithChunking(chunkSize, false)), ShouldBeNil)
+
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+				So(err, ShouldBeNil)
+				So(ar.TOC, ShouldResemble, expectedTOC)
+
+				dstDir, err := ioutil.TempDir("", "")
+				So(err, ShouldBeNil)
+				defer os.RemoveAll(dstDir)
+				So(ar.UnpackTo(context.Background(), dstDir), ShouldBeNil)
+				data, err := ioutil.ReadFile(filepath.Join(dstDir, "sub", "deeper", "zz_another"))
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "sub/deeper/zz_another data")
+			}
+		})
+
+		Convey("xz", func() {
+			for _, chunkSize := range []uint64{0, 20} {
+				buf := &bytes.Buffer{}
+				So(CreateFromPath(buf, srcDir, WithCompression(sardata.CompressionXZ, 64*1024),
+					WithChunking(chunkSize, false)), ShouldBeNil)
+
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+				So(err, ShouldBeNil)
+				So(ar.TOC, ShouldResemble, expectedTOC)
+
+				dstDir, err := ioutil.TempDir("", "")
+				So(err, ShouldBeNil)
+				defer os.RemoveAll(dstDir)
+				So(ar.UnpackTo(context.Background(), dstDir), ShouldBeNil)
+				data, err := ioutil.ReadFile(filepath.Join(dstDir, "sub", "deeper", "zz_another"))
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "sub/deeper/zz_another data")
+			}
+		})
+
+		Convey("auto", func() {
+			roundTrip := func(data []byte, options ...CreateOption) *CreateReport {
+				So(ioutil.WriteFile(filepath.Join(srcDir, "sub", "big"), data, 0666), ShouldBeNil)
+				rpt := &CreateReport{}
+				buf := &bytes.Buffer{}
+				So(CreateFromPath(buf, srcDir, append(options,
+					WithCompression(sardata.CompressionAuto, 0), WithCreateReport(rpt))...), ShouldBeNil)
+
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+				So(err, ShouldBeNil)
+				for _, path := range []string{"sub/big", "sub/deeper/zz_another", "lastFile"} {
+					expect, err := ioutil.ReadFile(filepath.Join(srcDir, path))
+					So(err, ShouldBeNil)
+					actual, err := ar.ReadFile(strings.Split(path, "/"))
+					So(err, ShouldBeNil)
+					So(actual, ShouldResemble, expect)
+				}
+
+				// The data block's header records the ratio of the chosen trial.
+				sampleRatio := 1.0 // for CompressionNone, if nothing was better
+				for _, t := range rpt.Trials {
+					if t.Scheme == rpt.Compression && t.Level == rpt.CompressionLevel {
+						sampleRatio = t.Ratio
+					}
+				}
+				if ar.chunks != nil {
+					So(ar.chunks.SampleRatio, ShouldAlmostEqual, sampleRatio, 1e-6)
+				} else {
+					h := sardata.BlockHeader{}
+					So(h.Read(bytes.NewReader(buf.Bytes()[ar.dataStart:])), ShouldBeNil)
+					So(h.Compression, ShouldEqual, rpt.Compression)
+					So(h.SampleRatio, ShouldAlmostEqual, sampleRatio, 1e-6)
+				}
+				So(ar.Close(), ShouldBeNil)
+				return rpt
+			}
+
+			Convey("compressible", func() {
+				data := bytes.Repeat([]byte("compressible data "), 300*1024)
+				So(len(data), ShouldBeGreaterThan, sardata.AutoSampleSize)
+				for _, chunkSize := range []uint64{0, 1024 * 1024} {
+					rpt := roundTrip(data, WithChunking(chunkSize, true))
+					So(rpt.Compression, ShouldNotEqual, sardata.CompressionNone)
+					So(rpt.Trials, ShouldNotBeEmpty)
+					So(rpt.DataSize, ShouldEqual, len(data)+110) // and the other files
+					So(rpt.Ratio(), ShouldBeLessThan, 0.1)
+				}
+			})
+
+			Convey("incompressible", func() {
+				data := make([]byte, 1024*1024)
+				rand.New(rand.NewSource(0)).Read(data)
+				rpt := roundTrip(data)
+				So(rpt.Compression, ShouldEqual, sardata.CompressionNone)
+				So(rpt.Ratio(), ShouldBeGreaterThan, 1)
+			})
+		})
+
+		Convey("chunked", func() {
+			for _, atFiles := range []bool{false, true} {
+				Convey(fmt.Sprintf("atFiles=%t", atFiles), func() {
+					buf := &bytes.Buffer{}
+					So(CreateFromPath(buf, srcDir, WithChunking(20, atFiles)), ShouldBeNil)
+					So(buf.Bytes()[3], ShouldEqual, sardata.VersionChunked)
+
+					ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+					So(err, ShouldBeNil)
+					So(ar.TOC, ShouldResemble, expectedTOC)
+					So(len(ar.chunks.Chunks), ShouldBeGreaterThan, 3)
+
+					paths := []string{"sub/deeper/zz_another", "someFile", "exe", "sub/subFile", "lastFile"}
+					for _, path := range paths {
+						expect, err := ioutil.ReadFile(filepath.Join(srcDir, path))
+						So(err, ShouldBeNil)
+						actual, err := ar.ReadFile(strings.Split(path, "/"))
+						So(err, ShouldBeNil)
+						So(string(actual), ShouldEqual, string(expect))
+					}
+
+					dstDir, err := ioutil.TempDir("", "")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(dstDir)
+
+					So(ar.UnpackTo(context.Background(), dstDir), ShouldBeNil)
+					for _, path := range paths {
+						expect, err := ioutil.ReadFile(filepath.Join(srcDir, path))
+						So(err, ShouldBeNil)
+						actual, err := ioutil.ReadFile(filepath.Join(dstDir, path))
+						So(err, ShouldBeNil)
+						So(string(actual), ShouldEqual, string(expect))
+					}
+				})
+			}
+		})
+
+		Convey("parallel", func() {
+			for _, chunkSize := range []uint64{0, 20} {
+				buf := &bytes.Buffer{}
+				So(CreateFromPath(buf, srcDir, WithCompressionWorkers(4), WithChunking(chunkSize, false)), ShouldBeNil)
+
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+				So(err, ShouldBeNil)
+				So(ar.TOC, ShouldResemble, expectedTOC)
+				data, err := ar.ReadFile([]string{"sub", "deeper", "zz_another"})
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "sub/deeper/zz_another data")
+				So(ar.Close(), ShouldBeNil)
+			}
+		})
+
+		Convey("parallel unpack", func() {
+			buf := &bytes.Buffer{}
+			So(CreateFromPath(buf, srcDir, WithChunking(20, false)), ShouldBeNil)
+
+			unpack := func(data []byte) (string, error) {
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(data)}, WithUnpackWorkers(3))
+				So(err, ShouldBeNil)
+				dstDir, err := ioutil.TempDir("", "")
+				So(err, ShouldBeNil)
+				return dstDir, ar.UnpackTo(context.Background(), dstDir)
+			}
+
+			dstDir, err := unpack(buf.Bytes())
+			defer os.RemoveAll(dstDir)
+			So(err, ShouldBeNil)
+			for _, path := range []string{"someFile", "exe", "sub/subFile", "sub/deeper/deepFile", "sub/deeper/zz_another", "lastFile"} {
+				expect, err := ioutil.ReadFile(filepath.Join(srcDir, path))
+				So(err, ShouldBeNil)
+				actual, err := ioutil.ReadFile(filepath.Join(dstDir, path))
+				So(err, ShouldBeNil)
+				So(string(actual), ShouldEqual, string(expect))
+			}
+			st, err := os.Stat(filepath.Join(dstDir, "exe"))
+			So(err, ShouldBeNil)
+			So(st.Mode()&0111, ShouldNotEqual, 0)
+
+			Convey("bad checksum", func() {
+				buf := &bytes.Buffer{}
+				So(CreateFromPath(buf, srcDir, WithChunking(20, false),
+					WithCompression(sardata.CompressionNone, 0)), ShouldBeNil)
+				data := buf.Bytes()
+				idx := bytes.Index(data, []byte("deeper/deepFile"))
+				So(idx, ShouldBeGreaterThan, 0)
+				data[idx] = 'D'
+
+				dstDir, err := unpack(data)
+				defer os.RemoveAll(dstDir)
+				So(err, ShouldErrLike, "mismatched checksum")
+			})
+		})
+
+		Convey("data order", func() {
+			paths := []string{"someFile", "exe", "sub/subFile", "sub/deeper/deepFile", "sub/deeper/zz_another", "lastFile"}
+			create := func(order DataOrder, options ...CreateOption) []byte {
+				buf := &bytes.Buffer{}
+				So(CreateFromPath(buf, srcDir, append(options, WithDataOrder(order))...), ShouldBeNil)
+				return buf.Bytes()
+			}
+			check := func(data []byte) {
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(data)})
+				So(err, ShouldBeNil)
+				for _, path := range paths {
+					expect, err := ioutil.ReadFile(filepath.Join(srcDir, path))
+					So(err, ShouldBeNil)
+					actual, err := ar.ReadFile(strings.Split(path, "/"))
+					So(err, ShouldBeNil)
+					So(string(actual), ShouldEqual, string(expect))
+				}
+
+				dstDir, err := ioutil.TempDir("", "")
+				So(err, ShouldBeNil)
+				defer os.RemoveAll(dstDir)
+				So(ar.UnpackTo(context.Background(), dstDir), ShouldBeNil)
+				for _, path := range paths {
+					expect, err := ioutil.ReadFile(filepath.Join(srcDir, path))
+					So(err, ShouldBeNil)
+					actual, err := ioutil.ReadFile(filepath.Join(dstDir, path))
+					So(err, ShouldBeNil)
+					So(string(actual), ShouldEqual, string(expect))
+				}
+				target, err := os.Readlink(filepath.Join(dstDir, "sub", "uplink"))
+				So(err, ShouldBeNil)
+				So(target, ShouldEqual, filepath.Join("..", "someFile"))
+			}
+			openTOC := func(data []byte) *toc.TOC {
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(data)})
+				So(err, ShouldBeNil)
+				So(ar.Close(), ShouldBeNil)
+				return ar.TOC
+			}
+
+			Convey("extension", func() {
+				// None of the files have an extension, so they're sorted by name.
+				data := create(DataOrderExtension)
+				So(data[3], ShouldEqual, sardata.VersionSolid|sardata.VersionDataOrderFlag)
+				So(openTOC(data).DataOrder, ShouldResemble, []uint64{3, 0, 1, 2, 5, 4})
+				check(data)
+			})
+
+			Convey("size", func() {
+				data := create(DataOrderSize, WithCompression(sardata.CompressionNone, 0))
+				So(openTOC(data).DataOrder, ShouldResemble, []uint64{1, 2, 5, 0, 3, 4})
+				idx := func(s string) int { return bytes.Index(data, []byte(s)) }
+				So(idx("lastFile data"), ShouldBeLessThan, idx("someFile data"))
+				So(idx("someFile data"), ShouldBeLessThan, idx("sub/subFile data"))
+				So(idx("sub/subFile data"), ShouldBeLessThan, idx("#!/bin/sh"))
+				check(data)
+
+				Convey("iterated", func() {
+					ar, err := Open(nullReadSeekCloser{bytes.NewReader(data)})
+					So(err, ShouldBeNil)
+					files := []string{}
+					for {
+						path, ent, r, err := ar.Next()
+						if err == io.EOF {
+							break
+						}
+						So(err, ShouldBeNil)
+						if ent.GetFile() == nil {
+							So(files, ShouldBeEmpty)
+							continue
+						}
+						rel := strings.Join(path, "/")
+						files = append(files, rel)
+						expect, err := ioutil.ReadFile(filepath.Join(srcDir, rel))
+						So(err, ShouldBeNil)
+						actual, err := ioutil.ReadAll(r)
+						So(err, ShouldBeNil)
+						So(string(actual), ShouldEqual, string(expect))
+					}
+					So(files, ShouldResemble, []string{
+						"lastFile", "someFile", "sub/subFile", "exe", "sub/deeper/deepFile", "sub/deeper/zz_another"})
+				})
+
+				Convey("flag required", func() {
+					data[3] &^= sardata.VersionDataOrderFlag
+					_, err := Open(nullReadSeekCloser{bytes.NewReader(data)}, WithVerification(VerifyNever))
+					So(err, ShouldErrLike, "archive version doesn't allow one")
+				})
+			})
+
+			Convey("similarity", func() {
+				for _, chunkSize := range []uint64{0, 20} {
+					check(create(DataOrderSimilarity, WithChunking(chunkSize, false)))
+				}
+			})
+
+			Convey("toc", func() {
+				data := create(DataOrderTOC)
+				So(data[3], ShouldEqual, sardata.VersionSolid)
+				So(openTOC(data), ShouldResemble, expectedTOC)
+			})
+
+			Convey("not for Builder", func() {
+				_, err := NewBuilder(&bytes.Buffer{}, WithDataOrder(DataOrderSize))
+				So(err, ShouldErrLike, "not supported by Builder")
+				_, err = NewBuilder(&bytes.Buffer{}, WithDataOrder(DataOrderSimilarity+1))
+				So(err, ShouldErrLike, "unknown DataOrder")
+			})
+		})
+
+		Convey("symlink targets are kept as written", func() {
+			mkTree(srcDir, map[string]string{
+				"sub/dots": "->./deeper/../subFile",
+				"sub/dir":  "->deeper/",
+			})
+			t, _, _, err := GenerateTreeFromPath(srcDir)
+			So(err, ShouldBeNil)
+			target := func(path ...string) []string {
+				ent, _, err := t.Locate(path)
+				So(err, ShouldBeNil)
+				return ent.GetSymlink().Target
+			}
+			So(target("sub", "dots"), ShouldResemble, []string{"deeper", "..", "subFile"})
+			So(target("sub", "dir"), ShouldResemble, []string{"deeper"})
+			So(target("sub", "uplink"), ShouldResemble, []string{"..", "someFile"})
+		})
+
+		Convey("symlinks which are only bad together", func() {
+			mkTree(srcDir, map[string]string{
+				"loop/a":       "->b",
+				"loop/b":       "->a",
+				"sub/up":       "->..",
+				"sub/deeper/x": "->../up/..",
+			})
+			t, _, rpt, err := GenerateTreeFromPath(srcDir)
+			So(err, ShouldBeNil)
+
+			So(len(rpt.Skipped), ShouldEqual, 3)
+			So(rpt.Skipped[0].Path, ShouldResemble, []string{"loop", "a"})
+			So(rpt.Skipped[0].Reason, ShouldEqual, SkipBadSymlink)
+			So(rpt.Skipped[0].Err, ShouldErrLike, "too many levels of symlinks")
+			So(rpt.Skipped[1].Path, ShouldResemble, []string{"loop", "b"})
+			So(rpt.Skipped[1].Reason, ShouldEqual, SkipBadSymlink)
+			So(rpt.Skipped[2].Path, ShouldResemble, []string{"sub", "deeper", "x"})
+			So(rpt.Skipped[2].Reason, ShouldEqual, SkipBadSymlink)
+			So(rpt.Skipped[2].Err, ShouldErrLike, "escapes root via other symlinks")
+
+			for _, path := range [][]string{{"loop", "a"}, {"loop", "b"}, {"sub", "deeper", "x"}} {
+				_, _, err := t.Locate(path)
+				So(err, ShouldEqual, toc.ErrNotFound)
+			}
+			_, _, err = t.Locate([]string{"sub", "up"})
+			So(err, ShouldBeNil)
+
+			buf := &bytes.Buffer{}
+			So(CreateFromPath(buf, srcDir), ShouldBeNil)
+		})
+
+		Convey("bad input", func() {
+			Convey("missing", func() {
+				buf := &bytes.Buffer{}
+				So(CreateFromPath(buf, filepath.Join(srcDir, "nope")), ShouldNotBeNil)
+			})
+
+			Convey("skipped entries", func() {
+				mkTree(srcDir, map[string]string{
+					"escape":         "->../../etc/passwd",
+					"sub/bad:name":   "data",
+					"sub/absolute":   "->/etc/passwd",
+					"sub/deeper/ok":  "->../../someFile",
+					"sub/deeper/bad": "->../../../someFile",
+				})
+				l, err := net.Listen("unix", filepath.Join(srcDir, "sub", "socket"))
+				So(err, ShouldBeNil)
+				defer l.Close()
+
+				rpt := &ScanReport{}
+				buf := &bytes.Buffer{}
+				So(CreateFromPath(buf, srcDir, WithScanReport(rpt)), ShouldBeNil)
+
+				So(len(rpt.Skipped), ShouldEqual, 5)
+				So(rpt.Skipped[0].Path, ShouldResemble, []string{"escape"})
+				So(rpt.Skipped[0].Reason, ShouldEqual, SkipBadSymlink)
+				So(rpt.Skipped[0].Err, ShouldErrLike, "escapes root")
+				So(rpt.Skipped[1].Path, ShouldResemble, []string{"sub", "absolute"})
+				So(rpt.Skipped[1].Reason, ShouldEqual, SkipBadSymlink)
+				So(rpt.Skipped[1].Err, ShouldErrLike, "absolute symlink target")
+				So(rpt.Skipped[2].Path, ShouldResemble, []string{"sub", "bad:name"})
+				So(rpt.Skipped[2].Reason, ShouldEqual, SkipBadName)
+				So(rpt.Skipped[3].Path, ShouldResemble, []string{"sub", "deeper", "bad"})
+				So(rpt.Skipped[3].Reason, ShouldEqual, SkipBadSymlink)
+				So(rpt.Skipped[4].Path, ShouldResemble, []string{"sub", "socket"})
+				So(rpt.Skipped[4].Reason, ShouldEqual, SkipSocket)
+
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+				So(err, ShouldBeNil)
+				deeper := ar.TOC.Root.Entries[4].GetTree().Entries[0].GetTree()
+				So(deeper.Entries[1].Name, ShouldEqual, "ok")
+				So(ar.Close(), ShouldBeNil)
+			})
+		})
+	})
+}
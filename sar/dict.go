@@ -0,0 +1,129 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+)
+
+// maxDictSampleSize is the most data that TrainZstdDict takes from any one
+// file.
+const maxDictSampleSize = 128 * 1024
+
+// readSample reads up to maxDictSampleSize bytes from r.
+func readSample(r io.Reader) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(r, maxDictSampleSize))
+}
+
+// isArchive returns true iff the file at path starts with the archive magic.
+func isArchive(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = sardata.ReadMagic(f)
+	return err == nil, nil
+}
+
+// archiveSamples returns a sample of every file in the archive at path.
+func archiveSamples(path string, options []OpenOption) (samples [][]byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ar, err := Open(f, options...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			ar.Close()
+		}
+	}()
+	for {
+		_, ent, r, err := ar.Next()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if file := ent.GetFile(); file == nil || file.Size == 0 {
+			continue
+		}
+		sample, err := readSample(r)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+}
+
+// fileSamples returns a sample of the regular file at path, or of every regular
+// file under it if it's a directory.
+func fileSamples(path string) (samples [][]byte, err error) {
+	err = filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Size() == 0 {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sample, err := readSample(f)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, sample)
+		return nil
+	})
+	return
+}
+
+// TrainZstdDict builds a zstd dictionary of at most maxSize bytes, for use with
+// WithZstdDict, from sample files which look like the files that will be
+// archived.
+//
+// Each path may be a file, a directory (in which case every regular file under
+// it is a sample) or an archive (in which case every file in the archive is a
+// sample). options are used to open archives. Only the start of each sample
+// file is used.
+func TrainZstdDict(paths []string, maxSize int, options ...OpenOption) ([]byte, error) {
+	var samples [][]byte
+	for _, path := range paths {
+		archive, err := isArchive(path)
+		if err != nil {
+			return nil, errors.Annotate(err).Reason("reading %(path)q").D("path", path).Err()
+		}
+		var s [][]byte
+		if archive {
+			s, err = archiveSamples(path, options)
+		} else {
+			s, err = fileSamples(path)
+		}
+		if err != nil {
+			return nil, errors.Annotate(err).Reason("reading samples from %(path)q").
+				D("path", path).Err()
+		}
+		samples = append(samples, s...)
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("no samples to train a dictionary with")
+	}
+	return sardata.TrainZstdDict(samples, maxSize)
+}
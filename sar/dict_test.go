@@ -0,0 +1,106 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+)
+
+func TestZstdDict(tst *testing.T) {
+	tst.Parallel()
+
+	Convey("zstd dictionaries", tst, func() {
+		srcDir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(srcDir)
+
+		files := map[string]string{}
+		for i := 0; i < 50; i++ {
+			files[fmt.Sprintf("cfg/%02d.json", i)] = fmt.Sprintf(
+				`{"target": "//src/component_%d:all", "toolchain": "clang-x86_64-linux-gnu", `+
+					`"flags": ["-O2", "-Wall", "-Werror"], "outputs": ["out/component_%d/lib.a"]}`, i, i)
+		}
+		mkTree(srcDir, files)
+
+		dict, err := TrainZstdDict([]string{srcDir}, 4096)
+		So(err, ShouldBeNil)
+
+		create := func(options ...CreateOption) []byte {
+			buf := &bytes.Buffer{}
+			So(CreateFromPath(buf, srcDir, options...), ShouldBeNil)
+			return buf.Bytes()
+		}
+		check := func(data []byte, options ...OpenOption) {
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(data)}, options...)
+			So(err, ShouldBeNil)
+			got, err := ar.ReadFile([]string{"cfg", "42.json"})
+			So(err, ShouldBeNil)
+			So(string(got), ShouldEqual, files["cfg/42.json"])
+
+			dstDir, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dstDir)
+			So(ar.UnpackTo(context.Background(), dstDir), ShouldBeNil)
+			got, err = ioutil.ReadFile(filepath.Join(dstDir, "cfg", "07.json"))
+			So(err, ShouldBeNil)
+			So(string(got), ShouldEqual, files["cfg/07.json"])
+		}
+
+		Convey("external", func() {
+			for _, chunkSize := range []uint64{0, 1000} {
+				plain := create(WithCompression(sardata.CompressionZstd, 19),
+					WithChunking(chunkSize, true))
+				data := create(WithCompression(sardata.CompressionZstd, 19),
+					WithChunking(chunkSize, true), WithZstdDict(dict, false))
+				So(len(data), ShouldBeLessThan, len(plain))
+				So(data[3]&sardata.VersionDictFlag, ShouldNotEqual, 0)
+
+				check(data, WithZstdDicts(dict), WithUnpackWorkers(2))
+
+				_, err := Open(nullReadSeekCloser{bytes.NewReader(data)})
+				So(err, ShouldErrLike, "must be supplied with WithZstdDicts")
+			}
+		})
+
+		Convey("embedded", func() {
+			data := create(WithCompression(sardata.CompressionZstd, 3), WithZstdDict(dict, true))
+			check(data)
+
+			Convey("training from an archive", func() {
+				arPath := filepath.Join(srcDir, "sample.sar")
+				So(ioutil.WriteFile(arPath, data, 0666), ShouldBeNil)
+				fromArchive, err := TrainZstdDict([]string{arPath}, 4096)
+				So(err, ShouldBeNil)
+				_, err = sardata.ZstdDictID(fromArchive)
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("bad", func() {
+			err := CreateFromPath(&bytes.Buffer{}, srcDir, WithZstdDict(dict, true))
+			So(err, ShouldErrLike, "requires CompressionZstd")
+
+			err = CreateFromPath(&bytes.Buffer{}, srcDir,
+				WithCompression(sardata.CompressionZstd, 3), WithZstdDict([]byte("nope"), true))
+			So(err, ShouldErrLike, "parsing dictionary")
+
+			_, err = TrainZstdDict([]string{filepath.Join(srcDir, "missing")}, 4096)
+			So(err, ShouldErrLike, "missing")
+		})
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:generate stringer -type UnpackAction
+
+package sar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// ExistingPolicy controls what UnpackTo does when the destination already
+// contains entries. It defaults to ExistingFail.
+type ExistingPolicy int
+
+// Valid values of ExistingPolicy
+const (
+	// ExistingFail requires the destination to be missing or empty.
+	ExistingFail ExistingPolicy = iota
+
+	// ExistingOverwrite replaces every existing entry which is also in the
+	// archive.
+	ExistingOverwrite
+
+	// ExistingSkip leaves every existing entry alone, and only writes the entries
+	// which don't exist yet.
+	ExistingSkip
+
+	// ExistingReplaceIfDifferent replaces existing entries which differ from the
+	// archive. Files are compared by size and mode bits, and also by content if
+	// WithCompareContents is supplied. Symlinks are compared by target.
+	ExistingReplaceIfDifferent
+
+	// ExistingMirror behaves like ExistingReplaceIfDifferent, but also deletes
+	// every entry in the destination which isn't in the archive's TOC. Entries
+	// which are in the TOC but not selected for unpacking (see WithInclude) are
+	// not deleted.
+	ExistingMirror
+)
+
+// UnpackAction is the action that UnpackTo took for a single path.
+type UnpackAction int
+
+// These are the actions reported in an UnpackReport.
+const (
+	// ActionCreated means that the path didn't exist, and was created.
+	ActionCreated UnpackAction = iota + 1
+
+	// ActionOverwritten means that an existing entry was replaced.
+	ActionOverwritten
+
+	// ActionSkipped means that an existing entry was left alone due to
+	// ExistingSkip.
+	ActionSkipped
+
+	// ActionUnchanged means that an existing entry was left alone because it
+	// matched the archive.
+	ActionUnchanged
+
+	// ActionDeleted means that an existing entry was deleted due to
+	// ExistingMirror.
+	ActionDeleted
+)
+
+// UnpackedEntry describes the action UnpackTo took for a single path.
+type UnpackedEntry struct {
+	// Path is relative to the unpack root.
+	Path   []string
+	Action UnpackAction
+}
+
+// UnpackReport is the structured report of the actions UnpackTo took. Entries
+// are in the order that they were processed.
+type UnpackReport struct {
+	Entries []UnpackedEntry
+}
+
+func (r *UnpackReport) add(path []string, action UnpackAction) {
+	r.Entries = append(r.Entries, UnpackedEntry{
+		append([]string(nil), path...), action})
+}
+
+// sameFileMode returns true iff the mode bits of the existing file fi are what
+// UnpackTo would have set for file.
+func sameFileMode(fi os.FileInfo, file *toc.File) bool {
+	mode := fi.Mode()
+	if mode&0222 == 0 != file.GetCommonMode().GetReadonly() {
+		return false
+	}
+	// windows doesn't have an executable bit.
+	if runtime.GOOS != "windows" && mode&0111 != 0 != file.GetPosixMode().GetExecutable() {
+		return false
+	}
+	return true
+}
+
+// sameFileContent returns true iff the file at path has the given sha256 sum.
+func (u *unpacker) sameFileContent(path []string, sum []byte) (bool, error) {
+	f, err := u.dir.open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return bytes.Equal(h.Sum(nil), sum), nil
+}
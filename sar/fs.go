@@ -0,0 +1,368 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// FS implements fs.FS, fs.ReadDirFS, fs.StatFS and fs.ReadFileFS over the
+// contents of an OpenedArchive. With Go 1.25 or later, it also implements
+// fs.ReadLinkFS.
+//
+// Symlinks are followed when opening (and statting) paths, but are reported as
+// symlinks by ReadDir (and Lstat). Symlinks are never followed outside of the
+// archive.
+//
+// File data is read with OpenedArchive.Open, so the same concurrency caveats
+// apply.
+type FS struct {
+	a *OpenedArchive
+}
+
+var (
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+)
+
+// FS returns an fs.FS view of the archive.
+func (a *OpenedArchive) FS() *FS {
+	return &FS{a}
+}
+
+// rootEntry is a synthetic Entry for the root Tree of t.
+func rootEntry(t *toc.TOC) *toc.Entry {
+	return &toc.Entry{Name: ".", Etype: &toc.Entry_Tree{Tree: t.Root}}
+}
+
+// resolve finds the Entry for the fs.FS path name, following symlinks. If
+// followLast is false and name refers to a symlink, the symlink itself is
+// returned. The returned path is the resolved location of the Entry in the TOC.
+func (f *FS) resolve(op, name string, followLast bool) (path []string, ent *toc.Entry, err error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	var todo []string
+	if name != "." {
+		todo = strings.Split(name, "/")
+	}
+
+	ent = rootEntry(f.a.TOC)
+	hops := 0
+	for len(todo) > 0 {
+		piece := todo[0]
+		todo = todo[1:]
+
+		tree := ent.GetTree()
+		if tree == nil {
+			return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		var next *toc.Entry
+		for _, e := range tree.Entries {
+			if e.Name == piece {
+				next = e
+				break
+			}
+		}
+		if next == nil {
+			return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+
+		link := next.GetSymlink()
+		if link == nil || (len(todo) == 0 && !followLast) {
+			path = append(path, piece)
+			ent = next
+			continue
+		}
+
+		if hops++; hops > toc.MaxSymlinkHops {
+			return nil, nil, &fs.PathError{Op: op, Path: name, Err: errTooManyLinks}
+		}
+		// Splice the link's target in place of the link, and re-resolve from the
+		// root.
+		for _, p := range link.Target {
+			if p == ".." {
+				if len(path) == 0 {
+					return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+				}
+				path = path[:len(path)-1]
+			} else {
+				path = append(path, p)
+			}
+		}
+		todo = append(path, todo...)
+		path = nil
+		ent = rootEntry(f.a.TOC)
+	}
+	return
+}
+
+type fsError string
+
+func (e fsError) Error() string { return string(e) }
+
+const errTooManyLinks = fsError("too many levels of symbolic links")
+
+// Open implements fs.FS.
+func (f *FS) Open(name string) (fs.File, error) {
+	path, ent, err := f.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := &fileInfo{fsBaseName(name), ent}
+	if tree := ent.GetTree(); tree != nil {
+		return &fsDir{info: info, entries: sortedDirEntries(tree)}, nil
+	}
+	_, offset, err := f.a.locateFile(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fsFile{a: f.a, info: info, offset: offset}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	_, ent, err := f.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	tree := ent.GetTree()
+	if tree == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	return sortedDirEntries(tree), nil
+}
+
+const errNotDir = fsError("not a directory")
+
+// Stat implements fs.StatFS.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	_, ent, err := f.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{fsBaseName(name), ent}, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	path, ent, err := f.resolve("read", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if ent.GetFile() == nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	data, err := f.a.ReadFile(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+const errIsDir = fsError("is a directory")
+
+func fsBaseName(name string) string {
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+func sortedDirEntries(t *toc.Tree) []fs.DirEntry {
+	ret := make([]fs.DirEntry, len(t.Entries))
+	for i, e := range t.Entries {
+		ret[i] = &fileInfo{e.Name, e}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry for a toc.Entry.
+type fileInfo struct {
+	name string
+	ent  *toc.Entry
+}
+
+var (
+	_ fs.FileInfo = (*fileInfo)(nil)
+	_ fs.DirEntry = (*fileInfo)(nil)
+)
+
+func (i *fileInfo) Name() string { return i.name }
+
+func (i *fileInfo) Size() int64 {
+	return int64(i.ent.GetFile().GetSize())
+}
+
+// Mode returns the mode of the entry. Files are 0644, plus 0111 if they're
+// executable, minus 0222 if they're readonly. Directories are 0755, and
+// symlinks are 0777.
+func (i *fileInfo) Mode() fs.FileMode {
+	switch x := i.ent.Etype.(type) {
+	case *toc.Entry_File:
+		mode := fs.FileMode(0644)
+		if x.File.GetPosixMode().GetExecutable() {
+			mode |= 0111
+		}
+		if x.File.GetCommonMode().GetReadonly() {
+			mode &^= 0222
+		}
+		return mode
+	case *toc.Entry_Tree:
+		return fs.ModeDir | 0755
+	case *toc.Entry_Symlink:
+		return fs.ModeSymlink | 0777
+	}
+	panic("impossible")
+}
+
+func (i *fileInfo) ModTime() time.Time { return time.Time{} }
+func (i *fileInfo) IsDir() bool        { return i.ent.GetTree() != nil }
+
+// Sys returns the underlying *toc.Entry.
+func (i *fileInfo) Sys() interface{} { return i.ent }
+
+func (i *fileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i *fileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// fsFile implements fs.File and io.Seeker for a File in the archive.
+//
+// The data stream is opened lazily on the first Read, so that Stat'ing files is
+// cheap.
+type fsFile struct {
+	a      *OpenedArchive
+	info   *fileInfo
+	offset uint64
+
+	// r reads the file's data starting at rPos, which may be behind pos if the
+	// caller has Seek'd forward.
+	r    io.Reader
+	rPos int64
+	pos  int64
+
+	closed bool
+}
+
+var _ io.ReadSeeker = (*fsFile)(nil)
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	size := f.info.Size()
+	if f.pos >= size {
+		return 0, io.EOF
+	}
+	if f.r == nil || f.rPos > f.pos {
+		r, err := f.a.dataAt(f.offset + uint64(f.pos))
+		if err != nil {
+			return 0, err
+		}
+		f.r, f.rPos = r, f.pos
+	}
+	if f.rPos < f.pos {
+		if _, err := io.CopyN(io.Discard, f.r, f.pos-f.rPos); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		f.rPos = f.pos
+	}
+	if remaining := size - f.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	// p doesn't go past the end of the file, so running out of data means that
+	// the data block is shorter than the TOC says.
+	n, err := io.ReadFull(f.r, p)
+	f.pos += int64(n)
+	f.rPos = f.pos
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, fsError("invalid whence")
+	}
+	if offset < 0 {
+		return 0, fsError("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *fsFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	f.r = nil
+	return nil
+}
+
+// fsDir implements fs.ReadDirFile for a Tree in the archive.
+type fsDir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	closed  bool
+}
+
+var _ fs.ReadDirFile = (*fsDir)(nil)
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errIsDir}
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, fs.ErrClosed
+	}
+	if n <= 0 {
+		ret := d.entries
+		d.entries = nil
+		return ret, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	ret := d.entries[:n]
+	d.entries = d.entries[n:]
+	return ret, nil
+}
+
+func (d *fsDir) Close() error {
+	if d.closed {
+		return fs.ErrClosed
+	}
+	d.closed = true
+	return nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build go1.25
+// +build go1.25
+
+package sar
+
+import (
+	"io/fs"
+	"strings"
+)
+
+var _ fs.ReadLinkFS = (*FS)(nil)
+
+// Lstat implements fs.ReadLinkFS.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	_, ent, err := f.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{fsBaseName(name), ent}, nil
+}
+
+// ReadLink implements fs.ReadLinkFS.
+func (f *FS) ReadLink(name string) (string, error) {
+	_, ent, err := f.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	link := ent.GetSymlink()
+	if link == nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return strings.Join(link.Target, "/"), nil
+}
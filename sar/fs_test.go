@@ -0,0 +1,161 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+func TestFS(tst *testing.T) {
+	tst.Parallel()
+
+	buf := &bytes.Buffer{}
+	b, err := NewBuilder(buf)
+	if err != nil {
+		panic(err)
+	}
+	addFile := func(path, data string, mode fs.FileMode) {
+		err := b.AddFile(strings.Split(path, "/"), uint64(len(data)), mode,
+			strings.NewReader(data))
+		if err != nil {
+			panic(err)
+		}
+	}
+	addFile("someFile", "someFile data", 0644)
+	addFile("exe", "exe data", 0755)
+	addFile("readonly", "readonly data", 0444)
+	if err := b.AddDir([]string{"tree"}); err != nil {
+		panic(err)
+	}
+	addFile("tree/subFile", "tree/subFile data", 0644)
+	if err := b.AddSymlink([]string{"tree", "link"}, []string{"..", "someFile"}); err != nil {
+		panic(err)
+	}
+	if err := b.AddSymlink([]string{"treeLink"}, []string{"tree"}); err != nil {
+		panic(err)
+	}
+	if err := b.Finish(); err != nil {
+		panic(err)
+	}
+
+	ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+	if err != nil {
+		panic(err)
+	}
+	fsys := ar.FS()
+
+	tst.Run("fstest", func(tst *testing.T) {
+		if err := fstest.TestFS(fsys, "someFile", "exe", "readonly", "tree/subFile"); err != nil {
+			tst.Fatal(err)
+		}
+	})
+
+	Convey("FS", tst, func() {
+		Convey("ReadFile", func() {
+			data, err := fs.ReadFile(fsys, "tree/subFile")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "tree/subFile data")
+		})
+
+		Convey("symlinks", func() {
+			data, err := fs.ReadFile(fsys, "tree/link")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "someFile data")
+
+			data, err = fs.ReadFile(fsys, "treeLink/link")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "someFile data")
+		})
+
+		Convey("modes", func() {
+			mode := func(name string) fs.FileMode {
+				st, err := fs.Stat(fsys, name)
+				So(err, ShouldBeNil)
+				return st.Mode()
+			}
+			So(mode("someFile"), ShouldEqual, 0644)
+			So(mode("exe"), ShouldEqual, 0755)
+			So(mode("readonly"), ShouldEqual, 0444)
+			So(mode("tree"), ShouldEqual, fs.ModeDir|0755)
+
+			ents, err := fs.ReadDir(fsys, "tree")
+			So(err, ShouldBeNil)
+			So(len(ents), ShouldEqual, 2)
+			So(ents[0].Name(), ShouldEqual, "link")
+			So(ents[0].Type(), ShouldEqual, fs.ModeSymlink)
+			info, err := ents[0].Info()
+			So(err, ShouldBeNil)
+			So(info.Sys(), ShouldHaveSameTypeAs, &toc.Entry{})
+		})
+
+		Convey("seek", func() {
+			f, err := fsys.Open("tree/subFile")
+			So(err, ShouldBeNil)
+			defer f.Close()
+			rs := f.(io.ReadSeeker)
+
+			_, err = rs.Seek(5, io.SeekStart)
+			So(err, ShouldBeNil)
+			data, err := io.ReadAll(rs)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "subFile data")
+
+			_, err = rs.Seek(-4, io.SeekEnd)
+			So(err, ShouldBeNil)
+			data, err = io.ReadAll(rs)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "data")
+		})
+
+		Convey("errors", func() {
+			_, err := fsys.Open("nope")
+			So(err, ShouldHaveSameTypeAs, &fs.PathError{})
+			So(err.(*fs.PathError).Err, ShouldEqual, fs.ErrNotExist)
+
+			_, err = fsys.Open("/abs")
+			So(err.(*fs.PathError).Err, ShouldEqual, fs.ErrInvalid)
+
+			_, err = fsys.ReadDir("someFile")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("truncated data", func() {
+			buf := &bytes.Buffer{}
+			b, err := NewBuilder(buf, WithCompression(sardata.CompressionNone, 0))
+			So(err, ShouldBeNil)
+			So(b.AddFile([]string{"file"}, 9, 0644, strings.NewReader("file data")), ShouldBeNil)
+			So(b.Finish(), ShouldBeNil)
+
+			raw := buf.Bytes()
+			idx := bytes.LastIndex(raw, []byte("file data"))
+			So(idx, ShouldBeGreaterThan, 0)
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(raw[:idx+4])},
+				WithVerification(VerifyNever))
+			So(err, ShouldBeNil)
+
+			f, err := ar.FS().Open("file")
+			So(err, ShouldBeNil)
+			defer f.Close()
+			data, err := io.ReadAll(f)
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			So(string(data), ShouldEqual, "file")
+
+			_, err = f.(io.Seeker).Seek(6, io.SeekStart)
+			So(err, ShouldBeNil)
+			_, err = f.Read(make([]byte, 10))
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+		})
+	})
+}
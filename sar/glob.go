@@ -0,0 +1,73 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"path"
+	"strings"
+
+	"github.com/luci/luci-go/common/errors"
+)
+
+// globPattern is a parsed slash-separated glob pattern.
+//
+// Each piece of the pattern is matched against a single path component with
+// path.Match, except for "**" which matches zero or more path components.
+type globPattern []string
+
+// parseGlob parses and validates a glob pattern.
+func parseGlob(pattern string) (globPattern, error) {
+	if pattern == "" {
+		return nil, errors.New("empty glob pattern")
+	}
+	ret := globPattern(strings.Split(pattern, "/"))
+	for _, piece := range ret {
+		if piece == "**" {
+			continue
+		}
+		if _, err := path.Match(piece, ""); err != nil {
+			return nil, errors.Annotate(err).Reason("bad glob pattern %(pattern)q").
+				D("pattern", pattern).Err()
+		}
+	}
+	return ret, nil
+}
+
+// match returns true iff the pattern matches the whole of p.
+func (g globPattern) match(p []string) bool {
+	if len(g) == 0 {
+		return len(p) == 0
+	}
+	if g[0] == "**" {
+		// Try consuming 0, 1, ... components of p.
+		for i := 0; i <= len(p); i++ {
+			if g[1:].match(p[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(p) == 0 {
+		return false
+	}
+	// parseGlob already checked the pattern, so path.Match can't fail.
+	if ok, _ := path.Match(g[0], p[0]); !ok {
+		return false
+	}
+	return g[1:].match(p[1:])
+}
+
+// matchAny returns true iff any of the patterns match p, or any of p's
+// parents.
+func matchAny(patterns []globPattern, p []string) bool {
+	for _, g := range patterns {
+		for i := 1; i <= len(p); i++ {
+			if g.match(p[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+)
+
+func TestGlob(tst *testing.T) {
+	tst.Parallel()
+
+	Convey("glob", tst, func() {
+		match := func(pattern, path string) bool {
+			g, err := parseGlob(pattern)
+			So(err, ShouldBeNil)
+			return g.match(strings.Split(path, "/"))
+		}
+
+		Convey("simple", func() {
+			So(match("bin", "bin"), ShouldBeTrue)
+			So(match("bin", "bin/x"), ShouldBeFalse)
+			So(match("b?n/*.so", "bin/a.so"), ShouldBeTrue)
+			So(match("bin/*.so", "bin/x/a.so"), ShouldBeFalse)
+		})
+
+		Convey("doublestar", func() {
+			So(match("bin/**", "bin"), ShouldBeTrue)
+			So(match("bin/**", "bin/x/y"), ShouldBeTrue)
+			So(match("**/*.so", "a.so"), ShouldBeTrue)
+			So(match("**/*.so", "x/y/a.so"), ShouldBeTrue)
+			So(match("a/**/b", "a/b"), ShouldBeTrue)
+			So(match("a/**/b", "a/x/y/b"), ShouldBeTrue)
+			So(match("a/**/b", "a/x/y/c"), ShouldBeFalse)
+		})
+
+		Convey("matchAny includes children", func() {
+			g, err := parseGlob("bin")
+			So(err, ShouldBeNil)
+			So(matchAny([]globPattern{g}, []string{"bin", "x"}), ShouldBeTrue)
+			So(matchAny([]globPattern{g}, []string{"lib", "bin"}), ShouldBeFalse)
+		})
+
+		Convey("bad", func() {
+			_, err := parseGlob("")
+			So(err, ShouldErrLike, "empty glob pattern")
+			_, err = parseGlob("a/[")
+			So(err, ShouldErrLike, "bad glob pattern")
+		})
+	})
+}
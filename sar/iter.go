@@ -0,0 +1,95 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+type iterItem struct {
+	path []string
+	ent  *toc.Entry
+}
+
+// iterState is the state for OpenedArchive.Next.
+type iterState struct {
+	items []iterItem
+	idx   int
+
+	// cur is the reader for the most recently returned File, if any.
+	cur     *io.LimitedReader
+	curPath []string
+
+	err error
+}
+
+// Next advances to the next entry in the archive (in TOC.LoopData order, which
+// is TOC.LoopItems order unless the archive was created with WithDataOrder),
+// and returns it. This works like archive/tar.Reader.Next.
+//
+// If the entry is a File, r will read exactly the File's data from the archive.
+// r is only valid until the next call to Next; any unread data is skipped. For
+// other entries, r is nil.
+//
+// After the last entry, Next verifies the archive checksum (as Close would do),
+// closes the archive and returns io.EOF. If the checksum doesn't match, it
+// returns the *sardata.ErrMismatchedChecksum instead.
+//
+// It is invalid to mix calls to Next and UnpackTo. Calling Close before Next
+// returns io.EOF is allowed, and will still verify the checksum.
+func (a *OpenedArchive) Next() (path []string, ent *toc.Entry, r io.Reader, err error) {
+	if a.iter == nil {
+		if a.didClose {
+			return nil, nil, nil, errors.New("cannot iterate closed/unpacked Archive")
+		}
+		a.iter = &iterState{}
+		a.TOC.LoopData(func(path []string, ent *toc.Entry) error {
+			a.iter.items = append(a.iter.items, iterItem{
+				append([]string(nil), path...), ent})
+			return nil
+		})
+	}
+	it := a.iter
+	if it.err != nil {
+		return nil, nil, nil, it.err
+	}
+
+	if it.cur != nil {
+		if _, err := io.Copy(ioutil.Discard, it.cur); err != nil {
+			it.err = errors.Annotate(err).Reason("skipping data for %(path)q").
+				D("path", strings.Join(it.curPath, "/")).Err()
+			return nil, nil, nil, it.err
+		}
+		if it.cur.N != 0 {
+			it.err = errors.Reason("archive data truncated in %(path)q").
+				D("path", strings.Join(it.curPath, "/")).Err()
+			return nil, nil, nil, it.err
+		}
+		it.cur, it.curPath = nil, nil
+	}
+
+	if it.idx == len(it.items) {
+		it.err = io.EOF
+		if err := a.Close(); err != nil {
+			it.err = err
+		}
+		return nil, nil, nil, it.err
+	}
+
+	item := it.items[it.idx]
+	it.idx++
+	if file := item.ent.GetFile(); file != nil {
+		it.cur = &io.LimitedReader{R: a.r, N: int64(file.Size)}
+		it.curPath = item.path
+		r = it.cur
+	}
+	return item.path, item.ent, r, nil
+}
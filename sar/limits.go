@@ -0,0 +1,207 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// LimitKind identifies the limit that a LimitError is for.
+type LimitKind string
+
+// These are the limits which may be set with OpenOptions.
+const (
+	// LimitTOCSize is set by WithMaxTOCSize.
+	LimitTOCSize LimitKind = "TOC size"
+
+	// LimitEntries is set by WithMaxEntries.
+	LimitEntries LimitKind = "entry count"
+
+	// LimitDepth is set by WithMaxDepth.
+	LimitDepth LimitKind = "tree depth"
+
+	// LimitFileSize is set by WithMaxFileSize.
+	LimitFileSize LimitKind = "file size"
+
+	// LimitTotalSize is set by WithMaxTotalSize. Archives whose total size
+	// doesn't fit in a uint64 always exceed it, with a Max of math.MaxUint64.
+	LimitTotalSize LimitKind = "total size"
+
+	// LimitCompressionRatio is set by WithMaxCompressionRatio.
+	LimitCompressionRatio LimitKind = "compression ratio"
+
+	// LimitDecoderMemory is set by WithMaxDecoderMemory.
+	LimitDecoderMemory LimitKind = "decoder memory"
+)
+
+// LimitError is returned by Open when the archive exceeds one of the limits
+// set by its OpenOptions. All limits are checked by Open, before the archive's
+// data is read, except that LimitDecoderMemory may only be found to be
+// exceeded once the data is read (e.g. in chunked archives, whose chunks are
+// checked one at a time), in which case it's reported as
+// a *sardata.ErrDecoderMemory instead.
+type LimitError struct {
+	Limit LimitKind
+
+	// Max is the configured limit, and Actual is the archive's value. Where
+	// the archive's value isn't known without doing the work that the limit
+	// prevents, Actual is Max+1. That's the case for LimitTOCSize with
+	// a compressed TOC, and for LimitDecoderMemory with schemes which don't
+	// report the memory they need.
+	Max    float64
+	Actual float64
+
+	// Path is the offending entry for LimitDepth and LimitFileSize.
+	Path []string
+}
+
+func (e *LimitError) Error() string {
+	ret := fmt.Sprintf("archive exceeds %s limit: %g > %g", e.Limit, e.Actual, e.Max)
+	if e.Path != nil {
+		ret += fmt.Sprintf(" (at %q)", strings.Join(e.Path, "/"))
+	}
+	return ret
+}
+
+type limits struct {
+	maxTOCSize          int64
+	maxEntries          int
+	maxDepth            int
+	maxFileSize         uint64
+	maxTotalSize        uint64
+	maxCompressionRatio float64
+	maxDecoderMemory    uint64
+}
+
+// WithMaxTOCSize limits the decompressed size of the archive's table of
+// contents, in bytes.
+func WithMaxTOCSize(n int64) OpenOption {
+	return func(o *openOptionData) {
+		o.limits.maxTOCSize = n
+	}
+}
+
+// WithMaxEntries limits the total number of entries (files, directories and
+// symlinks) in the archive.
+func WithMaxEntries(n int) OpenOption {
+	return func(o *openOptionData) {
+		o.limits.maxEntries = n
+	}
+}
+
+// WithMaxDepth limits the depth of the archive's directory tree. Entries in the
+// root have a depth of 1.
+func WithMaxDepth(n int) OpenOption {
+	return func(o *openOptionData) {
+		o.limits.maxDepth = n
+	}
+}
+
+// WithMaxFileSize limits the size of every file in the archive, in bytes.
+func WithMaxFileSize(n uint64) OpenOption {
+	return func(o *openOptionData) {
+		o.limits.maxFileSize = n
+	}
+}
+
+// WithMaxTotalSize limits the sum of the sizes of all of the files in the
+// archive, in bytes.
+func WithMaxTotalSize(n uint64) OpenOption {
+	return func(o *openOptionData) {
+		o.limits.maxTotalSize = n
+	}
+}
+
+// WithMaxCompressionRatio limits the ratio of the total size of the files in
+// the archive to the compressed size of the archive's data block.
+func WithMaxCompressionRatio(r float64) OpenOption {
+	return func(o *openOptionData) {
+		o.limits.maxCompressionRatio = r
+	}
+}
+
+// WithMaxDecoderMemory limits the memory that decompressing the archive may
+// need for the compressor's window or dictionary, in bytes. The default is
+// sardata.DefaultDecoderMaxMemory.
+//
+// This mostly matters for CompressionXZ, whose dictionary may be up to 4GB.
+func WithMaxDecoderMemory(n uint64) OpenOption {
+	return func(o *openOptionData) {
+		o.limits.maxDecoderMemory = n
+	}
+}
+
+// decoderLimitError returns a LimitError for LimitDecoderMemory if err is
+// a *sardata.ErrDecoderMemory, or nil otherwise.
+func decoderLimitError(err error) error {
+	de, ok := err.(*sardata.ErrDecoderMemory)
+	if !ok {
+		return nil
+	}
+	actual := de.Needed
+	if actual == 0 {
+		actual = de.Max + 1
+	}
+	return &LimitError{Limit: LimitDecoderMemory,
+		Max: float64(de.Max), Actual: float64(actual)}
+}
+
+// checkTOC checks t against the entry, depth and size limits, and returns the
+// total size of its files.
+func (l *limits) checkTOC(t *toc.TOC) (total uint64, err error) {
+	entries := 0
+	err = t.LoopItems(func(path []string, ent *toc.Entry) error {
+		entries++
+		if l.maxEntries > 0 && entries > l.maxEntries {
+			return &LimitError{Limit: LimitEntries,
+				Max: float64(l.maxEntries), Actual: float64(entries)}
+		}
+		if l.maxDepth > 0 && len(path) > l.maxDepth {
+			return &LimitError{Limit: LimitDepth,
+				Max: float64(l.maxDepth), Actual: float64(len(path)),
+				Path: append([]string(nil), path...)}
+		}
+		if file := ent.GetFile(); file != nil {
+			if l.maxFileSize > 0 && file.Size > l.maxFileSize {
+				return &LimitError{Limit: LimitFileSize,
+					Max: float64(l.maxFileSize), Actual: float64(file.Size),
+					Path: append([]string(nil), path...)}
+			}
+			if total+file.Size < total {
+				return &LimitError{Limit: LimitTotalSize,
+					Max: math.MaxUint64, Actual: float64(total) + float64(file.Size)}
+			}
+			total += file.Size
+			if l.maxTotalSize > 0 && total > l.maxTotalSize {
+				return &LimitError{Limit: LimitTotalSize,
+					Max: float64(l.maxTotalSize), Actual: float64(total)}
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// checkRatio checks the ratio of total to the compressed size of the data
+// block.
+func (l *limits) checkRatio(total, compressed uint64) error {
+	if l.maxCompressionRatio <= 0 || total == 0 {
+		return nil
+	}
+	// Treat an empty data block as one byte, to avoid dividing by zero.
+	if compressed == 0 {
+		compressed = 1
+	}
+	if ratio := float64(total) / float64(compressed); ratio > l.maxCompressionRatio {
+		return &LimitError{Limit: LimitCompressionRatio,
+			Max: l.maxCompressionRatio, Actual: ratio}
+	}
+	return nil
+}
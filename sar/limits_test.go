@@ -0,0 +1,154 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+func TestLimits(tst *testing.T) {
+	tst.Parallel()
+
+	Convey("Open with limits", tst, func() {
+		buf := &bytes.Buffer{}
+		b, err := NewBuilder(buf)
+		So(err, ShouldBeNil)
+		So(b.AddFile([]string{"big"}, 100000, 0644,
+			strings.NewReader(strings.Repeat("a", 100000))), ShouldBeNil)
+		So(b.AddDir([]string{"dir"}), ShouldBeNil)
+		So(b.AddDir([]string{"dir", "sub"}), ShouldBeNil)
+		So(b.AddFile([]string{"dir", "sub", "small"}, 10, 0644,
+			strings.NewReader("small data")), ShouldBeNil)
+		So(b.Finish(), ShouldBeNil)
+
+		open := func(opts ...OpenOption) error {
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())}, opts...)
+			if err == nil {
+				So(ar.Close(), ShouldBeNil)
+			}
+			return err
+		}
+		limitErr := func(err error) *LimitError {
+			So(err, ShouldHaveSameTypeAs, &LimitError{})
+			return err.(*LimitError)
+		}
+
+		Convey("within limits", func() {
+			So(open(
+				WithMaxTOCSize(1000),
+				WithMaxEntries(4),
+				WithMaxDepth(3),
+				WithMaxFileSize(100000),
+				WithMaxTotalSize(100010),
+				WithMaxCompressionRatio(10000),
+			), ShouldBeNil)
+		})
+
+		Convey("TOC size", func() {
+			err := limitErr(open(WithMaxTOCSize(10)))
+			So(err.Limit, ShouldEqual, LimitTOCSize)
+			So(err.Max, ShouldEqual, 10)
+			So(err.Actual, ShouldEqual, 11)
+		})
+
+		Convey("entries", func() {
+			err := limitErr(open(WithMaxEntries(3)))
+			So(err.Limit, ShouldEqual, LimitEntries)
+			So(err.Actual, ShouldEqual, 4)
+		})
+
+		Convey("depth", func() {
+			err := limitErr(open(WithMaxDepth(2)))
+			So(err.Limit, ShouldEqual, LimitDepth)
+			So(err.Path, ShouldResemble, []string{"dir", "sub", "small"})
+		})
+
+		Convey("file size", func() {
+			err := limitErr(open(WithMaxFileSize(99999)))
+			So(err.Limit, ShouldEqual, LimitFileSize)
+			So(err.Path, ShouldResemble, []string{"big"})
+			So(err.Error(), ShouldEqual,
+				`archive exceeds file size limit: 100000 > 99999 (at "big")`)
+		})
+
+		Convey("total size", func() {
+			err := limitErr(open(WithMaxTotalSize(100009)))
+			So(err.Limit, ShouldEqual, LimitTotalSize)
+			So(err.Actual, ShouldEqual, 100010)
+		})
+
+		Convey("total size overflow", func() {
+			big := &toc.File{Size: 1 << 63}
+			t := &toc.TOC{Root: &toc.Tree{Entries: []*toc.Entry{
+				{Name: "a", Etype: &toc.Entry_File{File: big}},
+				{Name: "b", Etype: &toc.Entry_File{File: big}},
+			}}}
+			for _, l := range []limits{{}, {maxTotalSize: math.MaxUint64}} {
+				_, err := l.checkTOC(t)
+				lerr := limitErr(err)
+				So(lerr.Limit, ShouldEqual, LimitTotalSize)
+				So(lerr.Max, ShouldEqual, float64(math.MaxUint64))
+				So(lerr.Actual, ShouldEqual, float64(1<<64))
+			}
+		})
+
+		Convey("compression ratio", func() {
+			err := limitErr(open(WithMaxCompressionRatio(10)))
+			So(err.Limit, ShouldEqual, LimitCompressionRatio)
+			So(err.Actual, ShouldBeGreaterThan, 10)
+		})
+
+		Convey("decoder memory", func() {
+			// xz level 6 uses an 8MB dictionary.
+			buf := &bytes.Buffer{}
+			b, err := NewBuilder(buf, WithCompression(sardata.CompressionXZ, 6))
+			So(err, ShouldBeNil)
+			So(b.AddFile([]string{"file"}, 9, 0644, strings.NewReader("file data")), ShouldBeNil)
+			So(b.Finish(), ShouldBeNil)
+
+			open := func(opts ...OpenOption) error {
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())}, opts...)
+				if err == nil {
+					So(ar.Close(), ShouldBeNil)
+				}
+				return err
+			}
+			So(open(), ShouldBeNil)
+			So(open(WithMaxDecoderMemory(8*1024*1024)), ShouldBeNil)
+
+			lerr := limitErr(open(WithMaxDecoderMemory(1024 * 1024)))
+			So(lerr.Limit, ShouldEqual, LimitDecoderMemory)
+			So(lerr.Actual, ShouldEqual, 8*1024*1024)
+		})
+
+		Convey("forged chunk index", func() {
+			buf := &bytes.Buffer{}
+			b, err := NewBuilder(buf, WithCompression(sardata.CompressionNone, 0), WithChunking(1024, false))
+			So(err, ShouldBeNil)
+			So(b.AddFile([]string{"file"}, 100, 0644,
+				strings.NewReader(strings.Repeat("a", 100))), ShouldBeNil)
+			So(b.Finish(), ShouldBeNil)
+
+			// One chunk, with 100 bytes of uncompressed and compressed data. Claim
+			// that there's more uncompressed data than the TOC allows for.
+			raw := buf.Bytes()
+			idx := bytes.Index(raw, []byte{1, byte(sardata.CompressionNone), 100, 100, 'a'})
+			So(idx, ShouldBeGreaterThan, 0)
+			raw[idx+2] = 127
+
+			_, err = Open(nullReadSeekCloser{bytes.NewReader(raw)}, WithMaxTotalSize(100))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "chunk index has 127 bytes of data, but the TOC has 100")
+		})
+	})
+}
@@ -9,7 +9,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"io/ioutil"
+	"time"
 
 	"github.com/luci/luci-go/common/errors"
 
@@ -25,10 +25,27 @@ type readSeekCloser interface {
 
 // OpenedArchive represends an Open'd sar file.
 type OpenedArchive struct {
-	r io.ReadCloser
+	r    io.ReadCloser
+	csum io.Closer
+	raw  io.Closer
 
 	didClose bool
 
+	// ra and dataStart are used for random access to the data block; see
+	// OpenedArchive.Open.
+	ra        io.ReaderAt
+	dataStart int64
+
+	// chunks is the index of the data block, for VersionChunked archives.
+	chunks *sardata.ChunkIndex
+
+	// decoder configures the decompression of the archive's blocks, with the zstd
+	// dictionary which the archive was compressed with (if any) and the decoder
+	// memory limit.
+	decoder sardata.DecoderConfig
+
+	iter *iterState
+
 	rawTOCBuf *bytes.Buffer
 	TOC       *toc.TOC
 
@@ -51,32 +68,25 @@ func (a *OpenedArchive) Close() error {
 		return nil
 	}
 	a.didClose = true
+	return a.closeReaders()
+}
 
-	if a.opts.verifyState == VerifyEarly {
-		// already verified the checksum, so just close a.r
-		return a.r.Close()
-	}
-
-	if a.opts.verifyState == VerifyNever {
-		// don't care!
-		return a.r.Close()
-	}
-
-	// otherwise we need to read to the end to check the checksum.
-	// TODO(iannucci): this could overflow.
-	var totalSize uint64
-	a.TOC.LoopItems(func(path []string, ent *toc.Entry) error {
-		if f := ent.GetFile(); f != nil {
-			totalSize += f.Size
-		}
-		return nil
-	})
-	_, err := io.Copy(ioutil.Discard, io.LimitReader(a.r, int64(totalSize)))
-	if err != nil {
+// closeReaders closes the data block and then the checksum reader.
+func (a *OpenedArchive) closeReaders() error {
+	// Closing the data block reads any remaining compressed data, which is
+	// necessary for VerifyLate to see all of the bytes covered by the checksum.
+	// For VerifyEarly and VerifyNever, a.csum is just the underlying reader.
+	if err := a.r.Close(); err != nil {
+		a.csum.Close()
 		return err
 	}
+	return a.csum.Close()
+}
 
-	return a.r.Close()
+// abortReaders closes the underlying reader without reading the rest of the
+// archive (and so without verifying the checksum).
+func (a *OpenedArchive) abortReaders() error {
+	return a.raw.Close()
 }
 
 // VerifyStateEnum allows you to control how Open will verify the package
@@ -99,6 +109,15 @@ type openOptionData struct {
 	verifyState      VerifyStateEnum
 	rawTOC           bool
 	unpackBufferSize int
+	unpackWorkers    int
+
+	zstdDicts [][]byte
+
+	progressFn       ProgressFunc
+	progressInterval time.Duration
+	progress         *progressTracker
+
+	limits limits
 }
 
 func (o openOptionData) setUpReader(r readSeekCloser) (ret io.ReadCloser, err error) {
@@ -112,10 +131,11 @@ func (o openOptionData) setUpReader(r readSeekCloser) (ret io.ReadCloser, err er
 	case VerifyEarly:
 		ret = io.ReadCloser(r)
 
+		var c sardata.ChecksumScheme
 		var h hash.Hash
 		var nominalEnd int64
 		var nominalCsum []byte
-		_, h, nominalEnd, nominalCsum, err = sardata.ParseTrailer(r)
+		c, h, nominalEnd, nominalCsum, err = sardata.ParseTrailer(r)
 		if err != nil {
 			err = errors.Annotate(err).Reason("early checksum setup").Err()
 			return
@@ -125,12 +145,15 @@ func (o openOptionData) setUpReader(r readSeekCloser) (ret io.ReadCloser, err er
 			err = errors.Annotate(err).Reason("early checksum seek").Err()
 			return
 		}
+		o.progress.start(StageVerify, nominalEnd-curLoctation, 0, 0)
 		if _, err = io.Copy(h, io.LimitReader(r, nominalEnd-curLoctation)); err != nil {
 			err = errors.Annotate(err).Reason("early checksum calculation").Err()
 			return
 		}
-		if !bytes.Equal(nominalCsum, h.Sum(nil)) {
-			err = errors.Annotate(err).Reason("early checksum").Err()
+		o.progress.done()
+		if actualCsum := h.Sum(nil); !bytes.Equal(nominalCsum, actualCsum) {
+			err = &sardata.ErrMismatchedChecksum{
+				Scheme: c, Nominal: nominalCsum, Actual: actualCsum}
 			return
 		}
 		if _, err = r.Seek(curLoctation, io.SeekStart); err != nil {
@@ -165,6 +188,16 @@ func WithRawTOC(val bool) OpenOption {
 	}
 }
 
+// WithProgress causes Open (with VerifyEarly) and UnpackTo to report their
+// progress to fn. fn is called at the start and end of each stage, and at most
+// once per interval in between.
+func WithProgress(fn ProgressFunc, interval time.Duration) OpenOption {
+	return func(o *openOptionData) {
+		o.progressFn = fn
+		o.progressInterval = interval
+	}
+}
+
 // WithUnpackBufferSize is an OpenOption factory which indicates the number of bytes
 // that UnpackTo will attempt to decompress ahead of time. Default if
 // unspecified is 16MB.
@@ -174,6 +207,49 @@ func WithUnpackBufferSize(factor int) OpenOption {
 	}
 }
 
+// WithUnpackWorkers is an OpenOption which, for archives whose data block is
+// chunked (see WithChunking), causes the chunks to be decompressed on up to n
+// goroutines at once. UnpackTo also writes up to n small files concurrently.
+//
+// This has no effect on solid archives, or if n is less than 2.
+func WithUnpackWorkers(n int) OpenOption {
+	return func(o *openOptionData) {
+		o.unpackWorkers = n
+	}
+}
+
+// WithZstdDicts supplies zstd dictionaries for archives which were created with
+// WithZstdDict, but without embedding the dictionary. Open picks the one whose
+// ID matches the archive's. May be supplied multiple times.
+func WithZstdDicts(dicts ...[]byte) OpenOption {
+	return func(o *openOptionData) {
+		o.zstdDicts = append(o.zstdDicts, dicts...)
+	}
+}
+
+// readDict reads the dictionary section from r, and returns the dictionary that
+// it refers to.
+func (o openOptionData) readDict(r io.Reader) ([]byte, error) {
+	sec := sardata.DictSection{}
+	if err := sec.Read(r); err != nil {
+		return nil, errors.Annotate(err).Reason("reading dictionary section").Err()
+	}
+	if sec.Embedded != nil {
+		return sec.Embedded, nil
+	}
+	for _, d := range o.zstdDicts {
+		id, err := sardata.ZstdDictID(d)
+		if err != nil {
+			return nil, errors.Annotate(err).Reason("parsing dictionary from WithZstdDicts").Err()
+		}
+		if id == sec.ID {
+			return d, nil
+		}
+	}
+	return nil, errors.Reason("archive requires zstd dictionary %(id)d, which must be supplied with WithZstdDicts").
+		D("id", sec.ID).Err()
+}
+
 // Open opens a SARchive from the given reader.
 //
 // It will read and validate the table of contents, and open the archive data
@@ -182,6 +258,11 @@ func WithUnpackBufferSize(factor int) OpenOption {
 // To get a positive confirmation for the integrity of the archive, you must
 // call Close() and observe the error (or you can use EarlyVerify to get
 // a preemptive integrity check).
+//
+// Any limits set with the WithMax* options are checked before Open returns; if
+// the archive exceeds one of them, Open returns a *LimitError. The exception is
+// WithMaxDecoderMemory, which may only be found to be exceeded once the data is
+// read (see LimitError).
 func Open(r readSeekCloser, options ...OpenOption) (ret *OpenedArchive, err error) {
 	opts := openOptionData{
 		unpackBufferSize: 16 * 1024 * 1024, // 16MB
@@ -190,6 +271,13 @@ func Open(r readSeekCloser, options ...OpenOption) (ret *OpenedArchive, err erro
 		o(&opts)
 	}
 
+	// Random access reads don't count towards the progress, so keep the
+	// original reader for them.
+	origR := r
+	if opts.progress = newProgressTracker(opts.progressFn, opts.progressInterval); opts.progress != nil {
+		r = &progressReader{r, opts.progress}
+	}
+
 	openedReader, err := opts.setUpReader(r)
 	if err != nil {
 		return
@@ -200,7 +288,10 @@ func Open(r readSeekCloser, options ...OpenOption) (ret *OpenedArchive, err erro
 		err = errors.Annotate(err).Reason("checking magic").Err()
 		return
 	}
-	if version != 1 {
+	hasDict := version&sardata.VersionDictFlag != 0
+	hasDataOrder := version&sardata.VersionDataOrderFlag != 0
+	version &^= sardata.VersionFlags
+	if version != sardata.VersionSolid && version != sardata.VersionChunked {
 		err = errors.Reason("unsupported version %(version)d").
 			D("version", version).Err()
 		return
@@ -208,7 +299,17 @@ func Open(r readSeekCloser, options ...OpenOption) (ret *OpenedArchive, err erro
 
 	ar := &OpenedArchive{
 		r:    openedReader,
+		csum: openedReader,
+		raw:  r,
 		opts: opts,
+
+		decoder: sardata.DecoderConfig{MaxMemory: opts.limits.maxDecoderMemory},
+	}
+
+	if hasDict {
+		if ar.decoder.Dict, err = opts.readDict(openedReader); err != nil {
+			return
+		}
 	}
 
 	tocReader := io.Reader(openedReader)
@@ -217,16 +318,73 @@ func Open(r readSeekCloser, options ...OpenOption) (ret *OpenedArchive, err erro
 		tocReader = io.TeeReader(openedReader, ar.rawTOCBuf)
 	}
 
-	if ar.TOC, err = sardata.ReadTOC(tocReader); err != nil {
+	if ar.TOC, err = sardata.ReadTOCConfig(tocReader, opts.limits.maxTOCSize, ar.decoder); err != nil {
+		if te, ok := err.(*sardata.ErrTOCTooLarge); ok {
+			actual := te.Size
+			if actual == 0 {
+				actual = te.Max + 1
+			}
+			err = &LimitError{Limit: LimitTOCSize,
+				Max: float64(te.Max), Actual: float64(actual)}
+			return
+		}
+		if lerr := decoderLimitError(err); lerr != nil {
+			err = lerr
+			return
+		}
 		err = errors.Annotate(err).Reason("reading TOC").Err()
 		return
 	}
+	if !hasDataOrder && len(ar.TOC.DataOrder) > 0 {
+		err = errors.New("TOC has a data order, but the archive version doesn't allow one")
+		return
+	}
+	totalSize, err := opts.limits.checkTOC(ar.TOC)
+	if err != nil {
+		return
+	}
+
+	if ar.dataStart, err = r.Seek(0, io.SeekCurrent); err != nil {
+		err = errors.Annotate(err).Reason("finding data block").Err()
+		return
+	}
+	if ra, ok := origR.(io.ReaderAt); ok {
+		ar.ra = ra
+	} else {
+		ar.ra = &seekReaderAt{r: origR}
+	}
 
-	ar.r, err = sardata.BlockReader(openedReader)
+	var dataReader io.ReadCloser
+	var compressedSize uint64
+	if version == sardata.VersionChunked {
+		ar.chunks, dataReader, err = sardata.ParallelChunkedBlockReader(openedReader, opts.unpackWorkers, ar.decoder)
+		if err == nil {
+			compressedSize = ar.chunks.CompressedSize()
+		}
+	} else {
+		var dataHeader sardata.BlockHeader
+		dataHeader, dataReader, err = sardata.BlockReaderConfig(openedReader, ar.decoder)
+		compressedSize = dataHeader.Length
+	}
+	if lerr := decoderLimitError(err); lerr != nil {
+		err = lerr
+		return
+	}
 	if err != nil {
 		err = errors.Annotate(err).Reason("opening data block").Err()
 		return
 	}
+	// The limits were checked against the TOC, so a chunk index which claims
+	// different sizes would get around them.
+	if ar.chunks != nil && ar.chunks.UncompressedSize() != totalSize {
+		err = errors.Reason("chunk index has %(chunks)d bytes of data, but the TOC has %(toc)d").
+			D("chunks", ar.chunks.UncompressedSize()).D("toc", totalSize).Err()
+		return
+	}
+	if err = opts.limits.checkRatio(totalSize, compressedSize); err != nil {
+		return
+	}
+	ar.r = dataReader
 
 	ret = ar
 	return
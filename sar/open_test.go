@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -46,6 +47,12 @@ type nullReadSeekCloser struct {
 
 func (nullReadSeekCloser) Close() error { return nil }
 
+type readerAtCloser struct {
+	*bytes.Reader
+}
+
+func (readerAtCloser) Close() error { return nil }
+
 func TestOpen(tst *testing.T) {
 	tst.Parallel()
 
@@ -103,6 +110,15 @@ func TestOpen(tst *testing.T) {
 			So(ar.Close(), ShouldBeNil)
 		})
 
+		Convey("VerifyEarly mismatch", func() {
+			newBytes := make([]byte, mockArchive.Len())
+			copy(newBytes, mockArchive.Bytes())
+			newBytes[len(newBytes)-10]++ // break the checksum
+
+			_, err := Open(nullReadSeekCloser{bytes.NewReader(newBytes)}, WithVerification(VerifyEarly))
+			So(err, ShouldHaveSameTypeAs, &sardata.ErrMismatchedChecksum{})
+		})
+
 		Convey("VerifyNever", func() {
 			newBytes := make([]byte, mockArchive.Len())
 			copy(newBytes, mockArchive.Bytes())
@@ -125,6 +141,104 @@ func TestOpen(tst *testing.T) {
 			So(ar.Close(), ShouldBeNil)
 		})
 
+		Convey("random access", func() {
+			hasContent := func(ar *OpenedArchive) {
+				data, err := ar.ReadFile([]string{"tree", "subFile"})
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "tree/subFile data")
+
+				rc, err := ar.Open([]string{"lastFile"})
+				So(err, ShouldBeNil)
+				data, err = ioutil.ReadAll(rc)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "lastFile data")
+				So(rc.Close(), ShouldBeNil)
+
+				data, err = ar.ReadFile([]string{"someFile"})
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "someFile data")
+
+				_, err = ar.ReadFile([]string{"tree"})
+				So(err, ShouldErrLike, `"tree" is not a file`)
+
+				_, err = ar.Open([]string{"tree", "nope"})
+				So(err, ShouldErrLike, toc.ErrNotFound)
+			}
+
+			Convey("seeker", func() {
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(mockArchive.Bytes())})
+				So(err, ShouldBeNil)
+				hasContent(ar)
+
+				// the sequential stream is unaffected.
+				dirName, err := ioutil.TempDir("", "")
+				So(err, ShouldBeNil)
+				defer os.RemoveAll(dirName)
+				So(ar.UnpackTo(context.Background(), dirName), ShouldBeNil)
+			})
+
+			Convey("readerAt", func() {
+				ar, err := Open(readerAtCloser{bytes.NewReader(mockArchive.Bytes())})
+				So(err, ShouldBeNil)
+				hasContent(ar)
+				So(ar.Close(), ShouldBeNil)
+			})
+		})
+
+		Convey("Next", func() {
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(mockArchive.Bytes())})
+			So(err, ShouldBeNil)
+
+			type item struct {
+				path string
+				data string
+			}
+			items := []item{}
+			for {
+				path, ent, r, err := ar.Next()
+				if err == io.EOF {
+					break
+				}
+				So(err, ShouldBeNil)
+				it := item{path: strings.Join(path, "/")}
+				if ent.GetFile() != nil {
+					// skip data for someOtherFile entirely.
+					if it.path != "someOtherFile" {
+						data, err := ioutil.ReadAll(r)
+						So(err, ShouldBeNil)
+						it.data = string(data)
+					}
+				} else {
+					So(r, ShouldBeNil)
+				}
+				items = append(items, it)
+			}
+			So(items, ShouldResemble, []item{
+				{"someFile", "someFile data"},
+				{"someOtherFile", ""},
+				{"tree", ""},
+				{"tree/subFile", "tree/subFile data"},
+				{"lastFile", "lastFile data"},
+			})
+
+			_, _, _, err = ar.Next()
+			So(err, ShouldEqual, io.EOF)
+			So(ar.UnpackTo(context.Background(), "nope"), ShouldErrLike, "can only unpack once")
+
+			Convey("bad checksum", func() {
+				newBytes := make([]byte, mockArchive.Len())
+				copy(newBytes, mockArchive.Bytes())
+				newBytes[len(newBytes)-10]++ // break the checksum
+
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(newBytes)})
+				So(err, ShouldBeNil)
+				for err == nil {
+					_, _, _, err = ar.Next()
+				}
+				So(err, ShouldHaveSameTypeAs, &sardata.ErrMismatchedChecksum{})
+			})
+		})
+
 		Convey("and unpack", func() {
 			ar, err := Open(nullReadSeekCloser{bytes.NewReader(mockArchive.Bytes())})
 			So(err, ShouldBeNil)
@@ -148,5 +262,66 @@ func TestOpen(tst *testing.T) {
 			So("tree/subFile", hasContent, "tree/subFile data")
 			So("lastFile", hasContent, "lastFile data")
 		})
+
+		Convey("and unpack selectively", func() {
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(mockArchive.Bytes())})
+			So(err, ShouldBeNil)
+
+			dirName, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dirName)
+
+			listing := func() []string {
+				ret := []string{}
+				filepath.Walk(dirName, func(path string, fi os.FileInfo, err error) error {
+					if path != dirName {
+						rel, _ := filepath.Rel(dirName, path)
+						ret = append(ret, filepath.ToSlash(rel))
+					}
+					return err
+				})
+				return ret
+			}
+
+			Convey("include", func() {
+				So(ar.UnpackTo(context.Background(), dirName, WithInclude("**/sub*")), ShouldBeNil)
+				So(listing(), ShouldResemble, []string{"tree", "tree/subFile"})
+				data, err := ioutil.ReadFile(filepath.Join(dirName, "tree", "subFile"))
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "tree/subFile data")
+			})
+
+			Convey("exclude", func() {
+				So(ar.UnpackTo(context.Background(), dirName,
+					WithExclude("tree", "some*")), ShouldBeNil)
+				So(listing(), ShouldResemble, []string{"lastFile"})
+			})
+
+			Convey("filter", func() {
+				So(ar.UnpackTo(context.Background(), dirName,
+					WithFilter(func(path []string, ent *toc.Entry) bool {
+						return ent.GetFile().GetSize() == 13
+					})), ShouldBeNil)
+				So(listing(), ShouldResemble, []string{"lastFile", "someFile"})
+			})
+
+			Convey("bad pattern", func() {
+				So(ar.UnpackTo(context.Background(), dirName, WithInclude("[")),
+					ShouldErrLike, "bad glob pattern")
+				// the archive is still usable
+				So(ar.UnpackTo(context.Background(), dirName), ShouldBeNil)
+			})
+
+			Convey("bad checksum", func() {
+				newBytes := make([]byte, mockArchive.Len())
+				copy(newBytes, mockArchive.Bytes())
+				newBytes[len(newBytes)-10]++ // break the checksum
+
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(newBytes)})
+				So(err, ShouldBeNil)
+				So(ar.UnpackTo(context.Background(), dirName, WithInclude("someFile")),
+					ShouldErrLike, "mismatched checksum")
+			})
+		})
 	})
 }
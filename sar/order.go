@@ -0,0 +1,181 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// DataOrder controls the order in which CreateFromPath writes the data of the
+// archive's files. It defaults to DataOrderTOC.
+//
+// The data block is compressed as a whole (or in large chunks), so putting
+// similar files next to each other can improve the compression ratio
+// considerably. Any order other than DataOrderTOC is recorded in the TOC (see
+// toc.TOC.DataOrder), and UnpackTo and OpenedArchive.Next still read the data
+// in a single sequential pass.
+type DataOrder int
+
+// Valid values of DataOrder
+const (
+	// DataOrderTOC writes the data in TOC.LoopItems order, i.e. depth-first
+	// with each directory's entries sorted by name.
+	DataOrderTOC DataOrder = iota
+
+	// DataOrderExtension groups the files by extension (ignoring case), and
+	// sorts each group by name.
+	DataOrderExtension
+
+	// DataOrderSize writes the files from the smallest to the largest.
+	DataOrderSize
+
+	// DataOrderSimilarity sorts the files by a similarity hash of their first
+	// similaritySampleSize bytes, so that files with similar contents tend to
+	// be adjacent. This reads the start of every file an extra time.
+	DataOrderSimilarity
+)
+
+// WithDataOrder causes CreateFromPath to write the data of the archive's files
+// in the given order.
+//
+// Archives whose data isn't in DataOrderTOC order can't be opened by readers
+// which predate this option. If the order turns out to be the same as
+// DataOrderTOC, the archive is written as if this option wasn't supplied.
+//
+// Builder writes the data in the order that it's added, so NewBuilder rejects
+// this option.
+func WithDataOrder(order DataOrder) CreateOption {
+	return func(o *createOptionData) {
+		o.dataOrder = order
+	}
+}
+
+// similaritySampleSize is how much of each file DataOrderSimilarity hashes.
+const similaritySampleSize = 64 * 1024
+
+// similarityHash returns a simhash of the 4-byte shingles of data: each bit of
+// the result is set iff that bit is set in the hashes of most of the shingles.
+// Data which share most of their shingles get hashes which share most of their
+// bits.
+//
+// Only about one in 16 shingles is counted, chosen by its hash so that the
+// same shingles are counted in every file.
+func similarityHash(data []byte) uint64 {
+	var votes [60]int
+	for i := 0; i+4 <= len(data); i++ {
+		h := uint64(binary.LittleEndian.Uint32(data[i:])) * 0x9e3779b97f4a7c15
+		h ^= h >> 29
+		if h>>60 != 0 {
+			continue
+		}
+		for b := range votes {
+			if h&(1<<uint(b)) != 0 {
+				votes[b]++
+			} else {
+				votes[b]--
+			}
+		}
+	}
+	ret := uint64(0)
+	for b, v := range votes {
+		if v > 0 {
+			ret |= 1 << uint(b)
+		}
+	}
+	return ret
+}
+
+// hashFile returns the similarityHash of the start of the file at abs.
+func hashFile(abs string) (uint64, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf := make([]byte, similaritySampleSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	return similarityHash(buf[:n]), nil
+}
+
+// orderData sets t.DataOrder as order says, reading the files from the
+// directory at root for DataOrderSimilarity. Files which compare equal stay in
+// TOC.LoopItems order. If the resulting order is the same as TOC.LoopItems
+// order, t.DataOrder is left empty.
+func orderData(t *toc.TOC, root string, order DataOrder) error {
+	if order == DataOrderTOC {
+		return nil
+	}
+
+	type file struct {
+		idx  int
+		path []string
+		size uint64
+		hash uint64
+	}
+	files := []file{}
+	t.LoopItems(func(path []string, ent *toc.Entry) error {
+		if f := ent.GetFile(); f != nil {
+			files = append(files, file{
+				idx: len(files), path: append([]string(nil), path...), size: f.Size})
+		}
+		return nil
+	})
+
+	var less func(a, b *file) bool
+	switch order {
+	case DataOrderExtension:
+		less = func(a, b *file) bool {
+			aName, bName := a.path[len(a.path)-1], b.path[len(b.path)-1]
+			aExt := strings.ToLower(filepath.Ext(aName))
+			bExt := strings.ToLower(filepath.Ext(bName))
+			if aExt != bExt {
+				return aExt < bExt
+			}
+			return aName < bName
+		}
+
+	case DataOrderSize:
+		less = func(a, b *file) bool { return a.size < b.size }
+
+	case DataOrderSimilarity:
+		for i := range files {
+			rel := filepath.Join(files[i].path...)
+			h, err := hashFile(filepath.Join(root, rel))
+			if err != nil {
+				return errors.Annotate(err).Reason("hashing file %(rel)q").
+					D("rel", rel).Err()
+			}
+			files[i].hash = h
+		}
+		less = func(a, b *file) bool { return a.hash < b.hash }
+
+	default:
+		panic("impossible")
+	}
+	sort.SliceStable(files, func(i, j int) bool { return less(&files[i], &files[j]) })
+
+	ret := make([]uint64, len(files))
+	reordered := false
+	for i, f := range files {
+		ret[i] = uint64(f.idx)
+		reordered = reordered || f.idx != i
+	}
+	if reordered {
+		t.DataOrder = ret
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"math/bits"
+	"math/rand"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSimilarityHash(tst *testing.T) {
+	tst.Parallel()
+
+	Convey("similarityHash", tst, func() {
+		rnd := rand.New(rand.NewSource(0))
+		random := func() []byte {
+			ret := make([]byte, 16*1024)
+			rnd.Read(ret)
+			return ret
+		}
+		dist := func(a, b []byte) int {
+			return bits.OnesCount64(similarityHash(a) ^ similarityHash(b))
+		}
+
+		text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog. ", 300))
+		edited := append([]byte(nil), text...)
+		copy(edited[1000:], "THE QUICK BROWN FOX")
+		So(dist(text, text), ShouldEqual, 0)
+		So(dist(text, edited), ShouldBeLessThan, 4)
+
+		a, b := random(), random()
+		edited = append(append([]byte(nil), a[:8*1024]...), b[8*1024:]...)
+		So(dist(a, edited), ShouldBeLessThan, dist(a, b))
+
+		So(similarityHash(nil), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,204 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// ProgressStage identifies the operation that a Progress update is for.
+type ProgressStage string
+
+// These are the stages which report progress.
+const (
+	// StageCreate is writing an archive with CreateFromPath or a Builder.
+	StageCreate ProgressStage = "create"
+
+	// StageVerify is the checksum verification done by Open with VerifyEarly.
+	StageVerify ProgressStage = "verify"
+
+	// StageUnpack is UnpackTo.
+	StageUnpack ProgressStage = "unpack"
+)
+
+// Progress is a snapshot of the progress of a single stage.
+type Progress struct {
+	Stage ProgressStage
+
+	// CompressedBytes is the number of bytes of the archive which have been read
+	// (or written, for StageCreate) so far in this stage.
+	//
+	// For StageCreate, the archive data is buffered in memory until the end, so
+	// this only increases once all of the files have been read.
+	CompressedBytes int64
+
+	// CompressedTotal is the total number of archive bytes that this stage will
+	// read, or 0 if it isn't known in advance. It's only known for StageVerify.
+	CompressedTotal int64
+
+	// UncompressedBytes is the number of bytes of file data which have been
+	// produced (or consumed, for StageCreate) so far.
+	UncompressedBytes int64
+
+	// UncompressedTotal is the sum of the sizes of all the Files in the TOC, or
+	// 0 if it isn't known in advance (e.g. when using a Builder).
+	UncompressedTotal int64
+
+	// Path is the path of the current entry, if any.
+	Path []string
+
+	// Entries is the number of entries which have been started so far.
+	Entries int
+
+	// EntriesTotal is the number of entries in the TOC, or 0 if it isn't known
+	// in advance.
+	EntriesTotal int
+
+	// Done is true for the last update of the stage.
+	Done bool
+}
+
+// ProgressFunc receives Progress updates.
+//
+// It's called synchronously from the goroutine doing the work (though never
+// concurrently), so it should return quickly.
+type ProgressFunc func(p Progress)
+
+// tocTotals returns the total file size and number of entries in t.
+func tocTotals(t *toc.TOC) (size int64, entries int) {
+	t.LoopItems(func(_ []string, ent *toc.Entry) error {
+		entries++
+		size += int64(ent.GetFile().GetSize())
+		return nil
+	})
+	return
+}
+
+// progressTracker accumulates Progress and rate-limits calls to a
+// ProgressFunc. A nil *progressTracker ignores all updates.
+type progressTracker struct {
+	fn       ProgressFunc
+	interval time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+	cur  Progress
+}
+
+func newProgressTracker(fn ProgressFunc, interval time.Duration) *progressTracker {
+	if fn == nil {
+		return nil
+	}
+	return &progressTracker{fn: fn, interval: interval}
+}
+
+// update applies cb to the current Progress, and then calls the ProgressFunc if
+// force is true or at least interval has passed since the last call.
+//
+// Updates outside of a stage (i.e. between done and the next start) are
+// ignored.
+func (p *progressTracker) update(force bool, cb func(*Progress)) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !force && (p.cur.Stage == "" || p.cur.Done) {
+		return
+	}
+	cb(&p.cur)
+	if now := time.Now(); force || now.Sub(p.last) >= p.interval {
+		p.last = now
+		p.fn(p.cur)
+	}
+}
+
+// start begins a new stage, and reports it immediately.
+func (p *progressTracker) start(stage ProgressStage, compressedTotal, uncompressedTotal int64, entriesTotal int) {
+	p.update(true, func(cur *Progress) {
+		*cur = Progress{
+			Stage:             stage,
+			CompressedTotal:   compressedTotal,
+			UncompressedTotal: uncompressedTotal,
+			EntriesTotal:      entriesTotal,
+		}
+	})
+}
+
+// done reports the end of the current stage.
+func (p *progressTracker) done() {
+	p.update(true, func(cur *Progress) {
+		cur.Path = nil
+		cur.Done = true
+	})
+}
+
+// entry reports the start of a new entry.
+func (p *progressTracker) entry(path []string) {
+	p.update(false, func(cur *Progress) {
+		// path is reused by TOC.LoopItems, so it must be copied.
+		cur.Path = append(cur.Path[:0:0], path...)
+		cur.Entries++
+	})
+}
+
+func (p *progressTracker) addCompressed(n int) {
+	if n > 0 {
+		p.update(false, func(cur *Progress) { cur.CompressedBytes += int64(n) })
+	}
+}
+
+func (p *progressTracker) addUncompressed(n int) {
+	if n > 0 {
+		p.update(false, func(cur *Progress) { cur.UncompressedBytes += int64(n) })
+	}
+}
+
+// progressReader counts the bytes read from the archive as compressed bytes.
+type progressReader struct {
+	readSeekCloser
+	p *progressTracker
+}
+
+func (r *progressReader) Read(buf []byte) (int, error) {
+	n, err := r.readSeekCloser.Read(buf)
+	r.p.addCompressed(n)
+	return n, err
+}
+
+// uncompressedReader counts the bytes read from the data block as uncompressed
+// bytes.
+type uncompressedReader struct {
+	r io.Reader
+	p *progressTracker
+}
+
+func (r uncompressedReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.p.addUncompressed(n)
+	return n, err
+}
+
+// progressWriter counts bytes written as either compressed or uncompressed
+// bytes.
+type progressWriter struct {
+	io.WriteCloser
+	p          *progressTracker
+	compressed bool
+}
+
+func (w *progressWriter) Write(buf []byte) (int, error) {
+	n, err := w.WriteCloser.Write(buf)
+	if w.compressed {
+		w.p.addCompressed(n)
+	} else {
+		w.p.addUncompressed(n)
+	}
+	return n, err
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProgress(tst *testing.T) {
+	tst.Parallel()
+
+	Convey("Progress", tst, func() {
+		srcDir, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(srcDir)
+		mkTree(srcDir, map[string]string{
+			"a":     strings.Repeat("a", 1000),
+			"dir/b": strings.Repeat("b", 2000),
+		})
+
+		var updates []Progress
+		record := func(p Progress) { updates = append(updates, p) }
+		last := func() Progress { return updates[len(updates)-1] }
+
+		buf := &bytes.Buffer{}
+		So(CreateFromPath(buf, srcDir, WithCreateProgress(record, 0)), ShouldBeNil)
+
+		Convey("create", func() {
+			So(updates[0], ShouldResemble, Progress{
+				Stage:             StageCreate,
+				UncompressedTotal: 3000,
+				EntriesTotal:      3,
+			})
+			So(last(), ShouldResemble, Progress{
+				Stage:             StageCreate,
+				CompressedBytes:   int64(buf.Len()),
+				UncompressedBytes: 3000,
+				UncompressedTotal: 3000,
+				Entries:           3,
+				EntriesTotal:      3,
+				Done:              true,
+			})
+			paths := []string{}
+			for _, p := range updates {
+				if p.Path != nil {
+					paths = append(paths, strings.Join(p.Path, "/"))
+				}
+			}
+			So(paths, ShouldContain, "dir/b")
+		})
+
+		Convey("verify and unpack", func() {
+			updates = nil
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())},
+				WithVerification(VerifyEarly), WithProgress(record, 0))
+			So(err, ShouldBeNil)
+
+			verifyDone := last()
+			So(verifyDone.Stage, ShouldEqual, StageVerify)
+			So(verifyDone.Done, ShouldBeTrue)
+			So(verifyDone.CompressedTotal, ShouldBeGreaterThan, 0)
+			So(verifyDone.CompressedBytes, ShouldEqual, verifyDone.CompressedTotal)
+
+			dst, err := ioutil.TempDir("", "")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dst)
+			So(ar.UnpackTo(context.Background(), dst), ShouldBeNil)
+
+			unpackDone := last()
+			So(unpackDone.Stage, ShouldEqual, StageUnpack)
+			So(unpackDone.Done, ShouldBeTrue)
+			So(unpackDone.UncompressedBytes, ShouldEqual, 3000)
+			So(unpackDone.UncompressedTotal, ShouldEqual, 3000)
+			So(unpackDone.Entries, ShouldEqual, 3)
+			So(unpackDone.EntriesTotal, ShouldEqual, 3)
+			So(unpackDone.CompressedBytes, ShouldBeGreaterThan, 0)
+		})
+	})
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// seekReaderAt implements io.ReaderAt for an io.ReadSeeker by seeking to the
+// requested offset, and then seeking back to the original position when done.
+//
+// This means that it's safe to interleave calls to ReadAt with sequential reads
+// of r, but NOT to do them concurrently.
+type seekReaderAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, err := s.r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if _, seekErr := s.r.Seek(cur, io.SeekStart); err == nil {
+			err = seekErr
+		}
+	}()
+	if _, err = s.r.Seek(off, io.SeekStart); err != nil {
+		return
+	}
+	n, err = io.ReadFull(s.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return
+}
+
+// dataAt returns a reader for the uncompressed archive_data stream, starting
+// at offset.
+//
+// For VersionChunked archives, this starts decompressing at the chunk which
+// contains offset. Otherwise it decompresses (and discards) all of the data
+// preceding offset.
+func (a *OpenedArchive) dataAt(offset uint64) (io.Reader, error) {
+	block := io.NewSectionReader(a.ra, a.dataStart, math.MaxInt64-a.dataStart)
+	if a.chunks != nil {
+		r, err := a.chunks.DataAt(block, offset)
+		if err != nil {
+			return nil, errors.Annotate(err).Reason("opening data block").Err()
+		}
+		return r, nil
+	}
+	// Note that we don't close this BlockReader, since that would read the rest
+	// of the (possibly large) compressed block.
+	_, rc, err := sardata.BlockReaderConfig(block, a.decoder)
+	if err != nil {
+		return nil, errors.Annotate(err).Reason("opening data block").Err()
+	}
+	if _, err := io.CopyN(ioutil.Discard, rc, int64(offset)); err != nil {
+		return nil, errors.Annotate(err).Reason("skipping to offset %(offset)d").
+			D("offset", offset).Err()
+	}
+	return rc, nil
+}
+
+// locateFile returns the File at path, and its offset in the archive_data
+// stream.
+func (a *OpenedArchive) locateFile(path []string) (*toc.File, uint64, error) {
+	ent, offset, err := a.TOC.Locate(path)
+	if err != nil {
+		return nil, 0, errors.Annotate(err).Reason("locating %(path)q").
+			D("path", strings.Join(path, "/")).Err()
+	}
+	file := ent.GetFile()
+	if file == nil {
+		return nil, 0, errors.Reason("%(path)q is not a file").
+			D("path", strings.Join(path, "/")).Err()
+	}
+	return file, offset, nil
+}
+
+// Open returns a reader for the data of the file at path, independently of
+// the sequential data stream used by UnpackTo and Close.
+//
+// If the archive was opened from an io.ReaderAt (like *os.File), Open may be
+// used concurrently with other reads of the archive. Otherwise the archive is
+// read by seeking, and reads from the returned reader must not happen
+// concurrently with any other reads of the archive (including UnpackTo).
+//
+// For archives written with WithChunking, only the chunks from the one
+// containing the file onwards are decompressed. Otherwise all of the data
+// preceding the file must be decompressed first.
+//
+// Note that this does NOT verify the archive checksum.
+func (a *OpenedArchive) Open(path []string) (io.ReadCloser, error) {
+	file, offset, err := a.locateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := a.dataAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(io.LimitReader(r, int64(file.Size))), nil
+}
+
+// ReadFile returns the data of the file at path. See Open.
+func (a *OpenedArchive) ReadFile(path []string) ([]byte, error) {
+	file, offset, err := a.locateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := a.dataAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, file.Size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.Annotate(err).Reason("reading %(path)q").
+			D("path", strings.Join(path, "/")).Err()
+	}
+	return buf, nil
+}
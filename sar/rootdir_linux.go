@@ -0,0 +1,33 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// +build linux
+
+package sar
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// openBeneath opens the directory at path relative to dirfd, failing with
+// ELOOP if any component of it is a symlink.
+//
+// This uses openat2, and falls back to openBeneathWalk on kernels older than
+// 5.6 (or where openat2 is blocked by seccomp).
+func openBeneath(dirfd int, path []string) (int, error) {
+	fd, err := unix.Openat2(dirfd, strings.Join(path, "/"), &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	switch err {
+	case unix.ENOSYS, unix.EPERM:
+		return openBeneathWalk(dirfd, path)
+	case unix.EXDEV:
+		// RESOLVE_BENEATH failed; this can only happen via a symlink.
+		err = unix.ELOOP
+	}
+	return fd, err
+}
@@ -0,0 +1,13 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// +build !linux,!windows
+
+package sar
+
+// openBeneath opens the directory at path relative to dirfd, failing with
+// ELOOP if any component of it is a symlink.
+func openBeneath(dirfd int, path []string) (int, error) {
+	return openBeneathWalk(dirfd, path)
+}
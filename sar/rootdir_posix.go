@@ -0,0 +1,304 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// +build !windows
+
+package sar
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// rootDir creates, inspects and removes entries beneath the unpack root
+// without following any symlinks, so that nothing outside of the root can be
+// written or removed even if the directories inside of it are replaced with
+// symlinks.
+//
+// Every parent directory is opened relative to a descriptor for the root (with
+// openat2(RESOLVE_BENEATH) where it's available, and O_NOFOLLOW otherwise), and
+// entries are created and removed relative to their parent's descriptor.
+type rootDir struct {
+	root string
+	fd   int
+
+	// parentRel and parentFd are the most recently opened parent directory.
+	// Entries are unpacked in depth-first order, so consecutive entries usually
+	// share a parent.
+	parentRel string
+	parentFd  int
+}
+
+func openRootDir(root string) (*rootDir, error) {
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	return &rootDir{root: root, fd: fd, parentFd: -1}, nil
+}
+
+func (d *rootDir) Close() error {
+	if d.parentFd >= 0 {
+		unix.Close(d.parentFd)
+		d.parentFd = -1
+	}
+	return unix.Close(d.fd)
+}
+
+// parent returns a descriptor for the directory containing path. It must not
+// be closed by the caller.
+//
+// The cached descriptor is never invalidated: the only directories which
+// UnpackTo removes are ones which aren't in the TOC (e.g. because they're being
+// replaced by a file or symlink), so it never has entries underneath them.
+func (d *rootDir) parent(path []string) (int, error) {
+	if len(path) == 1 {
+		return d.fd, nil
+	}
+	dir := path[:len(path)-1]
+	rel := strings.Join(dir, "/")
+	if d.parentFd >= 0 && d.parentRel == rel {
+		return d.parentFd, nil
+	}
+	fd, err := openBeneath(d.fd, dir)
+	if err != nil {
+		if err == unix.ELOOP {
+			err = errSymlinkParent
+		}
+		return -1, &os.PathError{Op: "open", Path: filepath.Join(d.root, rel), Err: err}
+	}
+	if d.parentFd >= 0 {
+		unix.Close(d.parentFd)
+	}
+	d.parentRel, d.parentFd = rel, fd
+	return fd, nil
+}
+
+// openBeneathWalk opens the directory at path relative to dirfd one component
+// at a time, refusing to follow symlinks. Every component of path has been
+// checked by toc.ValidateName, so none of them are "..".
+func openBeneathWalk(dirfd int, path []string) (int, error) {
+	fd := dirfd
+	for _, p := range path {
+		next, err := unix.Openat(fd, p, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err == unix.ENOTDIR && isSymlinkAt(fd, p) {
+			err = unix.ELOOP
+		}
+		if fd != dirfd {
+			unix.Close(fd)
+		}
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// isSymlinkAt returns true iff name (relative to dirfd) is a symlink.
+func isSymlinkAt(dirfd int, name string) bool {
+	var st unix.Stat_t
+	err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	return err == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK
+}
+
+// checkParent returns an error if the directory containing path can't be
+// opened without following symlinks.
+func (d *rootDir) checkParent(path []string) error {
+	_, err := d.parent(path)
+	return err
+}
+
+func (d *rootDir) abs(path []string) string {
+	return filepath.Join(d.root, filepath.Join(path...))
+}
+
+// mkdir makes the directory at path.
+func (d *rootDir) mkdir(path []string) error {
+	pfd, err := d.parent(path)
+	if err != nil {
+		return err
+	}
+	if err := unix.Mkdirat(pfd, path[len(path)-1], 0777); err != nil {
+		return &os.PathError{Op: "mkdir", Path: d.abs(path), Err: err}
+	}
+	return nil
+}
+
+// create makes a new file at path for writing. It fails if anything already
+// exists at path.
+func (d *rootDir) create(path []string) (*os.File, error) {
+	pfd, err := d.parent(path)
+	if err != nil {
+		return nil, err
+	}
+	abs := d.abs(path)
+	fd, err := unix.Openat(pfd, path[len(path)-1],
+		unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0666)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: abs, Err: err}
+	}
+	return os.NewFile(uintptr(fd), abs), nil
+}
+
+// symlink makes a symlink at path which points to target.
+func (d *rootDir) symlink(target string, path []string) error {
+	pfd, err := d.parent(path)
+	if err != nil {
+		return err
+	}
+	if err := unix.Symlinkat(target, pfd, path[len(path)-1]); err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: d.abs(path), Err: err}
+	}
+	return nil
+}
+
+// lstat returns information about the entry at path, without following it if
+// it's a symlink.
+func (d *rootDir) lstat(path []string) (os.FileInfo, error) {
+	pfd, err := d.parent(path)
+	if err != nil {
+		return nil, err
+	}
+	fi := &statInfo{name: path[len(path)-1]}
+	if err := unix.Fstatat(pfd, fi.name, &fi.st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: d.abs(path), Err: err}
+	}
+	return fi, nil
+}
+
+// open opens the file at path for reading. It fails if path is a symlink.
+func (d *rootDir) open(path []string) (*os.File, error) {
+	pfd, err := d.parent(path)
+	if err != nil {
+		return nil, err
+	}
+	abs := d.abs(path)
+	fd, err := unix.Openat(pfd, path[len(path)-1], unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: abs, Err: err}
+	}
+	return os.NewFile(uintptr(fd), abs), nil
+}
+
+// readlink returns the target of the symlink at path.
+func (d *rootDir) readlink(path []string) (string, error) {
+	pfd, err := d.parent(path)
+	if err != nil {
+		return "", err
+	}
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(pfd, path[len(path)-1], buf)
+		if err != nil {
+			return "", &os.PathError{Op: "readlink", Path: d.abs(path), Err: err}
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// rename moves the entry at from to to, replacing anything at to. from and to
+// must be in the same directory.
+func (d *rootDir) rename(from, to []string) error {
+	pfd, err := d.parent(to)
+	if err != nil {
+		return err
+	}
+	if err := unix.Renameat(pfd, from[len(from)-1], pfd, to[len(to)-1]); err != nil {
+		return &os.LinkError{Op: "rename", Old: d.abs(from), New: d.abs(to), Err: err}
+	}
+	return nil
+}
+
+// removeAll removes the entry at path, along with everything in it if it's a
+// directory. Like os.RemoveAll, it succeeds if there's nothing at path.
+func (d *rootDir) removeAll(path []string) error {
+	pfd, err := d.parent(path)
+	if err != nil {
+		return err
+	}
+	if err := removeAllAt(pfd, path[len(path)-1]); err != nil {
+		return &os.PathError{Op: "remove", Path: d.abs(path), Err: err}
+	}
+	return nil
+}
+
+// removeAllAt removes name (relative to dirfd) and everything in it, without
+// following symlinks.
+func removeAllAt(dirfd int, name string) error {
+	err := unix.Unlinkat(dirfd, name, 0)
+	switch err {
+	case nil, unix.ENOENT:
+		return nil
+	case unix.EISDIR, unix.EPERM:
+		// Linux returns EISDIR for directories, and other systems EPERM.
+	default:
+		return err
+	}
+	fd, oerr := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if oerr != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	names, rerr := dir.Readdirnames(-1)
+	for _, n := range names {
+		if rerr == nil {
+			rerr = removeAllAt(fd, n)
+		}
+	}
+	dir.Close()
+	if rerr != nil {
+		return rerr
+	}
+	if err := unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR); err != unix.ENOENT {
+		return err
+	}
+	return nil
+}
+
+// statInfo implements os.FileInfo for the result of fstatat.
+type statInfo struct {
+	name string
+	st   unix.Stat_t
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.st.Size }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(fi.st.Mtim.Unix()) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statInfo) Sys() interface{}   { return &fi.st }
+
+func (fi *statInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.st.Mode & 0777)
+	switch uint32(fi.st.Mode) & unix.S_IFMT {
+	case unix.S_IFBLK:
+		mode |= os.ModeDevice
+	case unix.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFDIR:
+		mode |= os.ModeDir
+	case unix.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case unix.S_IFLNK:
+		mode |= os.ModeSymlink
+	case unix.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if fi.st.Mode&unix.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.st.Mode&unix.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.st.Mode&unix.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
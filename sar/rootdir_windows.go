@@ -0,0 +1,118 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// +build windows
+
+package sar
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// rootDir creates, inspects and removes entries beneath the unpack root
+// without following any symlinks.
+//
+// Windows has no equivalent of openat, so every parent directory is checked
+// with Lstat before an entry in it is touched. Unlike on posix, this can't
+// protect against another process replacing a directory with a symlink (or
+// junction) between the check and the write or removal.
+type rootDir struct {
+	root string
+}
+
+func openRootDir(root string) (*rootDir, error) {
+	return &rootDir{root}, nil
+}
+
+func (d *rootDir) Close() error { return nil }
+
+func (d *rootDir) abs(path []string) string {
+	return filepath.Join(d.root, filepath.Join(path...))
+}
+
+// checkParent returns an error if any of the parent directories of path are
+// symlinks or junctions.
+func (d *rootDir) checkParent(path []string) error {
+	abs := d.root
+	for _, p := range path[:len(path)-1] {
+		abs = filepath.Join(abs, p)
+		fi, err := os.Lstat(abs)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 || fi.Mode()&os.ModeIrregular != 0 {
+			return &os.PathError{Op: "open", Path: abs, Err: errSymlinkParent}
+		}
+	}
+	return nil
+}
+
+// mkdir makes the directory at path.
+func (d *rootDir) mkdir(path []string) error {
+	if err := d.checkParent(path); err != nil {
+		return err
+	}
+	return os.Mkdir(d.abs(path), 0777)
+}
+
+// create makes a new file at path for writing. It fails if anything already
+// exists at path.
+func (d *rootDir) create(path []string) (*os.File, error) {
+	if err := d.checkParent(path); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(d.abs(path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+// symlink makes a symlink at path which points to target.
+func (d *rootDir) symlink(target string, path []string) error {
+	if err := d.checkParent(path); err != nil {
+		return err
+	}
+	return os.Symlink(target, d.abs(path))
+}
+
+// lstat returns information about the entry at path, without following it if
+// it's a symlink.
+func (d *rootDir) lstat(path []string) (os.FileInfo, error) {
+	if err := d.checkParent(path); err != nil {
+		return nil, err
+	}
+	return os.Lstat(d.abs(path))
+}
+
+// open opens the file at path for reading.
+func (d *rootDir) open(path []string) (*os.File, error) {
+	if err := d.checkParent(path); err != nil {
+		return nil, err
+	}
+	return os.Open(d.abs(path))
+}
+
+// readlink returns the target of the symlink at path.
+func (d *rootDir) readlink(path []string) (string, error) {
+	if err := d.checkParent(path); err != nil {
+		return "", err
+	}
+	return os.Readlink(d.abs(path))
+}
+
+// rename moves the entry at from to to, replacing anything at to. from and to
+// must be in the same directory.
+func (d *rootDir) rename(from, to []string) error {
+	if err := d.checkParent(to); err != nil {
+		return err
+	}
+	return os.Rename(d.abs(from), d.abs(to))
+}
+
+// removeAll removes the entry at path, along with everything in it if it's a
+// directory. Like os.RemoveAll, it succeeds if there's nothing at path.
+func (d *rootDir) removeAll(path []string) error {
+	if err := d.checkParent(path); err != nil {
+		return err
+	}
+	return os.RemoveAll(d.abs(path))
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/luci/luci-go/common/errors"
+	"github.com/luci/luci-go/common/iotools"
+)
+
+// CompressionAuto isn't a compression scheme. Passing it to sar.WithCompression
+// chooses the archive's scheme by compressing a sample of its data with
+// ChooseCompression.
+//
+// Its ID is reserved, so it can't be registered, and like the zero
+// CompressionScheme it isn't Valid. In a BlockHeader or chunk index, it marks
+// a scheme which CompressionAuto chose (see BlockHeader.SampleRatio).
+const CompressionAuto CompressionScheme = 127
+
+// A BlockHeader or chunk index whose scheme was chosen by CompressionAuto
+// encodes it as:
+//
+//   byte    CompressionAuto
+//   byte    the chosen CompressionScheme
+//   uvarint the sample's compression ratio, in millionths (rounded up)
+//
+// instead of the single CompressionScheme byte. Older readers reject it as an
+// unknown scheme.
+
+// appendScheme appends the encoding of scheme, and of sampleRatio if it's
+// non-zero, to buf.
+func appendScheme(buf []byte, scheme CompressionScheme, sampleRatio float64) []byte {
+	if sampleRatio == 0 {
+		return append(buf, byte(scheme))
+	}
+	buf = append(buf, byte(CompressionAuto), byte(scheme))
+	tmp := make([]byte, binary.MaxVarintLen64)
+	return append(buf, tmp[:binary.PutUvarint(tmp, uint64(math.Ceil(sampleRatio*1e6)))]...)
+}
+
+// readScheme reads a scheme encoded by appendScheme, and checks that it's
+// valid.
+func readScheme(br io.ByteReader) (scheme CompressionScheme, sampleRatio float64, err error) {
+	c, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+	if scheme = CompressionScheme(c); scheme == CompressionAuto {
+		if c, err = br.ReadByte(); err != nil {
+			return
+		}
+		scheme = CompressionScheme(c)
+		var ppm uint64
+		if ppm, err = binary.ReadUvarint(br); err != nil {
+			return
+		}
+		if ppm == 0 {
+			err = errors.New("zero sample ratio")
+			return
+		}
+		sampleRatio = float64(ppm) / 1e6
+	}
+	err = scheme.Valid()
+	return
+}
+
+// AutoSampleSize is the size of the sample (from the start of the data) which
+// CompressionAuto chooses a scheme with.
+const AutoSampleSize = 4 * 1024 * 1024
+
+// If no candidate shrinks the sample by at least autoMinSavings (as a fraction
+// of its size), ChooseCompression picks CompressionNone. Otherwise it picks the
+// first candidate whose output is at most autoTolerance larger than the
+// smallest.
+const (
+	autoMinSavings = 0.05
+	autoTolerance  = 0.10
+)
+
+// CompressionTrial is the result of compressing a sample with a scheme.
+type CompressionTrial struct {
+	Scheme CompressionScheme
+	Level  int
+
+	// Ratio is the compressed size divided by the size of the sample.
+	Ratio float64
+}
+
+// autoCandidates are the schemes which ChooseCompression tries, roughly from
+// the fastest to the slowest.
+var autoCandidates = []CompressionTrial{
+	{Scheme: CompressionLZ4, Level: 0},
+	{Scheme: CompressionZstd, Level: 3},
+	{Scheme: CompressionFlate, Level: 6},
+	{Scheme: CompressionBrotli, Level: 6},
+	{Scheme: CompressionXZ, Level: 6},
+}
+
+// ChooseCompression compresses sample with each of a few schemes, from fast
+// ones (lz4) to strong ones (xz), and returns the scheme to compress the rest
+// of the data with, along with every trial.
+//
+// A slower scheme is only chosen if the output of every faster one is more than
+// 10% larger than the smallest, and CompressionNone is chosen if no scheme
+// saves at least 5% (e.g. if the data is already compressed). The choice is
+// made on the sizes alone, so it doesn't depend on how busy the machine is. An
+// empty sample chooses CompressionNone without any trials.
+func ChooseCompression(sample []byte) (chosen CompressionTrial, trials []CompressionTrial, err error) {
+	chosen = CompressionTrial{Scheme: CompressionNone, Ratio: 1}
+	if len(sample) == 0 {
+		return
+	}
+
+	best := 1.0
+	for _, t := range autoCandidates {
+		cw := &iotools.CountingWriter{Writer: ioutil.Discard}
+		w, err := t.Scheme.Writer(cw, t.Level)
+		if err != nil {
+			return chosen, nil, errors.Annotate(err).Reason("trying %(scheme)s").
+				D("scheme", t.Scheme).Err()
+		}
+		if _, err := w.Write(sample); err != nil {
+			return chosen, nil, err
+		}
+		if err := w.Close(); err != nil {
+			return chosen, nil, err
+		}
+		t.Ratio = float64(cw.Count) / float64(len(sample))
+		trials = append(trials, t)
+		if t.Ratio < best {
+			best = t.Ratio
+		}
+	}
+
+	if best > 1-autoMinSavings {
+		return
+	}
+	for _, t := range trials {
+		if t.Ratio <= best*(1+autoTolerance) {
+			chosen = t
+			break
+		}
+	}
+	return
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"io"
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChooseCompression(t *testing.T) {
+	t.Parallel()
+
+	Convey("ChooseCompression", t, func() {
+		Convey("compressible", func() {
+			chosen, trials, err := ChooseCompression(testData(256 * 1024))
+			So(err, ShouldBeNil)
+			So(len(trials), ShouldEqual, len(autoCandidates))
+			So(chosen.Scheme, ShouldNotEqual, CompressionNone)
+			So(chosen.Ratio, ShouldBeLessThan, 0.5)
+			for _, t := range trials {
+				So(chosen.Ratio, ShouldBeLessThanOrEqualTo, t.Ratio*(1+autoTolerance))
+			}
+		})
+
+		Convey("incompressible", func() {
+			data := make([]byte, 256*1024)
+			rand.New(rand.NewSource(0)).Read(data)
+			chosen, trials, err := ChooseCompression(data)
+			So(err, ShouldBeNil)
+			So(len(trials), ShouldEqual, len(autoCandidates))
+			So(chosen, ShouldResemble, CompressionTrial{Scheme: CompressionNone, Ratio: 1})
+		})
+
+		Convey("empty", func() {
+			chosen, trials, err := ChooseCompression(nil)
+			So(err, ShouldBeNil)
+			So(trials, ShouldBeNil)
+			So(chosen.Scheme, ShouldEqual, CompressionNone)
+		})
+
+		Convey("isn't a real scheme", func() {
+			So(CompressionAuto.Valid(), ShouldNotBeNil)
+			So(CompressionAuto.String(), ShouldEqual, "auto")
+			So(CompressionScheme(0).Valid(), ShouldNotBeNil)
+			So(func() {
+				RegisterCompression(CompressionAuto, "not auto",
+					func(w io.Writer, _ int, _ []byte) (io.WriteCloser, error) {
+						return writeCloseHook{w, nil}, nil
+					},
+					func(r io.Reader, _ DecoderConfig) (io.ReadCloser, error) {
+						return readCloseHook{r, nil}, nil
+					})
+			}, ShouldPanicWith, `sardata: bad registration of compression scheme 127 ("not auto")`)
+		})
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"math"
 
 	"github.com/luci/luci-go/common/errors"
@@ -23,12 +24,18 @@ type BlockHeader struct {
 	// Compression indicates the compression decoder scheme that should be used
 	// for the block.
 	Compression CompressionScheme
+
+	// SampleRatio is the compression ratio (compressed size divided by
+	// uncompressed size) which CompressionAuto measured on a sample of the
+	// data when it chose Compression, to the nearest millionth. It's 0 if
+	// Compression was chosen some other way.
+	SampleRatio float64
 }
 
 func (b BlockHeader) Write(w io.Writer) error {
-	buf := make([]byte, binary.MaxVarintLen64+1)
+	buf := make([]byte, binary.MaxVarintLen64)
 	buf = buf[:binary.PutUvarint(buf, b.Length)]
-	buf = append(buf, byte(b.Compression))
+	buf = appendScheme(buf, b.Compression, b.SampleRatio)
 	_, err := w.Write(buf)
 	return err
 }
@@ -39,12 +46,8 @@ func (b *BlockHeader) Read(r io.Reader) (err error) {
 	if b.Length, err = binary.ReadUvarint(br); err != nil {
 		return
 	}
-	c, err := br.ReadByte()
-	if err != nil {
-		return
-	}
-	b.Compression = CompressionScheme(c)
-	return b.Compression.Valid()
+	b.Compression, b.SampleRatio, err = readScheme(br)
+	return
 }
 
 // BlockWriter returns a writer that will compress the data given to it. When
@@ -55,8 +58,28 @@ func (b *BlockHeader) Read(r io.Reader) (err error) {
 // that the length of the compressed data can be calculated to put into the
 // header.
 func BlockWriter(w io.Writer, scheme CompressionScheme, level int) (io.WriteCloser, error) {
+	return BlockWriterDict(w, scheme, level, nil)
+}
+
+// BlockWriterDict is like BlockWriter, but compresses with the zstd dictionary
+// dict (see CompressionScheme.WriterDict).
+func BlockWriterDict(w io.Writer, scheme CompressionScheme, level int, dict []byte) (io.WriteCloser, error) {
+	return blockWriter(w, scheme, level, dict, 0)
+}
+
+// SampledBlockWriter is like ParallelBlockWriter (or BlockWriterDict, if dict
+// is non-nil), but records sampleRatio, which CompressionAuto measured when it
+// chose scheme, in the BlockHeader.
+func SampledBlockWriter(w io.Writer, scheme CompressionScheme, level int, dict []byte, workers int, sampleRatio float64) (io.WriteCloser, error) {
+	if dict != nil {
+		return blockWriter(w, scheme, level, dict, sampleRatio)
+	}
+	return newParallelBlockWriter(w, scheme, level, workers, parallelSegmentSize, sampleRatio)
+}
+
+func blockWriter(w io.Writer, scheme CompressionScheme, level int, dict []byte, sampleRatio float64) (io.WriteCloser, error) {
 	buf := bytes.Buffer{}
-	compressWriter, err := scheme.Writer(&buf, level)
+	compressWriter, err := scheme.WriterDict(&buf, level, dict)
 	if err != nil {
 		return nil, err
 	}
@@ -68,7 +91,7 @@ func BlockWriter(w io.Writer, scheme CompressionScheme, level int) (io.WriteClos
 			if err := compressWriter.Close(); err != nil {
 				return err
 			}
-			h := BlockHeader{uint64(buf.Len()), scheme}
+			h := BlockHeader{uint64(buf.Len()), scheme, sampleRatio}
 			if err := h.Write(w); err != nil {
 				return err
 			}
@@ -81,13 +104,44 @@ func BlockWriter(w io.Writer, scheme CompressionScheme, level int) (io.WriteClos
 // BlockReader expects to read a compressed block from r. If it finds one and
 // knows the compression scheme of the block, it will return a ReadCloser which
 // can be used to read the decompressed data from the block.
+//
+// Closing the returned ReadCloser will consume the remainder of the compressed
+// block from r, so that r is positioned directly after the block.
 func BlockReader(r io.Reader) (io.ReadCloser, error) {
-	h := BlockHeader{}
-	if err := h.Read(r); err != nil {
-		return nil, err
+	_, ret, err := BlockReaderWithHeader(r)
+	return ret, err
+}
+
+// BlockReaderWithHeader is like BlockReader, but also returns the block's
+// header.
+func BlockReaderWithHeader(r io.Reader) (h BlockHeader, ret io.ReadCloser, err error) {
+	return BlockReaderConfig(r, DecoderConfig{})
+}
+
+// BlockReaderConfig is like BlockReaderWithHeader, but decompresses the block
+// as configured by cfg.
+func BlockReaderConfig(r io.Reader, cfg DecoderConfig) (h BlockHeader, ret io.ReadCloser, err error) {
+	if err = h.Read(r); err != nil {
+		return
 	}
 	if h.Length > math.MaxInt64 {
-		return nil, errors.New("block length exceeds int64")
+		err = errors.New("block length exceeds int64")
+		return
+	}
+	lr := io.LimitReader(r, int64(h.Length))
+	rc, err := h.Compression.ReaderConfig(lr, cfg)
+	if err != nil {
+		return
+	}
+	ret = readCloseHook{
+		rc,
+		func() error {
+			if err := rc.Close(); err != nil {
+				return err
+			}
+			_, err := io.Copy(ioutil.Discard, lr)
+			return err
+		},
 	}
-	return h.Compression.Reader(io.LimitReader(r, int64(h.Length)))
+	return
 }
@@ -6,9 +6,12 @@ package sardata
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"testing"
 
+	. "github.com/luci/luci-go/common/testing/assertions"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -51,3 +54,152 @@ func TestBlock(t *testing.T) {
 		})
 	})
 }
+
+func TestBlockRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	Convey("Block round trip", t, func() {
+		data := testData(100 * 1024)
+
+		for _, tc := range []struct {
+			scheme CompressionScheme
+			levels []int
+		}{
+			{CompressionNone, []int{0}},
+			{CompressionFlate, []int{-2, 1, 9}},
+			{CompressionZstd, []int{0, 1, 3, 9, 22}},
+			{CompressionXZ, []int{0, 6, 64 * 1024}},
+			{CompressionBrotli, []int{0, 6, 11}},
+			{CompressionLZ4, []int{0, 1, 9}},
+		} {
+			for _, level := range tc.levels {
+				Convey(fmt.Sprintf("%s at level %d", tc.scheme, level), func() {
+					buf := &bytes.Buffer{}
+					wc, err := BlockWriter(buf, tc.scheme, level)
+					So(err, ShouldBeNil)
+					_, err = wc.Write(data)
+					So(err, ShouldBeNil)
+					So(wc.Close(), ShouldBeNil)
+					if tc.scheme != CompressionNone {
+						So(buf.Len(), ShouldBeLessThan, len(data))
+					}
+
+					hdr, rc, err := BlockReaderWithHeader(bytes.NewReader(buf.Bytes()))
+					So(err, ShouldBeNil)
+					So(hdr.Compression, ShouldEqual, tc.scheme)
+					got, err := ioutil.ReadAll(rc)
+					So(err, ShouldBeNil)
+					So(rc.Close(), ShouldBeNil)
+					So(got, ShouldResemble, data)
+				})
+			}
+		}
+
+		Convey("bad zstd level", func() {
+			_, err := BlockWriter(&bytes.Buffer{}, CompressionZstd, 23)
+			So(err, ShouldErrLike, "out of range")
+			_, err = BlockWriter(&bytes.Buffer{}, CompressionZstd, -1)
+			So(err, ShouldErrLike, "out of range")
+		})
+
+		Convey("bad xz level", func() {
+			_, err := BlockWriter(&bytes.Buffer{}, CompressionXZ, 10)
+			So(err, ShouldErrLike, "neither a preset")
+			_, err = BlockWriter(&bytes.Buffer{}, CompressionXZ, -1)
+			So(err, ShouldErrLike, "neither a preset")
+		})
+
+		Convey("bad brotli and lz4 levels", func() {
+			_, err := BlockWriter(&bytes.Buffer{}, CompressionBrotli, 12)
+			So(err, ShouldErrLike, "out of range")
+			_, err = BlockWriter(&bytes.Buffer{}, CompressionLZ4, 10)
+			So(err, ShouldErrLike, "out of range")
+			_, err = BlockWriter(&bytes.Buffer{}, CompressionLZ4, -1)
+			So(err, ShouldErrLike, "out of range")
+		})
+
+		Convey("decoder memory limit", func() {
+			compress := func(scheme CompressionScheme, level int) []byte {
+				buf := &bytes.Buffer{}
+				wc, err := BlockWriter(buf, scheme, level)
+				So(err, ShouldBeNil)
+				_, err = wc.Write(data)
+				So(err, ShouldBeNil)
+				So(wc.Close(), ShouldBeNil)
+				return buf.Bytes()
+			}
+			read := func(block []byte, maxMemory uint64) error {
+				_, rc, err := BlockReaderConfig(bytes.NewReader(block), DecoderConfig{MaxMemory: maxMemory})
+				if err == nil {
+					_, err = ioutil.ReadAll(rc)
+				}
+				return err
+			}
+
+			Convey("xz", func() {
+				block := compress(CompressionXZ, 6)
+				So(read(block, 0), ShouldBeNil)
+				So(read(block, 8*1024*1024), ShouldBeNil)
+				So(read(block, 1024*1024), ShouldResemble, &ErrDecoderMemory{
+					Scheme: CompressionXZ, Needed: 8 * 1024 * 1024, Max: 1024 * 1024})
+			})
+
+			Convey("zstd", func() {
+				block := compress(CompressionZstd, 3)
+				So(read(block, 0), ShouldBeNil)
+				So(read(block, 1024), ShouldResemble, &ErrDecoderMemory{
+					Scheme: CompressionZstd, Max: 1024})
+			})
+		})
+
+		Convey("unknown scheme", func() {
+			_, err := BlockWriter(&bytes.Buffer{}, CompressionScheme(99), 0)
+			So(err, ShouldErrLike, "Unknown compression scheme 99")
+
+			h := BlockHeader{}
+			err = h.Read(bytes.NewReader([]byte{0, 99}))
+			So(err, ShouldErrLike, "Unknown compression scheme 99")
+			So(err, ShouldErrLike, "none (1), flate (2), zstd (3)")
+		})
+
+		Convey("sample ratio", func() {
+			for _, workers := range []int{1, 4} {
+				buf := &bytes.Buffer{}
+				wc, err := SampledBlockWriter(buf, CompressionFlate, 6, nil, workers, 0.25)
+				So(err, ShouldBeNil)
+				_, err = wc.Write(data)
+				So(err, ShouldBeNil)
+				So(wc.Close(), ShouldBeNil)
+
+				hdr, rc, err := BlockReaderWithHeader(bytes.NewReader(buf.Bytes()))
+				So(err, ShouldBeNil)
+				So(hdr.Compression, ShouldEqual, CompressionFlate)
+				So(hdr.SampleRatio, ShouldEqual, 0.25)
+				got, err := ioutil.ReadAll(rc)
+				So(err, ShouldBeNil)
+				So(rc.Close(), ShouldBeNil)
+				So(got, ShouldResemble, data)
+			}
+
+			Convey("is rounded up to millionths", func() {
+				buf := &bytes.Buffer{}
+				So(BlockHeader{Length: 5, Compression: CompressionZstd, SampleRatio: 0.1234561}.Write(buf), ShouldBeNil)
+				So(buf.Bytes(), ShouldResemble, []byte{5, byte(CompressionAuto), byte(CompressionZstd), 0xc1, 0xc4, 0x07})
+
+				h := BlockHeader{}
+				So(h.Read(buf), ShouldBeNil)
+				So(h, ShouldResemble, BlockHeader{Length: 5, Compression: CompressionZstd, SampleRatio: 0.123457})
+			})
+
+			Convey("must be valid", func() {
+				h := BlockHeader{}
+				err := h.Read(bytes.NewReader([]byte{0, byte(CompressionAuto), 99, 1}))
+				So(err, ShouldErrLike, "Unknown compression scheme 99")
+				err = h.Read(bytes.NewReader([]byte{0, byte(CompressionAuto), byte(CompressionAuto), 1}))
+				So(err, ShouldErrLike, "Unknown compression scheme 127")
+				err = h.Read(bytes.NewReader([]byte{0, byte(CompressionAuto), byte(CompressionZstd), 0}))
+				So(err, ShouldErrLike, "zero sample ratio")
+			})
+		})
+	})
+}
@@ -0,0 +1,446 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"github.com/luci/luci-go/common/errors"
+	"github.com/luci/luci-go/common/iotools"
+)
+
+// A chunked block is the data block of a VersionChunked archive. It's made of
+// independently compressed chunks, so that a reader can start decompressing at
+// any chunk boundary. It's encoded as:
+//
+//   uvarint number of chunks
+//   byte    CompressionScheme of every chunk (see CompressionAuto for how
+//           a scheme which it chose is encoded)
+//   for each chunk:
+//     uvarint uncompressed size
+//     uvarint compressed size
+//   the compressed data of each chunk, in order
+//
+// The part before the compressed data is the chunk index.
+
+// Chunk is a single entry in a ChunkIndex.
+type Chunk struct {
+	// UncompressedOffset is the offset of the chunk's first byte in the
+	// uncompressed data stream.
+	UncompressedOffset uint64
+	UncompressedSize   uint64
+
+	// CompressedOffset is the offset of the chunk's compressed data, relative to
+	// the end of the chunk index.
+	CompressedOffset uint64
+	CompressedSize   uint64
+}
+
+// ChunkIndex describes the chunks of a chunked block.
+type ChunkIndex struct {
+	Compression CompressionScheme
+	Chunks      []Chunk
+
+	// SampleRatio is like BlockHeader.SampleRatio.
+	SampleRatio float64
+
+	// Size is the encoded size of the chunk index, i.e. the offset of the first
+	// chunk's compressed data from the start of the block.
+	Size int64
+
+	// Decoder configures the decompression of the chunks, e.g. with the zstd
+	// dictionary which they were compressed with. It isn't part of the encoded
+	// index: ParallelChunkedBlockReader sets it, but callers of ReadChunkIndex
+	// must set it themselves before calling DataAt.
+	Decoder DecoderConfig
+}
+
+// UncompressedSize returns the total size of the uncompressed data stream.
+func (idx *ChunkIndex) UncompressedSize() uint64 {
+	if len(idx.Chunks) == 0 {
+		return 0
+	}
+	last := idx.Chunks[len(idx.Chunks)-1]
+	return last.UncompressedOffset + last.UncompressedSize
+}
+
+// CompressedSize returns the total size of the compressed chunks, not including
+// the index.
+func (idx *ChunkIndex) CompressedSize() uint64 {
+	if len(idx.Chunks) == 0 {
+		return 0
+	}
+	last := idx.Chunks[len(idx.Chunks)-1]
+	return last.CompressedOffset + last.CompressedSize
+}
+
+func (idx *ChunkIndex) write(w io.Writer) error {
+	buf := make([]byte, 0, binary.MaxVarintLen64*(2*len(idx.Chunks)+2)+2)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, v)]...)
+	}
+	putUvarint(uint64(len(idx.Chunks)))
+	buf = appendScheme(buf, idx.Compression, idx.SampleRatio)
+	for _, c := range idx.Chunks {
+		putUvarint(c.UncompressedSize)
+		putUvarint(c.CompressedSize)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadChunkIndex reads the chunk index at the start of a chunked block from r.
+// r is left positioned at the start of the first chunk's compressed data.
+func ReadChunkIndex(r io.Reader) (*ChunkIndex, error) {
+	cr := &iotools.CountingReader{Reader: r}
+	br := byteReader{Reader: cr}
+
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	idx := &ChunkIndex{}
+	if idx.Compression, idx.SampleRatio, err = readScheme(br); err != nil {
+		return nil, err
+	}
+
+	var uOff, cOff uint64
+	for i := uint64(0); i < n; i++ {
+		// Every chunk takes at least two bytes, so a bogus count will run out of
+		// data before it uses much memory.
+		ch := Chunk{UncompressedOffset: uOff, CompressedOffset: cOff}
+		if ch.UncompressedSize, err = binary.ReadUvarint(br); err != nil {
+			return nil, errors.Annotate(err).Reason("reading chunk %(i)d").D("i", i).Err()
+		}
+		if ch.CompressedSize, err = binary.ReadUvarint(br); err != nil {
+			return nil, errors.Annotate(err).Reason("reading chunk %(i)d").D("i", i).Err()
+		}
+		if uOff+ch.UncompressedSize < uOff || cOff+ch.CompressedSize < cOff ||
+			cOff+ch.CompressedSize > math.MaxInt64 {
+			return nil, errors.New("chunk sizes overflow")
+		}
+		uOff += ch.UncompressedSize
+		cOff += ch.CompressedSize
+		idx.Chunks = append(idx.Chunks, ch)
+	}
+	idx.Size = cr.Count
+	return idx, nil
+}
+
+// ChunkedWriter compresses data into a chunked block. See ChunkedBlockWriter.
+type ChunkedWriter struct {
+	w       io.Writer
+	scheme  CompressionScheme
+	level   int
+	dict    []byte
+	size    uint64
+	atFiles bool
+
+	// buf holds the compressed data of all of the chunks so far.
+	buf bytes.Buffer
+	idx ChunkIndex
+
+	// cw compresses the current chunk into buf, and is nil if there's no current
+	// chunk. cur is the number of uncompressed bytes in the current chunk.
+	cw  io.WriteCloser
+	cur uint64
+
+	// pool is non-nil if chunks are compressed in parallel. In that case the
+	// current chunk is buffered in raw (instead of using cw), and is compressed
+	// by the pool when it ends.
+	pool *compressPool
+	raw  []byte
+}
+
+var _ io.WriteCloser = (*ChunkedWriter)(nil)
+
+// ChunkedBlockWriter returns a writer which compresses the data given to it
+// into a chunked block. When it's closed, the chunk index and the compressed
+// chunks will be written to w. Like BlockWriter, the compressed data is
+// buffered in memory until then.
+//
+// If atFiles is false, every chunk (but the last) holds exactly size
+// uncompressed bytes. If atFiles is true, chunks only end when FileBoundary is
+// called, once they hold at least size bytes; this means that no file is split
+// between two chunks.
+//
+// If workers is more than 1, up to that many chunks are compressed
+// concurrently. This doesn't change the output.
+//
+// If dict is non-nil, every chunk is compressed with it (see
+// CompressionScheme.WriterDict).
+func ChunkedBlockWriter(w io.Writer, scheme CompressionScheme, level int, dict []byte, size uint64, atFiles bool, workers int) (*ChunkedWriter, error) {
+	if err := scheme.Valid(); err != nil {
+		return nil, err
+	}
+	if dict != nil && scheme != CompressionZstd {
+		return nil, errors.New("dictionaries are only supported by CompressionZstd")
+	}
+	if size == 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+	ret := &ChunkedWriter{
+		w: w, scheme: scheme, level: level, dict: dict, size: size, atFiles: atFiles,
+		idx: ChunkIndex{Compression: scheme},
+	}
+	if workers > 1 {
+		ret.pool = newCompressPool(workers)
+	}
+	return ret, nil
+}
+
+// writeChunk adds p to the current chunk.
+func (c *ChunkedWriter) writeChunk(p []byte) (int, error) {
+	if c.pool != nil {
+		c.raw = append(c.raw, p...)
+		return len(p), nil
+	}
+	if c.cw == nil {
+		var err error
+		if c.cw, err = c.scheme.WriterDict(&c.buf, c.level, c.dict); err != nil {
+			return 0, err
+		}
+	}
+	return c.cw.Write(p)
+}
+
+func (c *ChunkedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		toWrite := p
+		if !c.atFiles {
+			if remaining := c.size - c.cur; uint64(len(toWrite)) > remaining {
+				toWrite = toWrite[:remaining]
+			}
+		}
+		var wrote int
+		wrote, err = c.writeChunk(toWrite)
+		n += wrote
+		c.cur += uint64(wrote)
+		p = p[wrote:]
+		if err != nil {
+			return
+		}
+		if !c.atFiles && c.cur >= c.size {
+			if err = c.endChunk(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// FileBoundary marks the end of a file in the uncompressed data stream. If the
+// ChunkedWriter splits chunks at file boundaries, this ends the current chunk
+// if it's big enough.
+func (c *ChunkedWriter) FileBoundary() error {
+	if c.atFiles && c.cur >= c.size {
+		return c.endChunk()
+	}
+	return nil
+}
+
+// SetSampleRatio records the compression ratio which CompressionAuto measured
+// when it chose the ChunkedWriter's scheme in the chunk index. See
+// BlockHeader.SampleRatio.
+func (c *ChunkedWriter) SetSampleRatio(ratio float64) {
+	c.idx.SampleRatio = ratio
+}
+
+func (c *ChunkedWriter) endChunk() error {
+	if c.cur == 0 {
+		return nil
+	}
+	size := c.cur
+	c.cur = 0
+
+	if c.pool != nil {
+		raw := c.raw
+		c.raw = nil
+		return c.pool.submit(func(w io.Writer) error {
+			cw, err := c.scheme.WriterDict(w, c.level, c.dict)
+			if err != nil {
+				return err
+			}
+			if _, err := cw.Write(raw); err != nil {
+				return err
+			}
+			return cw.Close()
+		}, func(out []byte) error {
+			c.buf.Write(out)
+			c.addChunk(size, uint64(len(out)))
+			return nil
+		})
+	}
+
+	// Some schemes (e.g. CompressionNone) write to buf as soon as they're given
+	// data, so measure from the end of the previous chunk.
+	err := c.cw.Close()
+	c.cw = nil
+	if err != nil {
+		return err
+	}
+	c.addChunk(size, uint64(c.buf.Len())-c.idx.CompressedSize())
+	return nil
+}
+
+// addChunk appends a chunk to the index, whose compressed data has just been
+// appended to buf.
+func (c *ChunkedWriter) addChunk(uncompressed, compressed uint64) {
+	c.idx.Chunks = append(c.idx.Chunks, Chunk{
+		UncompressedOffset: c.idx.UncompressedSize(),
+		UncompressedSize:   uncompressed,
+		CompressedOffset:   c.idx.CompressedSize(),
+		CompressedSize:     compressed,
+	})
+}
+
+// Close ends the last chunk, and writes the chunked block to the underlying
+// writer.
+func (c *ChunkedWriter) Close() error {
+	if err := c.endChunk(); err != nil {
+		return err
+	}
+	if c.pool != nil {
+		if err := c.pool.wait(); err != nil {
+			return err
+		}
+	}
+	if err := c.idx.write(c.w); err != nil {
+		return err
+	}
+	_, err := c.w.Write(c.buf.Bytes())
+	return err
+}
+
+// chunkReader reads the uncompressed data of a sequence of chunks from r,
+// which must be positioned at the start of the first chunk's compressed data.
+type chunkReader struct {
+	r      io.Reader
+	scheme CompressionScheme
+	cfg    DecoderConfig
+	chunks []Chunk
+
+	// cur decompresses the current chunk from lr, and has remaining bytes left.
+	cur       io.ReadCloser
+	lr        *io.LimitedReader
+	remaining uint64
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			ch := c.chunks[0]
+			c.chunks = c.chunks[1:]
+			c.lr = &io.LimitedReader{R: c.r, N: int64(ch.CompressedSize)}
+			rc, err := c.scheme.ReaderConfig(c.lr, c.cfg)
+			if err != nil {
+				return 0, err
+			}
+			c.cur, c.remaining = rc, ch.UncompressedSize
+		}
+		if c.remaining == 0 {
+			if err := c.endChunk(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if uint64(len(p)) > c.remaining {
+			p = p[:c.remaining]
+		}
+		n, err := c.cur.Read(p)
+		c.remaining -= uint64(n)
+		if err == io.EOF {
+			err = nil
+			if c.remaining > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// endChunk closes the current chunk's decompressor, and skips the rest of its
+// compressed data.
+func (c *chunkReader) endChunk() error {
+	err := c.cur.Close()
+	c.cur = nil
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, c.lr)
+	return err
+}
+
+// ChunkedBlockReader reads a chunked block from r. It returns the block's
+// index, and a ReadCloser for the block's uncompressed data.
+//
+// Closing the returned ReadCloser will consume the remainder of the block from
+// r, so that r is positioned directly after the block.
+func ChunkedBlockReader(r io.Reader) (*ChunkIndex, io.ReadCloser, error) {
+	return ParallelChunkedBlockReader(r, 1, DecoderConfig{})
+}
+
+// chunkedBlockReader implements ChunkedBlockReader for idx, which has just been
+// read from r.
+func chunkedBlockReader(r io.Reader, idx *ChunkIndex) io.ReadCloser {
+	lr := io.LimitReader(r, int64(idx.CompressedSize()))
+	cr := &chunkReader{r: lr, scheme: idx.Compression, cfg: idx.Decoder, chunks: idx.Chunks}
+	return readCloseHook{
+		cr,
+		func() error {
+			if cr.cur != nil {
+				if err := cr.cur.Close(); err != nil {
+					return err
+				}
+			}
+			_, err := io.Copy(ioutil.Discard, lr)
+			return err
+		},
+	}
+}
+
+// DataAt returns a reader for the uncompressed data stream of the chunked block
+// described by idx, starting at offset. block must read the chunked block
+// starting from its chunk index.
+//
+// Only the chunks starting with the one containing offset are read.
+func (idx *ChunkIndex) DataAt(block io.ReaderAt, offset uint64) (io.Reader, error) {
+	if offset > idx.UncompressedSize() {
+		return nil, errors.Reason("offset %(offset)d is past the end of the data").
+			D("offset", offset).Err()
+	}
+	i := sort.Search(len(idx.Chunks), func(i int) bool {
+		c := idx.Chunks[i]
+		return c.UncompressedOffset+c.UncompressedSize > offset
+	})
+	if i == len(idx.Chunks) {
+		return bytes.NewReader(nil), nil
+	}
+	start := idx.Chunks[i]
+	r := &chunkReader{
+		r: io.NewSectionReader(block, idx.Size+int64(start.CompressedOffset),
+			int64(idx.CompressedSize()-start.CompressedOffset)),
+		scheme: idx.Compression,
+		cfg:    idx.Decoder,
+		chunks: idx.Chunks[i:],
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(offset-start.UncompressedOffset)); err != nil {
+		return nil, errors.Annotate(err).Reason("skipping to offset %(offset)d").
+			D("offset", offset).Err()
+	}
+	return r, nil
+}
@@ -0,0 +1,338 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/luci/luci-go/common/iotools"
+	. "github.com/luci/luci-go/common/testing/assertions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// minReaderAt records the lowest offset that was read from it.
+type minReaderAt struct {
+	io.ReaderAt
+	min int64
+}
+
+func (m *minReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < m.min {
+		m.min = off
+	}
+	return m.ReaderAt.ReadAt(p, off)
+}
+
+func TestChunkedBlock(t *testing.T) {
+	t.Parallel()
+
+	Convey("Chunked block", t, func() {
+		// 10 "files" of 100 bytes each.
+		files := make([][]byte, 10)
+		data := []byte{}
+		for i := range files {
+			files[i] = bytes.Repeat([]byte(fmt.Sprintf("file %d! ", i)), 13)[:100]
+			data = append(data, files[i]...)
+		}
+
+		writeWorkers := func(size uint64, atFiles bool, workers int) []byte {
+			buf := &bytes.Buffer{}
+			cw, err := ChunkedBlockWriter(buf, CompressionFlate, 9, nil, size, atFiles, workers)
+			So(err, ShouldBeNil)
+			for _, f := range files {
+				// Write in odd pieces to make sure that chunks are split correctly.
+				for len(f) > 0 {
+					n := 7
+					if n > len(f) {
+						n = len(f)
+					}
+					_, err := cw.Write(f[:n])
+					So(err, ShouldBeNil)
+					f = f[n:]
+				}
+				So(cw.FileBoundary(), ShouldBeNil)
+			}
+			So(cw.Close(), ShouldBeNil)
+			return buf.Bytes()
+		}
+		write := func(size uint64, atFiles bool) []byte {
+			return writeWorkers(size, atFiles, 1)
+		}
+
+		chunkSizes := func(idx *ChunkIndex) []uint64 {
+			ret := make([]uint64, len(idx.Chunks))
+			for i, c := range idx.Chunks {
+				ret[i] = c.UncompressedSize
+			}
+			return ret
+		}
+
+		Convey("by size", func() {
+			block := write(256, false)
+
+			idx, rc, err := ChunkedBlockReader(bytes.NewReader(block))
+			So(err, ShouldBeNil)
+			So(idx.Compression, ShouldEqual, CompressionFlate)
+			So(chunkSizes(idx), ShouldResemble, []uint64{256, 256, 256, 232})
+			So(idx.UncompressedSize(), ShouldEqual, 1000)
+			So(idx.Size+int64(idx.CompressedSize()), ShouldEqual, len(block))
+
+			got, err := ioutil.ReadAll(rc)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, data)
+			So(rc.Close(), ShouldBeNil)
+		})
+
+		Convey("uncompressed", func() {
+			buf := &bytes.Buffer{}
+			cw, err := ChunkedBlockWriter(buf, CompressionNone, 0, nil, 256, false, 1)
+			So(err, ShouldBeNil)
+			_, err = cw.Write(data)
+			So(err, ShouldBeNil)
+			So(cw.Close(), ShouldBeNil)
+
+			idx, rc, err := ChunkedBlockReader(bytes.NewReader(buf.Bytes()))
+			So(err, ShouldBeNil)
+			So(idx.CompressedSize(), ShouldEqual, 1000)
+			got, err := ioutil.ReadAll(rc)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, data)
+		})
+
+		Convey("at file boundaries", func() {
+			block := write(250, true)
+
+			idx, rc, err := ChunkedBlockReader(bytes.NewReader(block))
+			So(err, ShouldBeNil)
+			So(chunkSizes(idx), ShouldResemble, []uint64{300, 300, 300, 100})
+
+			got, err := ioutil.ReadAll(rc)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, data)
+			So(rc.Close(), ShouldBeNil)
+		})
+
+		Convey("in parallel", func() {
+			So(writeWorkers(256, false, 3), ShouldResemble, write(256, false))
+			So(writeWorkers(250, true, 3), ShouldResemble, write(250, true))
+
+			Convey("read", func() {
+				block := write(100, false)
+				idx, rc, err := ParallelChunkedBlockReader(bytes.NewReader(block), 3, DecoderConfig{})
+				So(err, ShouldBeNil)
+				So(len(idx.Chunks), ShouldEqual, 10)
+				got, err := ioutil.ReadAll(rc)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, data)
+				So(rc.Close(), ShouldBeNil)
+			})
+
+			Convey("close consumes the block", func() {
+				block := write(100, false)
+				r := bytes.NewReader(append(block, "after"...))
+				_, rc, err := ParallelChunkedBlockReader(r, 3, DecoderConfig{})
+				So(err, ShouldBeNil)
+				buf := make([]byte, 150)
+				_, err = io.ReadFull(rc, buf)
+				So(err, ShouldBeNil)
+				So(buf, ShouldResemble, data[:150])
+				So(rc.Close(), ShouldBeNil)
+				rest, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(string(rest), ShouldEqual, "after")
+			})
+
+			Convey("streams big chunks", func() {
+				big := bytes.Repeat([]byte("big chunk "), maxBufferedChunkSize/10+1)
+				buf := &bytes.Buffer{}
+				cw, err := ChunkedBlockWriter(buf, CompressionFlate, 1, nil, 100, true, 1)
+				So(err, ShouldBeNil)
+				for _, f := range [][]byte{data[:100], big, data[100:]} {
+					_, err = cw.Write(f)
+					So(err, ShouldBeNil)
+					So(cw.FileBoundary(), ShouldBeNil)
+				}
+				So(cw.Close(), ShouldBeNil)
+
+				r := bytes.NewReader(append(buf.Bytes(), "after"...))
+				idx, rc, err := ParallelChunkedBlockReader(r, 3, DecoderConfig{})
+				So(err, ShouldBeNil)
+				So(chunkSizes(idx), ShouldResemble, []uint64{100, uint64(len(big)), 900})
+
+				Convey("read", func() {
+					got, err := ioutil.ReadAll(rc)
+					So(err, ShouldBeNil)
+					So(got, ShouldResemble, append(append(data[:100:100], big...), data[100:]...))
+					So(rc.Close(), ShouldBeNil)
+				})
+
+				Convey("close during the big chunk", func() {
+					_, err := io.CopyN(ioutil.Discard, rc, 1000)
+					So(err, ShouldBeNil)
+					So(rc.Close(), ShouldBeNil)
+					rest, err := ioutil.ReadAll(r)
+					So(err, ShouldBeNil)
+					So(string(rest), ShouldEqual, "after")
+				})
+			})
+
+			Convey("forged index", func() {
+				// A small flate stream which decompresses to much more than the
+				// index says.
+				bomb := &bytes.Buffer{}
+				fw, err := CompressionFlate.Writer(bomb, 9)
+				So(err, ShouldBeNil)
+				_, err = fw.Write(make([]byte, 2*maxBufferedChunkSize))
+				So(err, ShouldBeNil)
+				So(fw.Close(), ShouldBeNil)
+
+				forge := func(size uint64) io.ReadCloser {
+					buf := &bytes.Buffer{}
+					forged := ChunkIndex{Compression: CompressionFlate, Chunks: []Chunk{
+						{UncompressedSize: size, CompressedSize: uint64(bomb.Len())},
+					}}
+					So(forged.write(buf), ShouldBeNil)
+					buf.Write(bomb.Bytes())
+					_, rc, err := ParallelChunkedBlockReader(bytes.NewReader(buf.Bytes()), 3, DecoderConfig{})
+					So(err, ShouldBeNil)
+					return rc
+				}
+
+				Convey("too small", func() {
+					n, err := io.Copy(ioutil.Discard, forge(100))
+					So(err, ShouldBeNil)
+					So(n, ShouldEqual, 100)
+				})
+
+				Convey("too big", func() {
+					n, err := io.Copy(ioutil.Discard, forge(1<<40))
+					So(err, ShouldEqual, io.ErrUnexpectedEOF)
+					So(n, ShouldEqual, 2*maxBufferedChunkSize)
+				})
+
+				Convey("claiming lots of compressed data", func() {
+					small := &bytes.Buffer{}
+					fw, err := CompressionFlate.Writer(small, 9)
+					So(err, ShouldBeNil)
+					_, err = fw.Write(data[:100])
+					So(err, ShouldBeNil)
+					So(fw.Close(), ShouldBeNil)
+
+					buf := &bytes.Buffer{}
+					forged := ChunkIndex{Compression: CompressionFlate, Chunks: []Chunk{
+						{UncompressedSize: 100, CompressedSize: 1 << 40},
+					}}
+					So(forged.write(buf), ShouldBeNil)
+					buf.Write(small.Bytes())
+					buf.Write(make([]byte, 2*maxBufferedChunkSize))
+
+					r := &iotools.CountingReader{Reader: bytes.NewReader(buf.Bytes())}
+					_, rc, err := ParallelChunkedBlockReader(r, 3, DecoderConfig{})
+					So(err, ShouldBeNil)
+					got := make([]byte, 100)
+					_, err = io.ReadFull(rc, got)
+					So(err, ShouldBeNil)
+					So(got, ShouldResemble, data[:100])
+					So(r.Count, ShouldBeLessThan, maxBufferedChunkSize)
+				})
+			})
+
+			Convey("truncated", func() {
+				block := write(100, false)
+				_, rc, err := ParallelChunkedBlockReader(bytes.NewReader(block[:len(block)-3]), 3, DecoderConfig{})
+				So(err, ShouldBeNil)
+				_, err = ioutil.ReadAll(rc)
+				So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			})
+		})
+
+		Convey("close consumes the block", func() {
+			block := write(256, false)
+			r := bytes.NewReader(append(block, "after"...))
+			_, rc, err := ChunkedBlockReader(r)
+			So(err, ShouldBeNil)
+			buf := make([]byte, 300)
+			_, err = io.ReadFull(rc, buf)
+			So(err, ShouldBeNil)
+			So(rc.Close(), ShouldBeNil)
+			rest, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(rest), ShouldEqual, "after")
+		})
+
+		Convey("DataAt", func() {
+			block := write(256, false)
+			idx, err := ReadChunkIndex(bytes.NewReader(block))
+			So(err, ShouldBeNil)
+
+			for _, offset := range []uint64{0, 1, 255, 256, 600, 999, 1000} {
+				ra := &minReaderAt{bytes.NewReader(block), int64(len(block))}
+				r, err := idx.DataAt(ra, offset)
+				So(err, ShouldBeNil)
+				got, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, data[offset:])
+
+				// Only the chunks from the one containing offset are read.
+				if offset < 1000 {
+					c := idx.Chunks[offset/256]
+					So(ra.min, ShouldEqual, idx.Size+int64(c.CompressedOffset))
+				}
+			}
+
+			_, err = idx.DataAt(bytes.NewReader(block), 1001)
+			So(err, ShouldErrLike, "past the end")
+		})
+
+		Convey("empty", func() {
+			buf := &bytes.Buffer{}
+			cw, err := ChunkedBlockWriter(buf, CompressionFlate, 9, nil, 10, false, 1)
+			So(err, ShouldBeNil)
+			So(cw.Close(), ShouldBeNil)
+			So(buf.Bytes(), ShouldResemble, []byte{0, byte(CompressionFlate)})
+
+			idx, rc, err := ChunkedBlockReader(bytes.NewReader(buf.Bytes()))
+			So(err, ShouldBeNil)
+			So(idx.Chunks, ShouldBeEmpty)
+			got, err := ioutil.ReadAll(rc)
+			So(err, ShouldBeNil)
+			So(got, ShouldBeEmpty)
+		})
+
+		Convey("sample ratio", func() {
+			buf := &bytes.Buffer{}
+			cw, err := ChunkedBlockWriter(buf, CompressionFlate, 9, nil, 10, false, 1)
+			So(err, ShouldBeNil)
+			cw.SetSampleRatio(0.5)
+			_, err = cw.Write(data[:25])
+			So(err, ShouldBeNil)
+			So(cw.Close(), ShouldBeNil)
+
+			idx, rc, err := ChunkedBlockReader(bytes.NewReader(buf.Bytes()))
+			So(err, ShouldBeNil)
+			So(idx.Compression, ShouldEqual, CompressionFlate)
+			So(idx.SampleRatio, ShouldEqual, 0.5)
+			So(idx.Chunks, ShouldHaveLength, 3)
+			got, err := ioutil.ReadAll(rc)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, data[:25])
+		})
+
+		Convey("bad", func() {
+			_, err := ChunkedBlockWriter(&bytes.Buffer{}, CompressionFlate, 9, nil, 0, false, 1)
+			So(err, ShouldErrLike, "chunk size must be positive")
+
+			_, err = ReadChunkIndex(bytes.NewReader([]byte{1, 99}))
+			So(err, ShouldErrLike, "Unknown compression scheme")
+
+			_, err = ReadChunkIndex(bytes.NewReader([]byte{3, 2, 1, 1, 1, 1}))
+			So(err, ShouldErrLike, "reading chunk 2")
+		})
+	})
+}
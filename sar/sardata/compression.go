@@ -6,50 +6,376 @@ package sardata
 
 import (
 	"compress/flate"
+	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	"github.com/luci/luci-go/common/errors"
+	"github.com/pierrec/lz4/v4"
 )
 
 // CompressionScheme indicates the type of compression used in a block, as
 // indicated by that block's BlockHeader.
 type CompressionScheme byte
 
-// These are the currently supported compressions schemes.
+// These are the built in compression schemes. Others may be added with
+// RegisterCompression.
 //
-// TODO(iannucci): add zstd or brotli as support becomes available.
+// The level given to Writer means the same thing as it does for the underlying
+// library: -2 to 9 for CompressionFlate (see compress/flate), and 0 to 22 for
+// CompressionZstd (see zstdLevel). For CompressionXZ it's either a preset from
+// 0 to 9, like the xz command line tool, or a dictionary size in bytes (see
+// xzDictCap). It's 0 to 11 for CompressionBrotli, and 0 to 9 for
+// CompressionLZ4 (see lz4Levels). CompressionNone ignores it.
+//
+// Roughly, CompressionLZ4 is the fastest (especially to decompress) and
+// CompressionXZ and CompressionBrotli at their highest levels compress best;
+// see BenchmarkSchemes for numbers.
 const (
 	CompressionNone CompressionScheme = iota + 1
 	CompressionFlate
+	CompressionZstd
+	CompressionXZ
+	CompressionBrotli
+	CompressionLZ4
 )
 
+// DefaultDecoderMaxMemory is the most memory that a decompressor may need for
+// its window or dictionary, unless DecoderConfig.MaxMemory says otherwise.
+const DefaultDecoderMaxMemory = 256 * 1024 * 1024
+
+// DecoderConfig configures the decompressing readers returned by ReaderConfig.
+type DecoderConfig struct {
+	// Dict is the zstd dictionary which the data was compressed with, if any.
+	Dict []byte
+
+	// MaxMemory limits the size of the window or dictionary that the data may
+	// require to be decompressed, in bytes, so that a hostile block can't make
+	// the reader allocate arbitrarily large buffers. 0 means
+	// DefaultDecoderMaxMemory.
+	//
+	// Schemes whose windows are always small (at most 16MB for brotli, and 4MB
+	// blocks for lz4) ignore it.
+	MaxMemory uint64
+}
+
+func (d DecoderConfig) maxMemory() uint64 {
+	if d.MaxMemory == 0 {
+		return DefaultDecoderMaxMemory
+	}
+	return d.MaxMemory
+}
+
+// ErrDecoderMemory is returned by decompressing readers if the data would need
+// more memory than DecoderConfig.MaxMemory allows.
+type ErrDecoderMemory struct {
+	Scheme CompressionScheme
+
+	// Needed is the memory that the data needs, or 0 if the scheme doesn't say.
+	Needed uint64
+	Max    uint64
+}
+
+func (e *ErrDecoderMemory) Error() string {
+	if e.Needed == 0 {
+		return fmt.Sprintf("decompressing %s data needs more than %d bytes of memory",
+			e.Scheme, e.Max)
+	}
+	return fmt.Sprintf("decompressing %s data needs %d bytes of memory, more than %d",
+		e.Scheme, e.Needed, e.Max)
+}
+
+// zstdMaxLevel is the highest level accepted for CompressionZstd, as for the
+// reference zstd implementation.
+const zstdMaxLevel = 22
+
+// zstdLevel maps a zstd compression level (1-22, like the zstd command line
+// tool) to the nearest level supported by the pure-Go encoder. 0 selects the
+// encoder's default.
+func zstdLevel(level int) (zstd.EncoderLevel, error) {
+	if level < 0 || level > zstdMaxLevel {
+		return 0, errors.Reason("zstd level %(level)d is out of range [0, %(max)d]").
+			D("level", level).D("max", zstdMaxLevel).Err()
+	}
+	if level == 0 {
+		return zstd.SpeedDefault, nil
+	}
+	return zstd.EncoderLevelFromZstd(level), nil
+}
+
+// newZstdWriter returns a zstd encoder which uses a single goroutine. Blocks
+// which are compressed in parallel get their concurrency from
+// ChunkedBlockWriter instead.
+func newZstdWriter(w io.Writer, level int, dict []byte) (io.WriteCloser, error) {
+	l, err := zstdLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(l), zstd.WithEncoderConcurrency(1)}
+	if dict != nil {
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+// zstdReader is a zstd decoder which reports windows larger than its limit as
+// an *ErrDecoderMemory.
+type zstdReader struct {
+	d   *zstd.Decoder
+	max uint64
+}
+
+func (z zstdReader) Read(p []byte) (int, error) {
+	n, err := z.d.Read(p)
+	// The decoder reports a window larger than WithDecoderMaxWindow as either of
+	// these, depending on where it notices. The decoded size itself isn't
+	// limited.
+	if err == zstd.ErrWindowSizeExceeded || err == zstd.ErrDecoderSizeExceeded {
+		err = &ErrDecoderMemory{Scheme: CompressionZstd, Max: z.max}
+	}
+	return n, err
+}
+
+func (z zstdReader) Close() error {
+	z.d.Close()
+	return nil
+}
+
+// newZstdReader returns a zstd decoder which uses a single goroutine.
+func newZstdReader(r io.Reader, cfg DecoderConfig) (io.ReadCloser, error) {
+	max := cfg.maxMemory()
+	if max < zstd.MinWindowSize {
+		max = zstd.MinWindowSize
+	}
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(max)}
+	if cfg.Dict != nil {
+		opts = append(opts, zstd.WithDecoderDicts(cfg.Dict))
+	}
+	d, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return zstdReader{d, max}, nil
+}
+
+// newBrotliWriter returns a brotli encoder for level, which must be between 0
+// and 11.
+func newBrotliWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level < brotli.BestSpeed || level > brotli.BestCompression {
+		return nil, errors.Reason("brotli level %(level)d is out of range [%(min)d, %(max)d]").
+			D("level", level).D("min", brotli.BestSpeed).D("max", brotli.BestCompression).Err()
+	}
+	return brotli.NewWriterLevel(w, level), nil
+}
+
+// lz4Levels maps the levels of CompressionLZ4 to the lz4 package's levels. 0 is
+// the fast compressor, and 1 to 9 are increasingly thorough (and slow) high
+// compression levels, which decompress just as fast.
+var lz4Levels = []lz4.CompressionLevel{
+	lz4.Fast,
+	lz4.Level1, lz4.Level2, lz4.Level3,
+	lz4.Level4, lz4.Level5, lz4.Level6,
+	lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
+func newLZ4Writer(w io.Writer, level int) (io.WriteCloser, error) {
+	if level < 0 || level >= len(lz4Levels) {
+		return nil, errors.Reason("lz4 level %(level)d is out of range [0, %(max)d]").
+			D("level", level).D("max", len(lz4Levels)-1).Err()
+	}
+	lw := lz4.NewWriter(w)
+	if err := lw.Apply(lz4.CompressionLevelOption(lz4Levels[level])); err != nil {
+		return nil, err
+	}
+	return lw, nil
+}
+
+// Compressor returns a writer which compresses the data written to it into w,
+// at the given level. What level means is up to the scheme.
+//
+// dict is always nil, except for CompressionZstd (see WriterDict).
+type Compressor func(w io.Writer, level int, dict []byte) (io.WriteCloser, error)
+
+// Decompressor returns a reader which decompresses the data read from r.
+// Schemes which may need a lot of memory to decompress should respect
+// cfg.MaxMemory, and return an *ErrDecoderMemory if the data needs more.
+type Decompressor func(r io.Reader, cfg DecoderConfig) (io.ReadCloser, error)
+
+type compression struct {
+	name      string
+	newWriter Compressor
+	newReader Decompressor
+}
+
+// compressions are the registered compression schemes.
+var compressions = struct {
+	sync.RWMutex
+	byID   map[CompressionScheme]compression
+	byName map[string]CompressionScheme
+}{
+	byID:   map[CompressionScheme]compression{},
+	byName: map[string]CompressionScheme{},
+}
+
+// RegisterCompression registers a compression scheme, so that blocks may be
+// written and read with it. This is how the built in schemes are registered,
+// too; their IDs are reserved, along with the rest of 1-127. Other schemes
+// should pick an ID from 128-255 which is unlikely to clash with anyone
+// else's, since it's stored in the archive.
+//
+// name identifies the scheme to humans, e.g. in error messages and in the
+// sar tool's flags.
+//
+// RegisterCompression is safe to call concurrently, but is usually called from
+// an init function. It panics if the ID or the name is already registered.
+func RegisterCompression(id CompressionScheme, name string, newWriter Compressor, newReader Decompressor) {
+	if id == 0 || id == CompressionAuto || name == "" || newWriter == nil || newReader == nil {
+		panic(fmt.Sprintf("sardata: bad registration of compression scheme %d (%q)", byte(id), name))
+	}
+
+	compressions.Lock()
+	defer compressions.Unlock()
+	if _, ok := compressions.byID[id]; ok {
+		panic(fmt.Sprintf("sardata: compression scheme %d is already registered", byte(id)))
+	}
+	if _, ok := compressions.byName[name]; ok {
+		panic(fmt.Sprintf("sardata: compression scheme %q is already registered", name))
+	}
+	compressions.byID[id] = compression{name, newWriter, newReader}
+	compressions.byName[name] = id
+}
+
+func init() {
+	RegisterCompression(CompressionNone, "none",
+		func(w io.Writer, _ int, _ []byte) (io.WriteCloser, error) {
+			return writeCloseHook{w, nil}, nil
+		},
+		func(r io.Reader, _ DecoderConfig) (io.ReadCloser, error) {
+			return readCloseHook{r, nil}, nil
+		})
+	RegisterCompression(CompressionFlate, "flate",
+		func(w io.Writer, level int, _ []byte) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		func(r io.Reader, _ DecoderConfig) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		})
+	RegisterCompression(CompressionZstd, "zstd", newZstdWriter, newZstdReader)
+	RegisterCompression(CompressionXZ, "xz",
+		func(w io.Writer, level int, _ []byte) (io.WriteCloser, error) {
+			return newXZWriter(w, level)
+		},
+		func(r io.Reader, cfg DecoderConfig) (io.ReadCloser, error) {
+			return newXZReader(r, cfg.maxMemory())
+		})
+	RegisterCompression(CompressionBrotli, "brotli",
+		func(w io.Writer, level int, _ []byte) (io.WriteCloser, error) {
+			return newBrotliWriter(w, level)
+		},
+		func(r io.Reader, _ DecoderConfig) (io.ReadCloser, error) {
+			return readCloseHook{brotli.NewReader(r), nil}, nil
+		})
+	RegisterCompression(CompressionLZ4, "lz4",
+		func(w io.Writer, level int, _ []byte) (io.WriteCloser, error) {
+			return newLZ4Writer(w, level)
+		},
+		func(r io.Reader, _ DecoderConfig) (io.ReadCloser, error) {
+			return readCloseHook{lz4.NewReader(r), nil}, nil
+		})
+}
+
+// lookup returns the registration of c, or an error naming the registered
+// schemes if there isn't one.
+func (c CompressionScheme) lookup() (compression, error) {
+	compressions.RLock()
+	defer compressions.RUnlock()
+	if reg, ok := compressions.byID[c]; ok {
+		return reg, nil
+	}
+	registered := make([]string, 0, len(compressions.byID))
+	for _, id := range sortedCompressions() {
+		registered = append(registered, fmt.Sprintf("%s (%d)", compressions.byID[id].name, byte(id)))
+	}
+	return compression{}, errors.Reason("Unknown compression scheme %(c)d; the registered schemes are %(registered)s").
+		D("c", byte(c)).D("registered", strings.Join(registered, ", ")).Err()
+}
+
+// sortedCompressions returns the registered schemes in order. compressions
+// must be locked.
+func sortedCompressions() []CompressionScheme {
+	ret := make([]CompressionScheme, 0, len(compressions.byID))
+	for id := range compressions.byID {
+		ret = append(ret, id)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// CompressionSchemes returns every registered compression scheme, in order.
+func CompressionSchemes() []CompressionScheme {
+	compressions.RLock()
+	defer compressions.RUnlock()
+	return sortedCompressions()
+}
+
+// CompressionByName returns the registered compression scheme called name.
+func CompressionByName(name string) (CompressionScheme, bool) {
+	compressions.RLock()
+	defer compressions.RUnlock()
+	c, ok := compressions.byName[name]
+	return c, ok
+}
+
+func (c CompressionScheme) String() string {
+	if c == CompressionAuto {
+		return "auto"
+	}
+	if reg, err := c.lookup(); err == nil {
+		return reg.name
+	}
+	return fmt.Sprintf("CompressionScheme(%d)", byte(c))
+}
+
 // Writer returns a new compressing writer for the given scheme.
 func (c CompressionScheme) Writer(w io.Writer, level int) (io.WriteCloser, error) {
-	switch c {
-	case CompressionNone:
-		return writeCloseHook{w, nil}, nil
-	case CompressionFlate:
-		return flate.NewWriter(w, level)
+	return c.WriterDict(w, level, nil)
+}
+
+// WriterDict is like Writer, but compresses with the zstd dictionary dict (see
+// TrainZstdDict). dict must be nil unless the scheme is CompressionZstd.
+func (c CompressionScheme) WriterDict(w io.Writer, level int, dict []byte) (io.WriteCloser, error) {
+	if dict != nil && c != CompressionZstd {
+		return nil, errors.New("dictionaries are only supported by CompressionZstd")
+	}
+	reg, err := c.lookup()
+	if err != nil {
+		return nil, err
 	}
-	return nil, c.Valid()
+	return reg.newWriter(w, level, dict)
 }
 
-// Reader returns a new decompressing reader for the given scheme.
+// Reader returns a new decompressing reader for the given scheme, with the
+// default DecoderConfig.
 func (c CompressionScheme) Reader(r io.Reader) (io.ReadCloser, error) {
-	switch c {
-	case CompressionNone:
-		return readCloseHook{r, nil}, nil
-	case CompressionFlate:
-		return flate.NewReader(r), nil
+	return c.ReaderConfig(r, DecoderConfig{})
+}
+
+// ReaderConfig is like Reader, but configured by cfg. cfg.Dict is ignored
+// unless the scheme is CompressionZstd.
+func (c CompressionScheme) ReaderConfig(r io.Reader, cfg DecoderConfig) (io.ReadCloser, error) {
+	reg, err := c.lookup()
+	if err != nil {
+		return nil, err
 	}
-	return nil, c.Valid()
+	return reg.newReader(r, cfg)
 }
 
-// Valid returns a nil err iff this CompressionScheme is valid.
+// Valid returns a nil err iff this CompressionScheme is registered.
 func (c CompressionScheme) Valid() error {
-	switch c {
-	case CompressionNone, CompressionFlate:
-		return nil
-	}
-	return errors.Reason("Unknown compression scheme %(c)x").D("c", c).Err()
+	_, err := c.lookup()
+	return err
 }
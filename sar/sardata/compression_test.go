@@ -0,0 +1,256 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// xorWriter and xorReader implement a toy compression scheme for
+// TestRegisterCompression, which xors every byte with a key.
+type xorWriter struct {
+	w   io.Writer
+	key byte
+}
+
+func (x xorWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for i, b := range p {
+		buf[i] = b ^ x.key
+	}
+	return x.w.Write(buf)
+}
+
+func (x xorWriter) Close() error { return nil }
+
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= x.key
+	}
+	return n, err
+}
+
+func (x xorReader) Close() error { return nil }
+
+func TestRegisterCompression(t *testing.T) {
+	t.Parallel()
+
+	// Convey runs this function once per leaf, so register outside of it.
+	const xor = CompressionScheme(200)
+	RegisterCompression(xor, "xor",
+		func(w io.Writer, level int, _ []byte) (io.WriteCloser, error) {
+			return xorWriter{w, byte(level)}, nil
+		},
+		func(r io.Reader, _ DecoderConfig) (io.ReadCloser, error) {
+			return xorReader{r, 42}, nil
+		})
+
+	Convey("RegisterCompression", t, func() {
+		Convey("registers a scheme", func() {
+			So(xor.Valid(), ShouldBeNil)
+			So(xor.String(), ShouldEqual, "xor")
+			c, ok := CompressionByName("xor")
+			So(ok, ShouldBeTrue)
+			So(c, ShouldEqual, xor)
+			So(CompressionSchemes(), ShouldContain, xor)
+
+			buf := &bytes.Buffer{}
+			w, err := BlockWriter(buf, xor, 42)
+			So(err, ShouldBeNil)
+			_, err = w.Write([]byte("some data"))
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(bytes.Contains(buf.Bytes(), []byte("some data")), ShouldBeFalse)
+
+			rc, err := BlockReader(bytes.NewReader(buf.Bytes()))
+			So(err, ShouldBeNil)
+			got, err := ioutil.ReadAll(rc)
+			So(err, ShouldBeNil)
+			So(string(got), ShouldEqual, "some data")
+
+			Convey("only once", func() {
+				So(func() {
+					RegisterCompression(xor, "xor2", nil, nil)
+				}, ShouldPanic)
+				So(func() {
+					RegisterCompression(201, "xor",
+						func(w io.Writer, level int, _ []byte) (io.WriteCloser, error) { return nil, nil },
+						func(r io.Reader, _ DecoderConfig) (io.ReadCloser, error) { return nil, nil })
+				}, ShouldPanicWith, `sardata: compression scheme "xor" is already registered`)
+				So(func() {
+					RegisterCompression(CompressionFlate, "flate2",
+						func(w io.Writer, level int, _ []byte) (io.WriteCloser, error) { return nil, nil },
+						func(r io.Reader, _ DecoderConfig) (io.ReadCloser, error) { return nil, nil })
+				}, ShouldPanicWith, "sardata: compression scheme 2 is already registered")
+			})
+
+			Convey("named in errors", func() {
+				So(CompressionScheme(99).Valid(), ShouldErrLike, "xor (200)")
+			})
+		})
+
+		Convey("concurrently", func() {
+			wg := sync.WaitGroup{}
+			for i := 0; i < 10; i++ {
+				id := CompressionScheme(210 + i)
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					RegisterCompression(id, fmt.Sprintf("concurrent-%d", id),
+						func(w io.Writer, level int, _ []byte) (io.WriteCloser, error) { return nil, nil },
+						func(r io.Reader, _ DecoderConfig) (io.ReadCloser, error) { return nil, nil })
+				}()
+				go func() {
+					defer wg.Done()
+					_ = CompressionFlate.Valid()
+					_ = id.String()
+				}()
+			}
+			wg.Wait()
+			for i := 0; i < 10; i++ {
+				So(CompressionScheme(210+i).Valid(), ShouldBeNil)
+			}
+		})
+	})
+}
+
+// benchCorpus returns the data which BenchmarkSchemes compresses: text, the Go
+// source of this repo, fixed-size binary records, and incompressible random
+// bytes, as a stand-in for the kinds of files that end up in archives.
+func benchCorpus(b *testing.B) map[string][]byte {
+	src := &bytes.Buffer{}
+	err := filepath.Walk(filepath.Join("..", ".."), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || !strings.HasSuffix(path, ".go") {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		src.Write(data)
+		return err
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(0))
+	records := &bytes.Buffer{}
+	for i := 0; records.Len() < 4*1024*1024; i++ {
+		var rec struct {
+			ID, Time  uint64
+			Kind, Len uint32
+		}
+		rec.ID = uint64(i)
+		rec.Time = 1500000000 + uint64(i)*10 + uint64(rnd.Intn(10))
+		rec.Kind = uint32(rnd.Intn(4))
+		rec.Len = uint32(rnd.ExpFloat64() * 1000)
+		binary.Write(records, binary.LittleEndian, &rec)
+	}
+
+	random := make([]byte, 1024*1024)
+	rnd.Read(random)
+
+	return map[string][]byte{
+		"text":    testData(4 * 1024 * 1024),
+		"source":  src.Bytes(),
+		"records": records.Bytes(),
+		"random":  random,
+	}
+}
+
+// BenchmarkSchemes compresses and decompresses each part of benchCorpus with
+// every scheme at a few levels. Besides the throughput (of uncompressed data),
+// it reports the compressed size as a fraction of the original size, e.g.:
+//
+//	go test -run NONE -bench Schemes/corpus=text
+func BenchmarkSchemes(b *testing.B) {
+	schemes := []struct {
+		name   string
+		scheme CompressionScheme
+		levels []int
+	}{
+		{"none", CompressionNone, []int{0}},
+		{"flate", CompressionFlate, []int{1, 6, 9}},
+		{"zstd", CompressionZstd, []int{1, 3, 19}},
+		{"xz", CompressionXZ, []int{0, 6}},
+		{"brotli", CompressionBrotli, []int{1, 6, 11}},
+		{"lz4", CompressionLZ4, []int{0, 9}},
+	}
+
+	corpora := benchCorpus(b)
+	for _, corpus := range []string{"text", "source", "records", "random"} {
+		data := corpora[corpus]
+		for _, s := range schemes {
+			for _, level := range s.levels {
+				s, level := s, level
+				name := fmt.Sprintf("corpus=%s/%s-%d", corpus, s.name, level)
+
+				compressed := &bytes.Buffer{}
+				compress := func() {
+					compressed.Reset()
+					w, err := BlockWriter(compressed, s.scheme, level)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := w.Write(data); err != nil {
+						b.Fatal(err)
+					}
+					if err := w.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				ratio := func(b *testing.B) {
+					b.ReportMetric(float64(compressed.Len())/float64(len(data)), "ratio")
+				}
+
+				b.Run(name+"/compress", func(b *testing.B) {
+					b.SetBytes(int64(len(data)))
+					for i := 0; i < b.N; i++ {
+						compress()
+					}
+					ratio(b)
+				})
+
+				b.Run(name+"/decompress", func(b *testing.B) {
+					if compressed.Len() == 0 {
+						compress()
+					}
+					b.SetBytes(int64(len(data)))
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						rc, err := BlockReader(bytes.NewReader(compressed.Bytes()))
+						if err != nil {
+							b.Fatal(err)
+						}
+						if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+							b.Fatal(err)
+						}
+						if err := rc.Close(); err != nil {
+							b.Fatal(err)
+						}
+					}
+					ratio(b)
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	"github.com/luci/luci-go/common/errors"
+)
+
+// MaxDictSize is the largest zstd dictionary which may be embedded in an
+// archive.
+const MaxDictSize = 8 * 1024 * 1024
+
+// DictSection is the dictionary section of an archive whose version includes
+// VersionDictFlag. It's encoded as:
+//
+//	uvarint dictionary ID
+//	uvarint size of the embedded dictionary (0 if it isn't embedded)
+//	the embedded dictionary
+type DictSection struct {
+	// ID is the ID of the zstd dictionary which the archive's blocks were
+	// compressed with.
+	ID uint32
+
+	// Embedded is the dictionary itself, or nil if the reader must supply it.
+	Embedded []byte
+}
+
+func (d DictSection) Write(w io.Writer) error {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(d.Embedded))
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(d.ID))]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(d.Embedded)))]...)
+	buf = append(buf, d.Embedded...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func (d *DictSection) Read(r io.Reader) error {
+	br := byteReader{Reader: r}
+
+	id, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	if id > math.MaxUint32 {
+		return errors.Reason("dictionary ID %(id)d is out of range").D("id", id).Err()
+	}
+	d.ID = uint32(id)
+
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	if size > MaxDictSize {
+		return errors.Reason("embedded dictionary is too large (%(size)d bytes)").
+			D("size", size).Err()
+	}
+	d.Embedded = nil
+	if size == 0 {
+		return nil
+	}
+	d.Embedded = make([]byte, size)
+	if _, err := io.ReadFull(r, d.Embedded); err != nil {
+		return err
+	}
+	embeddedID, err := ZstdDictID(d.Embedded)
+	if err != nil {
+		return errors.Annotate(err).Reason("parsing embedded dictionary").Err()
+	}
+	if embeddedID != d.ID {
+		return errors.Reason("embedded dictionary has ID %(actual)d, not %(nominal)d").
+			D("actual", embeddedID).D("nominal", d.ID).Err()
+	}
+	return nil
+}
+
+// ZstdDictID returns the ID of the zstd dictionary dict.
+func ZstdDictID(dict []byte) (uint32, error) {
+	d, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		return 0, err
+	}
+	return d.ID(), nil
+}
+
+// TrainZstdDict builds a zstd dictionary of at most maxSize bytes from samples,
+// which should look like the data that will be compressed with it. The
+// dictionary is given a random ID.
+func TrainZstdDict(samples [][]byte, maxSize int) ([]byte, error) {
+	if maxSize <= 0 || maxSize > MaxDictSize {
+		return nil, errors.Reason("dictionary size %(size)d is out of range (0, %(max)d]").
+			D("size", maxSize).D("max", MaxDictSize).Err()
+	}
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: maxSize,
+		HashBytes:   6,
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// configSample returns a small file which is very similar to the other samples.
+func configSample(i int) []byte {
+	return []byte(fmt.Sprintf(`{
+  "target": "//src/component_%d:all",
+  "toolchain": "clang-x86_64-linux-gnu",
+  "flags": ["-O2", "-fno-exceptions", "-Wall", "-Werror", "-DCOMPONENT=%d"],
+  "outputs": ["out/component_%d/lib.a", "out/component_%d/lib.so"],
+  "deps": ["//base:base", "//third_party/zlib:zlib", "//src/component_%d:headers"]
+}
+`, i, i, i, i, i+1))
+}
+
+func TestDict(t *testing.T) {
+	t.Parallel()
+
+	Convey("Dictionaries", t, func() {
+		samples := make([][]byte, 100)
+		for i := range samples {
+			samples[i] = configSample(i)
+		}
+		dict, err := TrainZstdDict(samples, 4096)
+		So(err, ShouldBeNil)
+		So(len(dict), ShouldBeLessThanOrEqualTo, 4096)
+		id, err := ZstdDictID(dict)
+		So(err, ShouldBeNil)
+
+		data := configSample(1000)
+		compress := func(dict []byte) []byte {
+			buf := &bytes.Buffer{}
+			wc, err := BlockWriterDict(buf, CompressionZstd, 19, dict)
+			So(err, ShouldBeNil)
+			_, err = wc.Write(data)
+			So(err, ShouldBeNil)
+			So(wc.Close(), ShouldBeNil)
+			return buf.Bytes()
+		}
+
+		Convey("block", func() {
+			block := compress(dict)
+			So(len(block), ShouldBeLessThan, len(compress(nil))/2)
+
+			_, rc, err := BlockReaderConfig(bytes.NewReader(block), DecoderConfig{Dict: dict})
+			So(err, ShouldBeNil)
+			got, err := ioutil.ReadAll(rc)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, data)
+
+			_, rc, err = BlockReaderConfig(bytes.NewReader(block), DecoderConfig{})
+			if err == nil {
+				_, err = ioutil.ReadAll(rc)
+			}
+			So(err, ShouldErrLike, "unknown dictionary")
+		})
+
+		Convey("chunked block", func() {
+			buf := &bytes.Buffer{}
+			cw, err := ChunkedBlockWriter(buf, CompressionZstd, 3, dict, 100, false, 2)
+			So(err, ShouldBeNil)
+			_, err = cw.Write(data)
+			So(err, ShouldBeNil)
+			So(cw.Close(), ShouldBeNil)
+
+			for _, workers := range []int{1, 3} {
+				idx, rc, err := ParallelChunkedBlockReader(bytes.NewReader(buf.Bytes()), workers, DecoderConfig{Dict: dict})
+				So(err, ShouldBeNil)
+				got, err := ioutil.ReadAll(rc)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, data)
+
+				r, err := idx.DataAt(bytes.NewReader(buf.Bytes()), 150)
+				So(err, ShouldBeNil)
+				got, err = ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, data[150:])
+			}
+		})
+
+		Convey("section", func() {
+			for _, sec := range []DictSection{{ID: id}, {ID: id, Embedded: dict}} {
+				buf := &bytes.Buffer{}
+				So(sec.Write(buf), ShouldBeNil)
+				got := DictSection{}
+				So(got.Read(buf), ShouldBeNil)
+				So(got, ShouldResemble, sec)
+				So(buf.Len(), ShouldEqual, 0)
+			}
+
+			Convey("bad", func() {
+				buf := &bytes.Buffer{}
+				So(DictSection{ID: id + 1, Embedded: dict}.Write(buf), ShouldBeNil)
+				So((&DictSection{}).Read(buf), ShouldErrLike, "embedded dictionary has ID")
+
+				buf.Reset()
+				So(DictSection{ID: 1, Embedded: []byte("not a dict")}.Write(buf), ShouldBeNil)
+				So((&DictSection{}).Read(buf), ShouldErrLike, "parsing embedded dictionary")
+
+				So((&DictSection{}).Read(bytes.NewReader([]byte{1, 0xff, 0xff, 0xff, 0x7f})),
+					ShouldErrLike, "too large")
+			})
+		})
+
+		Convey("only zstd", func() {
+			_, err := BlockWriterDict(&bytes.Buffer{}, CompressionFlate, 9, dict)
+			So(err, ShouldErrLike, "only supported by CompressionZstd")
+			_, err = ChunkedBlockWriter(&bytes.Buffer{}, CompressionFlate, 9, dict, 10, false, 1)
+			So(err, ShouldErrLike, "only supported by CompressionZstd")
+		})
+
+		Convey("bad training", func() {
+			_, err := TrainZstdDict(samples, 0)
+			So(err, ShouldErrLike, "out of range")
+			_, err = TrainZstdDict(nil, 4096)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
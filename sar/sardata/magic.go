@@ -13,23 +13,49 @@ import (
 // Magic is the magic bytes which appear at the beginning of a sarchive.
 const Magic = "SAR"
 
-// Version is the version of the sarchive format.
-const Version byte = 1
+// These are the versions of the sarchive format.
+const (
+	// VersionSolid archives have a single compressed data block (see
+	// BlockWriter).
+	VersionSolid byte = 1
 
-var magicVer []byte
+	// VersionChunked archives have a chunked data block (see
+	// ChunkedBlockWriter), which allows random access to the data.
+	VersionChunked byte = 2
 
-func init() {
-	magicVer = []byte(Magic + string(Version))
-}
+	// VersionDictFlag may be combined with any version. It indicates that the
+	// blocks of the archive are compressed with a zstd dictionary, and that
+	// the archive has a dictionary section (see DictSection) between the magic
+	// and the TOC.
+	VersionDictFlag byte = 0x80
+
+	// VersionDataOrderFlag may be combined with any version. It indicates that
+	// the data of the archive's files isn't in the order that the TOC lists
+	// them in, but in the order given by the TOC's DataOrder. Older readers,
+	// which would unpack the wrong data into each file, refuse such archives.
+	VersionDataOrderFlag byte = 0x40
+
+	// VersionFlags are all of the flags which may be combined with a version.
+	VersionFlags = VersionDictFlag | VersionDataOrderFlag
+)
 
-// WriteMagic writes SAR+VERSION to the writer.
+// Version is the newest version of the sarchive format.
+const Version = VersionChunked
+
+// WriteMagic writes SAR+VersionSolid to the writer.
 func WriteMagic(w io.Writer) error {
-	_, err := w.Write(magicVer)
+	return WriteMagicVersion(w, VersionSolid)
+}
+
+// WriteMagicVersion writes SAR+version to the writer.
+func WriteMagicVersion(w io.Writer, version byte) error {
+	_, err := w.Write(append([]byte(Magic), version))
 	return err
 }
 
 // ReadMagic reads magic from the reader and checks that it's equal to
-// SAR, and ensures that the file version is <= Version.
+// SAR, and ensures that the file version is <= Version. The returned version
+// may include any of VersionFlags.
 func ReadMagic(r io.Reader) (version byte, err error) {
 	buf := make([]byte, 4)
 	if _, err = io.ReadFull(r, buf); err != nil {
@@ -43,7 +69,7 @@ func ReadMagic(r io.Reader) (version byte, err error) {
 	}
 
 	version = buf[3]
-	if version > Version {
+	if version&^VersionFlags > Version {
 		err = errors.Reason("bad version: %(ver)d > %(ours)d").
 			D("ver", version).D("ours", Version).Err()
 		return
@@ -32,6 +32,13 @@ func TestMagic(t *testing.T) {
 					So(v, ShouldEqual, 1)
 				})
 
+				Convey("with flags", func() {
+					buf := bytes.NewReader([]byte{'S', 'A', 'R', 2 | VersionFlags})
+					v, err := ReadMagic(buf)
+					So(err, ShouldBeNil)
+					So(v, ShouldEqual, 2|VersionDictFlag|VersionDataOrderFlag)
+				})
+
 				Convey("older version", func() {
 					buf := bytes.NewReader([]byte{'S', 'A', 'R', 0})
 					v, err := ReadMagic(buf)
@@ -50,7 +57,7 @@ func TestMagic(t *testing.T) {
 				Convey("newer version", func() {
 					buf := bytes.NewReader([]byte{'S', 'A', 'R', 4})
 					_, err := ReadMagic(buf)
-					So(err, ShouldErrLike, `bad version: 4 > 1`)
+					So(err, ShouldErrLike, `bad version: 4 > 2`)
 				})
 
 				Convey("short read", func() {
@@ -0,0 +1,348 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+
+	"github.com/luci/luci-go/common/errors"
+)
+
+// compressJob is a single segment of data which is being compressed by a
+// compressPool.
+type compressJob struct {
+	done    chan struct{}
+	out     bytes.Buffer
+	err     error
+	collect func([]byte) error
+}
+
+// compressPool compresses segments of data on up to a fixed number of
+// goroutines at once, and collects their output in the order that they were
+// submitted.
+type compressPool struct {
+	sem     chan struct{}
+	pending []*compressJob
+}
+
+func newCompressPool(workers int) *compressPool {
+	return &compressPool{sem: make(chan struct{}, workers)}
+}
+
+// submit runs compress on a worker goroutine, and calls collect with its
+// output (on the caller's goroutine) once every previously submitted job has
+// been collected.
+//
+// To bound memory use, submit collects the oldest jobs first if there are
+// already twice as many outstanding jobs as workers.
+func (p *compressPool) submit(compress func(io.Writer) error, collect func([]byte) error) error {
+	for len(p.pending) >= 2*cap(p.sem) {
+		if err := p.collectOldest(); err != nil {
+			return err
+		}
+	}
+	j := &compressJob{done: make(chan struct{}), collect: collect}
+	p.pending = append(p.pending, j)
+	p.sem <- struct{}{}
+	go func() {
+		defer close(j.done)
+		defer func() { <-p.sem }()
+		j.err = compress(&j.out)
+	}()
+	return nil
+}
+
+func (p *compressPool) collectOldest() error {
+	j := p.pending[0]
+	p.pending = p.pending[1:]
+	<-j.done
+	if j.err != nil {
+		return j.err
+	}
+	return j.collect(j.out.Bytes())
+}
+
+// wait collects all of the outstanding jobs.
+func (p *compressPool) wait() error {
+	for len(p.pending) > 0 {
+		if err := p.collectOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	// parallelSegmentSize is the amount of uncompressed data which
+	// ParallelBlockWriter gives to each worker.
+	parallelSegmentSize = 1024 * 1024
+
+	// flateWindowSize is the size of the flate sliding window. Each segment is
+	// compressed with the end of the previous segment as its dictionary, so
+	// that splitting the data costs very little compression.
+	flateWindowSize = 32 * 1024
+
+	// maxBufferedChunkSize is the largest chunk (compressed or uncompressed)
+	// which ParallelChunkedBlockReader reads into memory. Larger chunks (whose
+	// sizes come from the untrusted chunk index) are streamed on the reading
+	// goroutine instead.
+	maxBufferedChunkSize = 4 * 1024 * 1024
+)
+
+// parallelBlockWriter implements ParallelBlockWriter.
+type parallelBlockWriter struct {
+	w       io.Writer
+	level   int
+	segSize int
+	pool    *compressPool
+
+	// sampleRatio is recorded in the BlockHeader; see SampledBlockWriter.
+	sampleRatio float64
+
+	// buf is the compressed data of every segment collected so far.
+	buf bytes.Buffer
+
+	// seg is the uncompressed data of the current segment, and dict is the end
+	// of the previous segment.
+	seg  []byte
+	dict []byte
+}
+
+// ParallelBlockWriter is like BlockWriter, but compresses the data on up to
+// workers goroutines at once.
+//
+// The data is split into segments which are compressed independently, using
+// the end of the previous segment as a preset dictionary. Every segment but
+// the last ends with a flate sync flush, so that the concatenation of the
+// segments is a single valid flate stream (like pigz does), which any block
+// reader can decompress.
+//
+// This only applies to CompressionFlate. For other schemes, or if workers is
+// less than 2, this is the same as BlockWriter.
+func ParallelBlockWriter(w io.Writer, scheme CompressionScheme, level, workers int) (io.WriteCloser, error) {
+	return newParallelBlockWriter(w, scheme, level, workers, parallelSegmentSize, 0)
+}
+
+func newParallelBlockWriter(w io.Writer, scheme CompressionScheme, level, workers, segSize int, sampleRatio float64) (io.WriteCloser, error) {
+	if scheme != CompressionFlate || workers < 2 {
+		return blockWriter(w, scheme, level, nil, sampleRatio)
+	}
+	// Check the level up front, instead of in the first worker.
+	if _, err := flate.NewWriter(nil, level); err != nil {
+		return nil, err
+	}
+	return &parallelBlockWriter{
+		w: w, level: level, segSize: segSize, sampleRatio: sampleRatio,
+		pool: newCompressPool(workers),
+		seg:  make([]byte, 0, segSize),
+	}, nil
+}
+
+func (p *parallelBlockWriter) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		toCopy := data
+		if room := p.segSize - len(p.seg); len(toCopy) > room {
+			toCopy = toCopy[:room]
+		}
+		p.seg = append(p.seg, toCopy...)
+		n += len(toCopy)
+		data = data[len(toCopy):]
+		if len(p.seg) == p.segSize {
+			if err = p.submit(false); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// submit hands the current segment to the pool.
+func (p *parallelBlockWriter) submit(final bool) error {
+	seg, dict, level := p.seg, p.dict, p.level
+	compress := func(w io.Writer) error {
+		fw, err := flate.NewWriterDict(w, level, dict)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(seg); err != nil {
+			return err
+		}
+		if final {
+			return fw.Close()
+		}
+		return fw.Flush()
+	}
+	collect := func(out []byte) error {
+		_, err := p.buf.Write(out)
+		return err
+	}
+	if err := p.pool.submit(compress, collect); err != nil {
+		return err
+	}
+
+	// seg now belongs to the worker, so it must not be modified.
+	if len(seg) > flateWindowSize {
+		p.dict = seg[len(seg)-flateWindowSize:]
+	} else {
+		p.dict = seg
+	}
+	p.seg = make([]byte, 0, p.segSize)
+	return nil
+}
+
+func (p *parallelBlockWriter) Close() error {
+	if err := p.submit(true); err != nil {
+		return err
+	}
+	if err := p.pool.wait(); err != nil {
+		return err
+	}
+	h := BlockHeader{uint64(p.buf.Len()), CompressionFlate, p.sampleRatio}
+	if err := h.Write(p.w); err != nil {
+		return err
+	}
+	_, err := p.w.Write(p.buf.Bytes())
+	return err
+}
+
+// parallelChunkReader implements ParallelChunkedBlockReader. It reads the
+// compressed chunks from r in order, and decompresses them on a compressPool.
+type parallelChunkReader struct {
+	r      io.Reader
+	scheme CompressionScheme
+	cfg    DecoderConfig
+	chunks []Chunk
+	pool   *compressPool
+
+	// cur is the rest of the uncompressed data of the current chunk, unless
+	// the current chunk is too big to buffer, in which case stream reads it.
+	cur    []byte
+	stream *chunkReader
+	err    error
+}
+
+func (p *parallelChunkReader) Read(buf []byte) (int, error) {
+	for {
+		if p.stream != nil {
+			n, err := p.stream.Read(buf)
+			if err == io.EOF {
+				p.stream, err = nil, nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		if len(p.cur) > 0 {
+			n := copy(buf, p.cur)
+			p.cur = p.cur[n:]
+			return n, nil
+		}
+		if p.err != nil {
+			return 0, p.err
+		}
+		p.err = p.next()
+	}
+}
+
+// next submits the next chunk to the pool (which collects the oldest chunk into
+// cur if the pool is full), or collects the oldest chunk if every chunk has
+// already been submitted. Returns io.EOF once every chunk has been collected.
+//
+// Chunks larger than maxBufferedChunkSize are streamed instead, once every
+// earlier chunk has been collected.
+func (p *parallelChunkReader) next() error {
+	if len(p.chunks) == 0 || p.chunks[0].UncompressedSize > maxBufferedChunkSize ||
+		p.chunks[0].CompressedSize > maxBufferedChunkSize {
+		if len(p.pool.pending) > 0 {
+			return p.pool.collectOldest()
+		}
+		if len(p.chunks) == 0 {
+			return io.EOF
+		}
+		p.stream = &chunkReader{r: p.r, scheme: p.scheme, cfg: p.cfg, chunks: p.chunks[:1]}
+		p.chunks = p.chunks[1:]
+		return nil
+	}
+	ch := p.chunks[0]
+	p.chunks = p.chunks[1:]
+
+	// Don't trust the index with a preallocated buffer; a bogus size will just
+	// run out of data.
+	raw := &bytes.Buffer{}
+	if _, err := raw.ReadFrom(io.LimitReader(p.r, int64(ch.CompressedSize))); err != nil {
+		return err
+	}
+	if uint64(raw.Len()) != ch.CompressedSize {
+		return io.ErrUnexpectedEOF
+	}
+
+	scheme, cfg := p.scheme, p.cfg
+	return p.pool.submit(func(w io.Writer) error {
+		rc, err := scheme.ReaderConfig(bytes.NewReader(raw.Bytes()), cfg)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(w, io.LimitReader(rc, int64(ch.UncompressedSize)))
+		if err == nil && uint64(n) < ch.UncompressedSize {
+			err = io.ErrUnexpectedEOF
+		}
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}, func(out []byte) error {
+		p.cur = out
+		return nil
+	})
+}
+
+// ParallelChunkedBlockReader is like ChunkedBlockReader, but decompresses up to
+// workers chunks concurrently.
+//
+// The compressed data is still read from r sequentially, by the goroutine
+// calling Read, so a checksum computed over r (see ChecksumReader) is
+// unaffected. Up to twice as many chunks as workers are held in memory at
+// once; chunks of more than 4MiB (compressed or uncompressed) are decompressed
+// by the goroutine calling Read instead.
+//
+// The chunks are decompressed as configured by cfg, and the returned
+// ChunkIndex's Decoder is set to it.
+//
+// If workers is less than 2, the chunks are decompressed by the goroutine
+// calling Read, like ChunkedBlockReader.
+func ParallelChunkedBlockReader(r io.Reader, workers int, cfg DecoderConfig) (*ChunkIndex, io.ReadCloser, error) {
+	idx, err := ReadChunkIndex(r)
+	if err != nil {
+		return nil, nil, errors.Annotate(err).Reason("reading chunk index").Err()
+	}
+	idx.Decoder = cfg
+	if workers < 2 {
+		return idx, chunkedBlockReader(r, idx), nil
+	}
+	lr := io.LimitReader(r, int64(idx.CompressedSize()))
+	pr := &parallelChunkReader{
+		r: lr, scheme: idx.Compression, cfg: cfg, chunks: idx.Chunks,
+		pool: newCompressPool(workers),
+	}
+	return idx, readCloseHook{
+		pr,
+		func() error {
+			// The outstanding chunks only hold copies of their compressed data, so
+			// they can just be dropped.
+			pr.pool.pending = nil
+			if pr.stream != nil && pr.stream.cur != nil {
+				if err := pr.stream.cur.Close(); err != nil {
+					return err
+				}
+			}
+			_, err := io.Copy(ioutil.Discard, lr)
+			return err
+		},
+	}, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testData returns n bytes of somewhat compressible text.
+func testData(n int) []byte {
+	words := []string{"sarchive ", "solid ", "archive ", "flate ", "chunk ", "data ", "file ", "\n"}
+	rnd := rand.New(rand.NewSource(0))
+	buf := bytes.NewBuffer(make([]byte, 0, n))
+	for buf.Len() < n {
+		buf.WriteString(words[rnd.Intn(len(words))])
+		if rnd.Intn(10) == 0 {
+			fmt.Fprintf(buf, "%d ", rnd.Int63())
+		}
+	}
+	return buf.Bytes()[:n]
+}
+
+func TestParallelBlockWriter(t *testing.T) {
+	t.Parallel()
+
+	Convey("ParallelBlockWriter", t, func() {
+		for _, size := range []int{0, 1, 999, 1000, 1001, 5500} {
+			Convey(fmt.Sprintf("%d bytes", size), func() {
+				data := testData(size)
+				buf := &bytes.Buffer{}
+				w, err := newParallelBlockWriter(buf, CompressionFlate, 9, 3, 1000, 0)
+				So(err, ShouldBeNil)
+				// Write in odd pieces to make sure that segments are split correctly.
+				for p := data; len(p) > 0; {
+					n := 333
+					if n > len(p) {
+						n = len(p)
+					}
+					_, err := w.Write(p[:n])
+					So(err, ShouldBeNil)
+					p = p[n:]
+				}
+				So(w.Close(), ShouldBeNil)
+
+				rc, err := BlockReader(bytes.NewReader(buf.Bytes()))
+				So(err, ShouldBeNil)
+				got, err := ioutil.ReadAll(rc)
+				So(err, ShouldBeNil)
+				So(rc.Close(), ShouldBeNil)
+				So(got, ShouldResemble, data)
+			})
+		}
+
+		Convey("falls back to BlockWriter", func() {
+			data := testData(5000)
+			write := func(mk func(io.Writer) (io.WriteCloser, error)) []byte {
+				buf := &bytes.Buffer{}
+				w, err := mk(buf)
+				So(err, ShouldBeNil)
+				_, err = w.Write(data)
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+				return buf.Bytes()
+			}
+			So(write(func(w io.Writer) (io.WriteCloser, error) {
+				return newParallelBlockWriter(w, CompressionNone, 0, 4, 1000, 0)
+			}), ShouldResemble, write(func(w io.Writer) (io.WriteCloser, error) {
+				return BlockWriter(w, CompressionNone, 0)
+			}))
+			So(write(func(w io.Writer) (io.WriteCloser, error) {
+				return newParallelBlockWriter(w, CompressionFlate, 9, 1, 1000, 0)
+			}), ShouldResemble, write(func(w io.Writer) (io.WriteCloser, error) {
+				return BlockWriter(w, CompressionFlate, 9)
+			}))
+		})
+
+		Convey("bad level", func() {
+			_, err := ParallelBlockWriter(&bytes.Buffer{}, CompressionFlate, 42, 4)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// BenchmarkCompression compares the single-stream BlockWriter to the parallel
+// writers. Besides the throughput, it reports the compressed size as a
+// fraction of the original size.
+func BenchmarkCompression(b *testing.B) {
+	data := testData(32 * 1024 * 1024)
+
+	workerCounts := []int{2, 4}
+	if n := runtime.NumCPU(); n > 4 {
+		workerCounts = append(workerCounts, n)
+	}
+
+	bench := func(name string, mk func(io.Writer) (io.WriteCloser, error)) {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			buf := &bytes.Buffer{}
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				w, err := mk(buf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := w.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len())/float64(len(data)), "ratio")
+		})
+	}
+
+	for _, level := range []int{1, 6, 9} {
+		level := level
+		bench(fmt.Sprintf("level=%d/single", level), func(w io.Writer) (io.WriteCloser, error) {
+			return BlockWriter(w, CompressionFlate, level)
+		})
+		bench(fmt.Sprintf("level=%d/zstd", level), func(w io.Writer) (io.WriteCloser, error) {
+			return BlockWriter(w, CompressionZstd, level)
+		})
+		bench(fmt.Sprintf("level=%d/xz", level), func(w io.Writer) (io.WriteCloser, error) {
+			return BlockWriter(w, CompressionXZ, level)
+		})
+		for _, n := range workerCounts {
+			n := n
+			bench(fmt.Sprintf("level=%d/parallel=%d", level, n), func(w io.Writer) (io.WriteCloser, error) {
+				return ParallelBlockWriter(w, CompressionFlate, level, n)
+			})
+			bench(fmt.Sprintf("level=%d/chunked=%d", level, n), func(w io.Writer) (io.WriteCloser, error) {
+				return ChunkedBlockWriter(w, CompressionFlate, level, nil, 1024*1024, false, n)
+			})
+		}
+	}
+}
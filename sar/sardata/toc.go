@@ -5,6 +5,7 @@
 package sardata
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 
@@ -14,11 +15,16 @@ import (
 
 // WriteTOC writes a compressed table of contents to the given writer.
 func WriteTOC(w io.Writer, t *toc.TOC, scheme CompressionScheme, level int) (err error) {
+	return WriteTOCDict(w, t, scheme, level, nil)
+}
+
+// WriteTOCDict is like WriteTOC, but compresses with the zstd dictionary dict.
+func WriteTOCDict(w io.Writer, t *toc.TOC, scheme CompressionScheme, level int, dict []byte) (err error) {
 	var buf []byte
 	if buf, err = proto.Marshal(t); err != nil {
 		return
 	}
-	wc, err := BlockWriter(w, scheme, level)
+	wc, err := BlockWriterDict(w, scheme, level, dict)
 	if err != nil {
 		return
 	}
@@ -28,14 +34,60 @@ func WriteTOC(w io.Writer, t *toc.TOC, scheme CompressionScheme, level int) (err
 	return wc.Close()
 }
 
+// ErrTOCTooLarge is returned by ReadTOCLimit when the decompressed table of
+// contents is larger than the limit.
+type ErrTOCTooLarge struct {
+	// Size is the decompressed size of the table of contents, or 0 if it isn't
+	// known. Only uncompressed blocks give their size up front; compressed ones
+	// aren't decompressed past the limit.
+	Size uint64
+	Max  uint64
+}
+
+func (e *ErrTOCTooLarge) Error() string {
+	if e.Size == 0 {
+		return fmt.Sprintf("decompressed TOC is larger than %d bytes", e.Max)
+	}
+	return fmt.Sprintf("decompressed TOC is %d bytes, larger than %d", e.Size, e.Max)
+}
+
 // ReadTOC parsses a compressed table of contents from the given reader.
 func ReadTOC(r io.Reader) (ret *toc.TOC, err error) {
-	br, err := BlockReader(r)
+	return ReadTOCLimit(r, 0)
+}
+
+// ReadTOCLimit is like ReadTOC, but returns *ErrTOCTooLarge without
+// decompressing the rest of the block if the decompressed table of contents is
+// larger than maxSize bytes. A maxSize of 0 means no limit.
+func ReadTOCLimit(r io.Reader, maxSize int64) (ret *toc.TOC, err error) {
+	return ReadTOCConfig(r, maxSize, DecoderConfig{})
+}
+
+// ReadTOCConfig is like ReadTOCLimit, but decompresses the table of contents as
+// configured by cfg.
+func ReadTOCConfig(r io.Reader, maxSize int64, cfg DecoderConfig) (ret *toc.TOC, err error) {
+	h, br, err := BlockReaderConfig(r, cfg)
 	if err != nil {
 		return nil, err
 	}
-	buf, err := ioutil.ReadAll(br)
+	src := io.Reader(br)
+	if maxSize > 0 {
+		src = io.LimitReader(br, maxSize+1)
+	}
+	buf, err := ioutil.ReadAll(src)
 	if err != nil {
+		br.Close()
+		return
+	}
+	if maxSize > 0 && int64(len(buf)) > maxSize {
+		br.Close()
+		tooLarge := &ErrTOCTooLarge{Max: uint64(maxSize)}
+		if h.Compression == CompressionNone {
+			tooLarge.Size = h.Length
+		}
+		return nil, tooLarge
+	}
+	if err = br.Close(); err != nil {
 		return
 	}
 	ret = &toc.TOC{}
@@ -66,8 +66,147 @@ func (t *TOC) LoopItems(cb func(path []string, ent *Entry) error) error {
 	return nil
 }
 
+// LoopData is like LoopItems, but visits Files in the order of their data in
+// the archive_data stream, so that reading the stream sequentially yields the
+// data of each File as cb is called for it.
+//
+// If the TOC has no DataOrder, this is exactly LoopItems. Otherwise, every
+// Tree and SymLink is visited first (in LoopItems order), followed by every
+// File in DataOrder. The path slice passed to cb may be retained.
+func (t *TOC) LoopData(cb func(path []string, ent *Entry) error) error {
+	if len(t.DataOrder) == 0 {
+		return t.LoopItems(cb)
+	}
+
+	type file struct {
+		path []string
+		ent  *Entry
+	}
+	files := []file{}
+	err := t.LoopItems(func(path []string, ent *Entry) error {
+		if ent.GetFile() != nil {
+			files = append(files, file{append([]string(nil), path...), ent})
+			return nil
+		}
+		return cb(append([]string(nil), path...), ent)
+	})
+	if err != nil {
+		return err
+	}
+	for _, i := range t.DataOrder {
+		if err := cb(files[i].path, files[i].ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataOffsets returns the offset of each File's data in the uncompressed
+// archive_data stream, indexed by the File's position in LoopItems order.
+func (t *TOC) dataOffsets() []uint64 {
+	sizes := []uint64{}
+	t.LoopItems(func(path []string, ent *Entry) error {
+		if f := ent.GetFile(); f != nil {
+			sizes = append(sizes, f.Size)
+		}
+		return nil
+	})
+	ret := make([]uint64, len(sizes))
+	offset := uint64(0)
+	for _, i := range t.DataOrder {
+		ret[i] = offset
+		offset += sizes[i]
+	}
+	return ret
+}
+
+// ErrNotFound is returned from Locate if the requested path is not in the TOC.
+var ErrNotFound = errors.New("path not found in TOC")
+
+var errStopLoop = errors.New("stop loop")
+
+// Locate finds the Entry at path, as well as the offset of its data in the
+// uncompressed archive_data stream (i.e. the sum of the sizes of all Files which
+// precede it in LoopData order).
+//
+// Returns ErrNotFound if there's no such Entry.
+func (t *TOC) Locate(path []string) (ent *Entry, offset uint64, err error) {
+	// idx is the index of the Entry among the Files, in LoopItems order.
+	idx := 0
+	err = t.LoopItems(func(p []string, e *Entry) error {
+		if len(p) == len(path) {
+			match := true
+			for i := range p {
+				if p[i] != path[i] {
+					match = false
+					break
+				}
+			}
+			if match {
+				ent = e
+				return errStopLoop
+			}
+		}
+		if f := e.GetFile(); f != nil {
+			offset += f.Size
+			idx++
+		}
+		return nil
+	})
+	switch {
+	case err == errStopLoop:
+		err = nil
+		if len(t.DataOrder) > 0 && ent.GetFile() != nil {
+			offset = t.dataOffsets()[idx]
+		}
+	case err == nil:
+		err = ErrNotFound
+	}
+	return
+}
+
+// Validate returns an error if the TOC contains any invalid entries, or any
+// symlinks which point outside of the root.
 func (t *TOC) Validate() error {
-	return t.Root.Validate(t.CaseSafe, -1)
+	if err := t.Root.Validate(t.CaseSafe, -1); err != nil {
+		return err
+	}
+	if err := t.checkDataOrder(); err != nil {
+		return err
+	}
+	return t.checkSymlinks()
+}
+
+// checkDataOrder makes sure that DataOrder (if any) contains the index of every
+// File exactly once.
+func (t *TOC) checkDataOrder() error {
+	if len(t.DataOrder) == 0 {
+		return nil
+	}
+	files := uint64(0)
+	t.LoopItems(func(path []string, ent *Entry) error {
+		if ent.GetFile() != nil {
+			files++
+		}
+		return nil
+	})
+	if uint64(len(t.DataOrder)) != files {
+		return errors.Reason("data order has %(len)d entries, but there are %(files)d files").
+			D("len", len(t.DataOrder)).D("files", files).Err()
+	}
+	seen := make([]bool, files)
+	for _, i := range t.DataOrder {
+		if i >= files {
+			return errors.Reason("data order refers to file %(i)d, but there are %(files)d files").
+				D("i", i).D("files", files).Err()
+		}
+		if seen[i] {
+			return errors.Reason("data order refers to file %(i)d more than once").
+				D("i", i).Err()
+		}
+		seen[i] = true
+	}
+	return nil
 }
 
 func (t *Tree) Validate(caseSafe bool, depth int) error {
@@ -92,7 +231,10 @@ func (t *Tree) Validate(caseSafe bool, depth int) error {
 	return nil
 }
 
-var badChars = regexp.MustCompile("[<>:\"/\\|?*\x00-\x1f]")
+// badChars are the characters which aren't allowed in path components on
+// windows. Backslashes must be rejected everywhere, since a symlink target
+// containing them could escape the root on windows.
+var badChars = regexp.MustCompile("[<>:\"/\\\\|?*\x00-\x1f]")
 
 func checkPathPiece(piece string, allowRel bool) error {
 	if piece == "" {
@@ -114,8 +256,13 @@ func checkPathPiece(piece string, allowRel bool) error {
 	return nil
 }
 
+// ValidateName returns a non-nil error iff name is not a valid Entry name.
+func ValidateName(name string) error {
+	return checkPathPiece(name, false)
+}
+
 func (e *Entry) Validate(caseSafe bool, depth int) error {
-	if err := checkPathPiece(e.Name, false); err != nil {
+	if err := ValidateName(e.Name); err != nil {
 		return err
 	}
 
@@ -135,18 +282,102 @@ func (s *SymLink) Validate(depth int) error {
 		return errors.New("empty symlink target")
 	}
 
-	level := 0
+	// level is the depth of the directory that the target has reached so far.
+	level := depth
 	for i, p := range s.Target {
 		if err := checkPathPiece(p, true); err != nil {
 			return errors.Annotate(err).Reason("symlink target piece %(i)d").
 				D("i", i).Err()
 		}
-		if p == ".." {
+		if p != ".." {
 			level++
-			if level > depth {
-				return errors.Reason("symlink target %(target)q escapes root").
-					D("target", s.Target).Err()
+			continue
+		}
+		if level--; level < 0 {
+			return errors.Reason("symlink target %(target)q escapes root").
+				D("target", s.Target).Err()
+		}
+	}
+	return nil
+}
+
+// MaxSymlinkHops is the maximum number of symlinks which may be traversed while
+// resolving a single symlink target.
+const MaxSymlinkHops = 40
+
+// checkSymlinks makes sure that no symlink in the TOC points outside of the
+// root once the other symlinks that its target traverses are followed.
+//
+// SymLink.Validate only checks each target on its own, so it accepts e.g.
+// "a/b" -> ".." and "c" -> "a/b/..", even though the latter resolves to the
+// parent of the root.
+func (t *TOC) checkSymlinks() error {
+	if bad := t.BadSymlinks(); len(bad) > 0 {
+		return bad[0].Err
+	}
+	return nil
+}
+
+// BadSymlink is a symlink which BadSymlinks rejected.
+type BadSymlink struct {
+	Path []string
+	Err  error
+}
+
+// BadSymlinks resolves the target of every symlink in the TOC, following the
+// other symlinks that it traverses, and returns the ones which escape the root
+// or traverse more than MaxSymlinkHops symlinks, in LoopItems order.
+func (t *TOC) BadSymlinks() (ret []BadSymlink) {
+	links := map[string]*SymLink{}
+	t.LoopItems(func(path []string, ent *Entry) error {
+		if link := ent.GetSymlink(); link != nil {
+			links[strings.Join(path, "/")] = link
+		}
+		return nil
+	})
+	if len(links) == 0 {
+		return nil
+	}
+
+	t.LoopItems(func(path []string, ent *Entry) error {
+		if link := ent.GetSymlink(); link != nil {
+			if err := resolveSymlink(links, path, link); err != nil {
+				ret = append(ret, BadSymlink{append([]string(nil), path...), err})
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// resolveSymlink follows the target of the symlink at path through links (keyed
+// by "/"-joined path), and returns an error if it escapes the root or traverses
+// too many symlinks.
+func resolveSymlink(links map[string]*SymLink, path []string, link *SymLink) error {
+	rel := strings.Join(path, "/")
+
+	cur := append([]string(nil), path[:len(path)-1]...)
+	todo := append([]string(nil), link.Target...)
+	hops := 0
+	for len(todo) > 0 {
+		p := todo[0]
+		todo = todo[1:]
+		if p == ".." {
+			if len(cur) == 0 {
+				return errors.Reason("symlink %(path)q escapes root via other symlinks").
+					D("path", rel).Err()
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+		cur = append(cur, p)
+		if next := links[strings.Join(cur, "/")]; next != nil {
+			if hops++; hops > MaxSymlinkHops {
+				return errors.Reason("symlink %(path)q: too many levels of symlinks").
+					D("path", rel).Err()
 			}
+			cur = cur[:len(cur)-1]
+			todo = append(append([]string(nil), next.Target...), todo...)
 		}
 	}
 	return nil
@@ -29,6 +29,11 @@ func TestTOCNormalize(t *testing.T) {
 					s := &SymLink{[]string{"some", "..", "file.ext"}}
 					So(s.Validate(1), ShouldBeNil)
 				})
+
+				Convey("down then up", func() {
+					s := &SymLink{[]string{"some", "..", "..", "file.ext"}}
+					So(s.Validate(1), ShouldBeNil)
+				})
 			})
 
 			Convey("bad", func() {
@@ -53,6 +58,9 @@ func TestTOCNormalize(t *testing.T) {
 					So(s.Validate(0), ShouldErrLike, `escapes root`)
 					So(s.Validate(1), ShouldErrLike, `escapes root`)
 					So(s.Validate(2), ShouldErrLike)
+
+					s = &SymLink{[]string{"some", "..", "..", "file"}}
+					So(s.Validate(0), ShouldErrLike, `escapes root`)
 				})
 			})
 		})
@@ -122,11 +130,95 @@ func TestTOCNormalize(t *testing.T) {
 	})
 }
 
+func TestTOCMaliciousSymlinks(t *testing.T) {
+	t.Parallel()
+
+	link := func(name string, target ...string) *Entry {
+		return &Entry{name, &Entry_Symlink{&SymLink{target}}}
+	}
+	dir := func(name string, ents ...*Entry) *Entry {
+		return &Entry{name, &Entry_Tree{&Tree{ents}}}
+	}
+
+	Convey("TOC.Validate rejects malicious symlinks", t, func() {
+		corpus := []struct {
+			name string
+			ents []*Entry
+			err  string
+		}{
+			{"parent of root", []*Entry{
+				link("up", "..", "etc", "passwd"),
+			}, "escapes root"},
+			{"down then past root", []*Entry{
+				link("up", "a", "..", "..", "etc"),
+			}, "escapes root"},
+			{"nested", []*Entry{
+				dir("d", dir("e", link("up", "..", "..", "..", "x"))),
+			}, "escapes root"},
+			{"absolute", []*Entry{
+				link("abs", "", "etc"),
+			}, "empty path component"},
+			{"drive letter", []*Entry{
+				link("abs", "C:", "Windows"),
+			}, `bad char ":"`},
+			{"backslashes", []*Entry{
+				link("abs", `..\..\x`),
+			}, `bad char "\\"`},
+			{"chained", []*Entry{
+				dir("a", link("b", "..")),
+				link("c", "a", "b", ".."),
+			}, "escapes root via other symlinks"},
+			{"chained twice", []*Entry{
+				dir("a", dir("b", link("c", "..", ".."))),
+				link("d", "a", "b", "c"),
+				link("e", "d", ".."),
+			}, "escapes root via other symlinks"},
+			{"loop", []*Entry{
+				link("x", "y"),
+				link("y", "x"),
+			}, "too many levels of symlinks"},
+		}
+		for _, c := range corpus {
+			Convey(c.name, func() {
+				t := &TOC{CaseSafe: true, Root: &Tree{c.ents}}
+				So(t.Validate(), ShouldErrLike, c.err)
+			})
+		}
+
+		Convey("chained within root is ok", func() {
+			t := &TOC{CaseSafe: true, Root: &Tree{[]*Entry{
+				dir("a", link("b", "..")),
+				link("c", "a", "b", "a", "b", "a"),
+				{"f", &Entry_File{}},
+				link("g", "c", "b", "f"),
+			}}}
+			So(t.Validate(), ShouldBeNil)
+			So(t.BadSymlinks(), ShouldBeEmpty)
+		})
+
+		Convey("BadSymlinks reports every bad symlink", func() {
+			t := &TOC{CaseSafe: true, Root: &Tree{[]*Entry{
+				dir("a", link("b", "..")),
+				link("c", "a", "b", ".."),
+				link("x", "y"),
+				link("y", "x"),
+			}}}
+			bad := t.BadSymlinks()
+			So(len(bad), ShouldEqual, 3)
+			So(bad[0].Path, ShouldResemble, []string{"c"})
+			So(bad[0].Err, ShouldErrLike, "escapes root via other symlinks")
+			So(bad[1].Path, ShouldResemble, []string{"x"})
+			So(bad[1].Err, ShouldErrLike, "too many levels of symlinks")
+			So(bad[2].Path, ShouldResemble, []string{"y"})
+		})
+	})
+}
+
 func TestTOCLoop(t *testing.T) {
 	t.Parallel()
 
 	Convey("TOC.LoopItems", t, func() {
-		t := &TOC{true, &Tree{[]*Entry{
+		t := &TOC{CaseSafe: true, Root: &Tree{[]*Entry{
 			{"someFile", &Entry_File{}},
 			{"someSymlink", &Entry_Symlink{&SymLink{[]string{"someFile"}}}},
 			{"someTree", &Entry_Tree{&Tree{[]*Entry{
@@ -165,3 +257,101 @@ func TestTOCLoop(t *testing.T) {
 		})
 	})
 }
+
+func TestTOCLocate(t *testing.T) {
+	t.Parallel()
+
+	Convey("TOC.Locate", t, func() {
+		t := &TOC{CaseSafe: true, Root: &Tree{[]*Entry{
+			{"someFile", &Entry_File{&File{Size: 10}}},
+			{"someTree", &Entry_Tree{&Tree{[]*Entry{
+				{"subFile", &Entry_File{&File{Size: 20}}},
+				{"subSymlink", &Entry_Symlink{&SymLink{[]string{"..", "someFile"}}}},
+			}}}},
+			{"lastFile", &Entry_File{&File{Size: 30}}},
+		}}}
+
+		ent, offset, err := t.Locate([]string{"lastFile"})
+		So(err, ShouldBeNil)
+		So(ent.Name, ShouldEqual, "lastFile")
+		So(offset, ShouldEqual, 30)
+
+		ent, offset, err = t.Locate([]string{"someTree", "subFile"})
+		So(err, ShouldBeNil)
+		So(ent.Name, ShouldEqual, "subFile")
+		So(offset, ShouldEqual, 10)
+
+		_, _, err = t.Locate([]string{"someTree", "lastFile"})
+		So(err, ShouldEqual, ErrNotFound)
+	})
+}
+
+func TestTOCDataOrder(t *testing.T) {
+	t.Parallel()
+
+	Convey("TOC.DataOrder", t, func() {
+		t := &TOC{CaseSafe: true, Root: &Tree{[]*Entry{
+			{"someFile", &Entry_File{&File{Size: 10}}},
+			{"someTree", &Entry_Tree{&Tree{[]*Entry{
+				{"subFile", &Entry_File{&File{Size: 20}}},
+				{"subSymlink", &Entry_Symlink{&SymLink{[]string{"..", "someFile"}}}},
+			}}}},
+			{"lastFile", &Entry_File{&File{Size: 30}}},
+		}}, DataOrder: []uint64{2, 0, 1}}
+		So(t.Validate(), ShouldBeNil)
+
+		Convey("LoopData", func() {
+			found := []string{}
+			So(t.LoopData(func(path []string, ent *Entry) error {
+				found = append(found, strings.Join(path, "/"))
+				return nil
+			}), ShouldBeNil)
+			So(found, ShouldResemble, []string{
+				"someTree",
+				"someTree/subSymlink",
+				"lastFile",
+				"someFile",
+				"someTree/subFile",
+			})
+
+			Convey("without DataOrder", func() {
+				t.DataOrder = nil
+				found := []string{}
+				So(t.LoopData(func(path []string, ent *Entry) error {
+					found = append(found, strings.Join(path, "/"))
+					return nil
+				}), ShouldBeNil)
+				So(found, ShouldResemble, []string{
+					"someFile",
+					"someTree",
+					"someTree/subFile",
+					"someTree/subSymlink",
+					"lastFile",
+				})
+			})
+		})
+
+		Convey("Locate", func() {
+			for path, offset := range map[string]uint64{
+				"lastFile":         0,
+				"someFile":         30,
+				"someTree/subFile": 40,
+			} {
+				_, off, err := t.Locate(strings.Split(path, "/"))
+				So(err, ShouldBeNil)
+				So(off, ShouldEqual, offset)
+			}
+		})
+
+		Convey("Validate", func() {
+			t.DataOrder = []uint64{2, 0}
+			So(t.Validate(), ShouldErrLike, "data order has 2 entries, but there are 3 files")
+
+			t.DataOrder = []uint64{2, 0, 3}
+			So(t.Validate(), ShouldErrLike, "refers to file 3, but there are 3 files")
+
+			t.DataOrder = []uint64{2, 0, 2}
+			So(t.Validate(), ShouldErrLike, "refers to file 2 more than once")
+		})
+	})
+}
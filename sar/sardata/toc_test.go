@@ -6,8 +6,10 @@ package sardata
 
 import (
 	"bytes"
+	"io/ioutil"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
 	. "github.com/smartystreets/goconvey/convey"
 
 	"github.com/riannucci/sarchive/sar/sardata/toc"
@@ -44,5 +46,26 @@ func TestTOC(t *testing.T) {
 			So(err, ShouldBeNil)
 			So(newT, ShouldResemble, t)
 		})
+
+		Convey("read with limit", func() {
+			raw := buf.Bytes()
+			newT, err := ReadTOCLimit(bytes.NewReader(raw), 100)
+			So(err, ShouldBeNil)
+			So(newT, ShouldResemble, t)
+
+			r := bytes.NewReader(append(raw, "after"...))
+			_, err = ReadTOCLimit(r, 10)
+			So(err, ShouldResemble, &ErrTOCTooLarge{Max: 10})
+			rest, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(rest), ShouldEqual, "after")
+		})
+
+		Convey("read uncompressed with limit", func() {
+			raw := &bytes.Buffer{}
+			So(WriteTOC(raw, t, CompressionNone, 0), ShouldBeNil)
+			_, err := ReadTOCLimit(raw, 10)
+			So(err, ShouldResemble, &ErrTOCTooLarge{Size: uint64(proto.Size(t)), Max: 10})
+		})
 	})
 }
@@ -0,0 +1,117 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sardata
+
+import (
+	"io"
+
+	"github.com/luci/luci-go/common/errors"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// CompressionXZ data is a raw LZMA2 stream (the compression used by xz),
+// prefixed with the LZMA2 dictionary size property byte, like an xz filter.
+// The xz container is left out, since blocks already have a header and the
+// archive has a checksum.
+
+// xzPresets are the dictionary sizes of the xz command line tool's presets,
+// -0 to -9.
+var xzPresets = []int{
+	256 * 1024,
+	1024 * 1024,
+	2 * 1024 * 1024,
+	4 * 1024 * 1024,
+	4 * 1024 * 1024,
+	8 * 1024 * 1024,
+	8 * 1024 * 1024,
+	16 * 1024 * 1024,
+	32 * 1024 * 1024,
+	64 * 1024 * 1024,
+}
+
+// xzDictCap returns the dictionary size for an xz compression level, which is
+// either a preset from 0 to 9, or a dictionary size in bytes.
+func xzDictCap(level int) (int, error) {
+	switch {
+	case level >= 0 && level < len(xzPresets):
+		return xzPresets[level], nil
+	case level >= lzma.MinDictCap && int64(level) <= lzma.MaxDictCap:
+		return level, nil
+	}
+	return 0, errors.Reason("xz level %(level)d is neither a preset (0-9) nor a dictionary size (at least %(min)d bytes)").
+		D("level", level).D("min", lzma.MinDictCap).Err()
+}
+
+type xzWriter struct {
+	w        io.Writer
+	dictCode byte
+	lw       *lzma.Writer2
+
+	wroteProps bool
+}
+
+func newXZWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	dictCap, err := xzDictCap(level)
+	if err != nil {
+		return nil, err
+	}
+	lw, err := lzma.Writer2Config{DictCap: dictCap}.NewWriter2(w)
+	if err != nil {
+		return nil, err
+	}
+	return &xzWriter{w: w, dictCode: lzma.EncodeDictCap(int64(dictCap)), lw: lw}, nil
+}
+
+// writeProps writes the dictionary size property byte, which must precede the
+// LZMA2 stream.
+func (x *xzWriter) writeProps() error {
+	if x.wroteProps {
+		return nil
+	}
+	x.wroteProps = true
+	_, err := x.w.Write([]byte{x.dictCode})
+	return err
+}
+
+func (x *xzWriter) Write(p []byte) (int, error) {
+	if err := x.writeProps(); err != nil {
+		return 0, err
+	}
+	return x.lw.Write(p)
+}
+
+func (x *xzWriter) Close() error {
+	if err := x.writeProps(); err != nil {
+		return err
+	}
+	return x.lw.Close()
+}
+
+// newXZReader reads the dictionary size from r, and returns a reader for the
+// LZMA2 stream which follows it. It returns an *ErrDecoderMemory if the
+// dictionary is larger than maxMemory bytes.
+func newXZReader(r io.Reader, maxMemory uint64) (io.ReadCloser, error) {
+	var props [1]byte
+	if _, err := io.ReadFull(r, props[:]); err != nil {
+		return nil, errors.Annotate(err).Reason("reading xz properties").Err()
+	}
+	dictCap, err := lzma.DecodeDictCap(props[0])
+	if err != nil {
+		return nil, err
+	}
+	if uint64(dictCap) > maxMemory || int64(int(dictCap)) != dictCap {
+		return nil, &ErrDecoderMemory{CompressionXZ, uint64(dictCap), maxMemory}
+	}
+	// The stream may declare a dictionary smaller than lzma's minimum, which it
+	// will still decode correctly with a larger one.
+	if dictCap < lzma.MinDictCap {
+		dictCap = lzma.MinDictCap
+	}
+	lr, err := lzma.Reader2Config{DictCap: int(dictCap)}.NewReader2(r)
+	if err != nil {
+		return nil, err
+	}
+	return readCloseHook{lr, nil}, nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:generate stringer -type SkipReason
+
+package sar
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/luci/luci-go/common/data/stringset"
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// SkipReason indicates why GenerateTreeFromPath omitted an entry from the
+// generated TOC.
+type SkipReason int
+
+// These are the reasons that an entry may be skipped.
+const (
+	// SkipSocket is used for unix domain sockets.
+	SkipSocket SkipReason = iota + 1
+
+	// SkipDevice is used for block and character devices.
+	SkipDevice
+
+	// SkipNamedPipe is used for FIFOs.
+	SkipNamedPipe
+
+	// SkipIrregular is used for any other non-regular file types.
+	SkipIrregular
+
+	// SkipBadName is used for entries whose name is rejected by
+	// toc.ValidateName.
+	SkipBadName
+
+	// SkipBadSymlink is used for symlinks which are absolute, which would be
+	// rejected by SymLink.Validate (e.g. because they point outside of the
+	// archive), or which TOC.BadSymlinks rejects once the other symlinks are
+	// followed (e.g. loops, or chains which escape the archive).
+	SkipBadSymlink
+)
+
+// SkippedEntry describes a single entry that GenerateTreeFromPath omitted.
+type SkippedEntry struct {
+	// Path is the path of the skipped entry, relative to the scanned directory.
+	Path []string
+
+	Reason SkipReason
+
+	// Err is the validation error for SkipBadName and SkipBadSymlink, and nil
+	// otherwise.
+	Err error
+}
+
+// ScanReport is the structured report of all the entries which
+// GenerateTreeFromPath encountered but could not include in the TOC.
+type ScanReport struct {
+	Skipped []SkippedEntry
+}
+
+func (r *ScanReport) skip(path []string, name string, reason SkipReason, err error) {
+	p := make([]string, len(path), len(path)+1)
+	copy(p, path)
+	r.Skipped = append(r.Skipped, SkippedEntry{append(p, name), reason, err})
+}
+
+// skipReasonForMode returns the SkipReason for a non-regular, non-directory,
+// non-symlink mode.
+func skipReasonForMode(mode os.FileMode) SkipReason {
+	switch {
+	case mode&os.ModeSocket != 0:
+		return SkipSocket
+	case mode&os.ModeDevice != 0:
+		return SkipDevice
+	case mode&os.ModeNamedPipe != 0:
+		return SkipNamedPipe
+	}
+	return SkipIrregular
+}
+
+// newTOCFile generates a toc.File with the given size, and with the modes
+// derived from the permission bits of mode.
+func newTOCFile(size uint64, mode os.FileMode) *toc.File {
+	ret := &toc.File{Size: size}
+	if mode&0111 != 0 {
+		ret.PosixMode = &toc.PosixMode{Executable: true}
+	}
+	if mode&0222 == 0 {
+		ret.CommonMode = &toc.CommonMode{Readonly: true}
+	}
+	return ret
+}
+
+// scanFile generates the toc.File for the regular file at abs.
+func scanFile(abs string, fi os.FileInfo) (*toc.File, error) {
+	ret := newTOCFile(uint64(fi.Size()), fi.Mode())
+	winMode, err := getWinFileAttributes(abs)
+	if err != nil {
+		return nil, errors.Annotate(err).Reason("reading windows mode").Err()
+	}
+	ret.WinMode = winMode
+	return ret, nil
+}
+
+// scanSymlink generates the toc.SymLink for the symlink at abs, which is at
+// the given depth in the TOC.
+//
+// The target is stored as written, apart from empty and "." components. In
+// particular "x/.." isn't collapsed, since x may itself be a symlink; it's up
+// to SymLink.Validate (and TOC.Validate) to reject ".." components which escape
+// the root.
+//
+// Returns a nil SymLink and a non-nil validation error if the symlink should be
+// skipped. The returned error is only for failures to read the link.
+func scanSymlink(abs string, depth int) (link *toc.SymLink, invalid, err error) {
+	target, err := os.Readlink(abs)
+	if err != nil {
+		return
+	}
+	if filepath.IsAbs(target) {
+		invalid = errors.Reason("absolute symlink target %(target)q").
+			D("target", target).Err()
+		return
+	}
+	link = &toc.SymLink{}
+	for _, p := range strings.Split(filepath.ToSlash(target), "/") {
+		if p != "" && p != "." {
+			link.Target = append(link.Target, p)
+		}
+	}
+	if invalid = link.Validate(depth); invalid != nil {
+		link = nil
+	}
+	return
+}
+
+// scanTree recursively generates the toc.Tree for the directory at abs, whose
+// path relative to the scan root is path.
+//
+// Entries are sorted by name. caseSafe is true iff no two entries in this tree
+// (or any subtree) have names which differ only by case.
+func scanTree(rpt *ScanReport, abs string, path []string) (ret *toc.Tree, caseSafe bool, err error) {
+	fis, err := ioutil.ReadDir(abs)
+	if err != nil {
+		return
+	}
+
+	ret = &toc.Tree{Entries: make([]*toc.Entry, 0, len(fis))}
+	caseSafe = true
+	lowerNames := stringset.New(len(fis))
+	for _, fi := range fis {
+		name := fi.Name()
+		if err := toc.ValidateName(name); err != nil {
+			rpt.skip(path, name, SkipBadName, err)
+			continue
+		}
+
+		entAbs := filepath.Join(abs, name)
+		ent := &toc.Entry{Name: name}
+
+		switch mode := fi.Mode(); {
+		case mode.IsRegular():
+			file, err := scanFile(entAbs, fi)
+			if err != nil {
+				return nil, false, errors.Annotate(err).Reason("scanning file %(path)q").
+					D("path", entAbs).Err()
+			}
+			ent.Etype = &toc.Entry_File{File: file}
+
+		case mode.IsDir():
+			tree, subCaseSafe, err := scanTree(rpt, entAbs, append(path, name))
+			if err != nil {
+				return nil, false, err
+			}
+			caseSafe = caseSafe && subCaseSafe
+			ent.Etype = &toc.Entry_Tree{Tree: tree}
+
+		case mode&os.ModeSymlink != 0:
+			link, invalid, err := scanSymlink(entAbs, len(path))
+			if err != nil {
+				return nil, false, errors.Annotate(err).Reason("scanning symlink %(path)q").
+					D("path", entAbs).Err()
+			}
+			if invalid != nil {
+				rpt.skip(path, name, SkipBadSymlink, invalid)
+				continue
+			}
+			ent.Etype = &toc.Entry_Symlink{Symlink: link}
+
+		default:
+			rpt.skip(path, name, skipReasonForMode(mode), nil)
+			continue
+		}
+
+		if !lowerNames.Add(strings.ToLower(name)) {
+			caseSafe = false
+		}
+		ret.Entries = append(ret.Entries, ent)
+	}
+	return
+}
+
+// removeEntry removes the entry called name from the tree at dir beneath root.
+func removeEntry(root *toc.Tree, dir []string, name string) {
+	tree := root
+	for _, d := range dir {
+		for _, ent := range tree.Entries {
+			if ent.Name == d {
+				tree = ent.GetTree()
+				break
+			}
+		}
+	}
+	for i, ent := range tree.Entries {
+		if ent.Name == name {
+			tree.Entries = append(tree.Entries[:i], tree.Entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// GenerateTreeFromPath scans the directory at path and returns the TOC that
+// CreateFromPath would write for it.
+//
+// caseSafe is true iff the TOC can be unpacked on a case-insensitive
+// filesystem (this is also reflected in the TOC's CaseSafe field).
+//
+// Entries which cannot be represented in a SARchive (sockets, devices, FIFOs,
+// invalid names and invalid symlinks) are omitted from the TOC, and are listed
+// in the returned ScanReport instead.
+func GenerateTreeFromPath(path string) (ret *toc.TOC, caseSafe bool, rpt *ScanReport, err error) {
+	rpt = &ScanReport{}
+	root, caseSafe, err := scanTree(rpt, path, nil)
+	if err != nil {
+		err = errors.Annotate(err).Reason("scanning %(path)q").
+			D("path", path).Err()
+		return
+	}
+	t := &toc.TOC{CaseSafe: caseSafe, Root: root}
+	// scanSymlink only checks each symlink on its own. Any symlink which
+	// traverses a bad one is bad too, so removing them all leaves none behind.
+	for _, b := range t.BadSymlinks() {
+		dir, name := b.Path[:len(b.Path)-1], b.Path[len(b.Path)-1]
+		removeEntry(root, dir, name)
+		rpt.skip(dir, name, SkipBadSymlink, b.Err)
+	}
+	if err = t.Validate(); err != nil {
+		err = errors.Annotate(err).Reason("validating TOC").Err()
+		return
+	}
+	ret = t
+	return
+}
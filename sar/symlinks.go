@@ -0,0 +1,56 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"strings"
+
+	"github.com/luci/luci-go/common/errors"
+
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// SymlinkPolicy controls what UnpackTo does with the symlinks in the archive.
+// It defaults to SymlinksAllow.
+//
+// Regardless of the policy, UnpackTo never writes through a symlink: every
+// entry's parent directories must be real directories beneath the root.
+type SymlinkPolicy int
+
+// Valid values of SymlinkPolicy
+const (
+	// SymlinksAllow creates the archive's symlinks.
+	SymlinksAllow SymlinkPolicy = iota
+
+	// SymlinksSkip leaves out the archive's symlinks, as if they weren't
+	// selected.
+	SymlinksSkip
+
+	// SymlinksReject causes UnpackTo to fail without writing anything if the
+	// archive contains any symlinks.
+	SymlinksReject
+)
+
+// WithSymlinkPolicy controls what UnpackTo does with the archive's symlinks.
+func WithSymlinkPolicy(p SymlinkPolicy) UnpackOption {
+	return func(o *unpackOptionData) {
+		o.symlinks = p
+	}
+}
+
+// errSymlinkParent is the error for entries whose parent directory turns out
+// to be a symlink when it's opened.
+var errSymlinkParent = errors.New("parent directory is a symlink")
+
+// rejectSymlinks returns an error if t contains any symlinks.
+func rejectSymlinks(t *toc.TOC) error {
+	return t.LoopItems(func(path []string, ent *toc.Entry) error {
+		if ent.GetSymlink() != nil {
+			return errors.Reason("archive contains symlink %(path)q").
+				D("path", strings.Join(path, "/")).Err()
+		}
+		return nil
+	})
+}
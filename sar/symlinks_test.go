@@ -0,0 +1,206 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// rawArchive writes an archive containing t (which isn't validated) and no
+// file data.
+func rawArchive(t *toc.TOC) []byte {
+	buf := &bytes.Buffer{}
+	csumWriter := sardata.ChecksumBLAKE2b.Writer(nullWriteCloser{buf})
+	must := func(err error) {
+		if err != nil {
+			panic(err)
+		}
+	}
+	must(sardata.WriteMagic(csumWriter))
+	must(sardata.WriteTOC(csumWriter, t, sardata.CompressionFlate, 9))
+	bw, err := sardata.BlockWriter(csumWriter, sardata.CompressionFlate, 9)
+	must(err)
+	must(bw.Close())
+	must(csumWriter.Close())
+	return buf.Bytes()
+}
+
+func TestUnpackSymlinks(tst *testing.T) {
+	tst.Parallel()
+
+	if runtime.GOOS == "windows" {
+		tst.Skip("symlinks require privileges on windows")
+	}
+
+	link := func(name string, target ...string) *toc.Entry {
+		return &toc.Entry{Name: name, Etype: &toc.Entry_Symlink{Symlink: &toc.SymLink{Target: target}}}
+	}
+	dir := func(name string, ents ...*toc.Entry) *toc.Entry {
+		return &toc.Entry{Name: name, Etype: &toc.Entry_Tree{Tree: &toc.Tree{Entries: ents}}}
+	}
+
+	Convey("Open rejects archives with escaping symlinks", tst, func() {
+		corpus := map[string][]*toc.Entry{
+			"parent of root": {
+				link("up", "..", "x"),
+			},
+			"down then past root": {
+				link("up", "a", "..", "..", "x"),
+			},
+			"chained": {
+				dir("a", link("b", "..")),
+				link("c", "a", "b", "..", "x"),
+			},
+		}
+		for name, ents := range corpus {
+			Convey(name, func() {
+				data := rawArchive(&toc.TOC{CaseSafe: true, Root: &toc.Tree{Entries: ents}})
+				_, err := Open(nullReadSeekCloser{bytes.NewReader(data)})
+				So(err, ShouldErrLike, "escapes root")
+			})
+		}
+	})
+
+	Convey("UnpackTo", tst, func() {
+		tmp, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmp)
+		root := filepath.Join(tmp, "root")
+		outside := filepath.Join(tmp, "outside")
+		So(os.Mkdir(outside, 0777), ShouldBeNil)
+
+		Convey("never writes through symlinks", func() {
+			So(os.Mkdir(root, 0777), ShouldBeNil)
+			So(os.Symlink(outside, filepath.Join(root, "evil")), ShouldBeNil)
+
+			d, err := openRootDir(root)
+			So(err, ShouldBeNil)
+			defer d.Close()
+
+			_, err = d.create([]string{"evil", "file"})
+			So(err, ShouldErrLike, "parent directory is a symlink")
+			So(d.mkdir([]string{"evil", "dir"}), ShouldErrLike, "parent directory is a symlink")
+			So(d.symlink("x", []string{"evil", "link"}), ShouldErrLike, "parent directory is a symlink")
+
+			f, err := d.create([]string{"file"})
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+			_, err = d.create([]string{"file"})
+			So(os.IsExist(err), ShouldBeTrue)
+
+			So(readTree(outside), ShouldBeEmpty)
+		})
+
+		Convey("never removes or reads through symlinks", func() {
+			So(os.Mkdir(root, 0777), ShouldBeNil)
+			So(os.Symlink(outside, filepath.Join(root, "evil")), ShouldBeNil)
+			mkTree(outside, map[string]string{"victim": "data", "dir/file": "data"})
+			mkTree(root, map[string]string{"dir/sub/file": "data", "file": "data"})
+
+			d, err := openRootDir(root)
+			So(err, ShouldBeNil)
+			defer d.Close()
+
+			So(d.removeAll([]string{"evil", "victim"}), ShouldErrLike, "parent directory is a symlink")
+			So(d.removeAll([]string{"evil", "dir"}), ShouldErrLike, "parent directory is a symlink")
+			So(d.rename([]string{"evil", "victim"}, []string{"evil", "other"}), ShouldErrLike,
+				"parent directory is a symlink")
+			_, err = d.lstat([]string{"evil", "victim"})
+			So(err, ShouldErrLike, "parent directory is a symlink")
+			_, err = d.open([]string{"evil", "victim"})
+			So(err, ShouldErrLike, "parent directory is a symlink")
+
+			fi, err := d.lstat([]string{"evil"})
+			So(err, ShouldBeNil)
+			So(fi.Mode()&os.ModeSymlink, ShouldNotEqual, 0)
+			target, err := d.readlink([]string{"evil"})
+			So(err, ShouldBeNil)
+			So(target, ShouldEqual, outside)
+			_, err = d.open([]string{"evil"})
+			So(err, ShouldNotBeNil)
+
+			fi, err = d.lstat([]string{"file"})
+			So(err, ShouldBeNil)
+			So(fi.Mode().IsRegular(), ShouldBeTrue)
+			So(fi.Size(), ShouldEqual, 4)
+
+			So(d.removeAll([]string{"evil"}), ShouldBeNil)
+			So(d.removeAll([]string{"dir"}), ShouldBeNil)
+			So(d.removeAll([]string{"nope"}), ShouldBeNil)
+			So(readTree(root), ShouldResemble, map[string]string{"file": "data"})
+			So(readTree(outside), ShouldResemble, map[string]string{"victim": "data", "dir/file": "data"})
+		})
+
+		Convey("replaces existing symlinked directories", func() {
+			So(os.Mkdir(root, 0777), ShouldBeNil)
+			So(os.Symlink(outside, filepath.Join(root, "dir")), ShouldBeNil)
+
+			buf := &bytes.Buffer{}
+			b, err := NewBuilder(buf)
+			So(err, ShouldBeNil)
+			So(b.AddDir([]string{"dir"}), ShouldBeNil)
+			So(b.AddFile([]string{"dir", "file"}, 4, 0644, strings.NewReader("data")), ShouldBeNil)
+			So(b.Finish(), ShouldBeNil)
+
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+			So(err, ShouldBeNil)
+			So(ar.UnpackTo(context.Background(), root, WithExistingPolicy(ExistingOverwrite)), ShouldBeNil)
+			So(readTree(root), ShouldResemble, map[string]string{"dir/file": "data"})
+			So(readTree(outside), ShouldBeEmpty)
+		})
+
+		Convey("with a SymlinkPolicy", func() {
+			buf := &bytes.Buffer{}
+			b, err := NewBuilder(buf)
+			So(err, ShouldBeNil)
+			So(b.AddFile([]string{"file"}, 4, 0644, strings.NewReader("data")), ShouldBeNil)
+			So(b.AddSymlink([]string{"link"}, []string{"file"}), ShouldBeNil)
+			So(b.Finish(), ShouldBeNil)
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+			So(err, ShouldBeNil)
+
+			Convey("allow", func() {
+				So(ar.UnpackTo(context.Background(), root), ShouldBeNil)
+				So(readTree(root), ShouldResemble, map[string]string{
+					"file": "data",
+					"link": "->file",
+				})
+			})
+
+			Convey("skip", func() {
+				So(ar.UnpackTo(context.Background(), root, WithSymlinkPolicy(SymlinksSkip)), ShouldBeNil)
+				So(readTree(root), ShouldResemble, map[string]string{"file": "data"})
+			})
+
+			Convey("reject", func() {
+				err := ar.UnpackTo(context.Background(), root, WithSymlinkPolicy(SymlinksReject))
+				So(err, ShouldErrLike, `archive contains symlink "link"`)
+				_, err = os.Stat(root)
+				So(os.IsNotExist(err), ShouldBeTrue)
+				So(ar.Close(), ShouldBeNil)
+			})
+
+			Convey("bad", func() {
+				err := ar.UnpackTo(context.Background(), root, WithSymlinkPolicy(SymlinkPolicy(7)))
+				So(err, ShouldErrLike, "unknown SymlinkPolicy 7")
+			})
+		})
+	})
+}
@@ -7,34 +7,44 @@ package sar
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/luci/luci-go/common/data/stringset"
 	"github.com/luci/luci-go/common/errors"
-	"github.com/luci/luci-go/common/logging"
 
+	"github.com/riannucci/sarchive/sar/sardata"
 	"github.com/riannucci/sarchive/sar/sardata/toc"
 )
 
-func ensureRoot(root string) error {
-	if st, err := os.Stat(root); !os.IsNotExist(err) {
-		return err
-	} else if os.IsNotExist(err) {
+// ensureRoot makes sure that root is a directory. Unless allowNonEmpty is
+// true, it must also be empty.
+func ensureRoot(root string, allowNonEmpty bool) error {
+	st, err := os.Stat(root)
+	switch {
+	case os.IsNotExist(err):
 		if err := os.MkdirAll(root, 0777); err != nil {
 			return errors.Annotate(err).Reason("making root dir").Err()
 		}
-	} else if !st.IsDir() {
+	case err != nil:
 		return err
-	} else if st.IsDir() {
+	case !st.IsDir():
+		return errors.New("not a directory")
+	case !allowNonEmpty:
 		f, err := os.Open(root)
 		if err != nil {
 			return err
 		}
 		finfos, err := f.Readdir(1)
 		f.Close()
-		if err != nil {
+		if err != nil && err != io.EOF {
 			return err
 		}
 		if len(finfos) != 0 {
@@ -44,151 +54,791 @@ func ensureRoot(root string) error {
 	return nil
 }
 
-func ensureSymlink(wg *sync.WaitGroup, ech chan<- error, abs, rel string, s *toc.SymLink) {
+// ctxReader is an io.Reader which fails with ctx.Err() once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// prepReader returns the reader for the data block. Closing checksumCloser
+// reads the rest of the archive and verifies its checksum. abort stops the
+// read-ahead goroutine (if any) and closes the archive without reading the rest
+// of it.
+//
+// Reads from the returned reader fail once ctx is done.
+func (a *OpenedArchive) prepReader(ctx context.Context) (dataReader io.Reader, checksumCloser io.Closer, abort func()) {
+	dataReader = ctxReader{ctx, a.r}
+	checksumCloser = closeFn(a.closeReaders)
+	abort = func() { a.abortReaders() }
+	if a.opts.unpackBufferSize > 0 {
+		rd, wr := io.Pipe()
+		done := make(chan struct{})
+		go func(r io.Reader) {
+			defer close(done)
+			_, err := bufio.NewReaderSize(r, a.opts.unpackBufferSize).WriteTo(wr)
+			wr.CloseWithError(err)
+		}(dataReader)
+		dataReader = ctxReader{ctx, rd}
+		checksumCloser = closeFn(func() error {
+			// Make sure the read-ahead goroutine is done with a.r before we close
+			// it.
+			rd.Close()
+			<-done
+			return a.closeReaders()
+		})
+		abort = func() {
+			rd.Close()
+			<-done
+			a.abortReaders()
+		}
+	}
+	return
+}
+
+type closeFn func() error
+
+func (c closeFn) Close() error { return c() }
+
+type unpackOptionData struct {
+	include         []string
+	exclude         []string
+	filter          func(path []string, ent *toc.Entry) bool
+	existing        ExistingPolicy
+	compareContents bool
+	report          *UnpackReport
+	atomic          bool
+	backup          string
+	symlinks        SymlinkPolicy
+}
+
+// UnpackOption functions can be supplied to the UnpackTo function.
+type UnpackOption func(*unpackOptionData)
+
+// WithInclude limits UnpackTo to the entries which match at least one of the
+// given glob patterns (or which are inside of a directory that does). May be
+// supplied multiple times.
+//
+// Patterns are slash-separated, and each piece is matched against a single path
+// component using path.Match. A piece of "**" matches zero or more path
+// components, so "bin/**/*.so" matches "bin/a.so" and "bin/x/y/a.so".
+func WithInclude(patterns ...string) UnpackOption {
+	return func(o *unpackOptionData) {
+		o.include = append(o.include, patterns...)
+	}
+}
+
+// WithExclude prevents UnpackTo from writing the entries which match any of the
+// given glob patterns (or which are inside of a directory that does). Exclusion
+// takes precedence over WithInclude. May be supplied multiple times.
+//
+// See WithInclude for the pattern syntax.
+func WithExclude(patterns ...string) UnpackOption {
+	return func(o *unpackOptionData) {
+		o.exclude = append(o.exclude, patterns...)
+	}
+}
+
+// WithFilter causes UnpackTo to skip every entry for which fn returns false.
+// fn is only called for entries which pass WithInclude and WithExclude.
+//
+// Unlike the glob patterns, fn applies only to the entries it's called for; if
+// fn rejects a directory, fn will still be called for that directory's
+// entries.
+func WithFilter(fn func(path []string, ent *toc.Entry) bool) UnpackOption {
+	return func(o *unpackOptionData) {
+		o.filter = fn
+	}
+}
+
+// WithExistingPolicy allows UnpackTo to write into a non-empty directory, and
+// controls what happens to the entries which already exist there.
+func WithExistingPolicy(p ExistingPolicy) UnpackOption {
+	return func(o *unpackOptionData) {
+		o.existing = p
+	}
+}
+
+// WithCompareContents causes ExistingReplaceIfDifferent and ExistingMirror to
+// compare the contents of existing files which have the same size as the
+// archived file, instead of assuming that they're the same.
+//
+// The archived data is written to a temporary file next to the existing one,
+// which is renamed over the existing file iff its hash differs.
+func WithCompareContents(val bool) UnpackOption {
+	return func(o *unpackOptionData) {
+		o.compareContents = val
+	}
+}
+
+// WithUnpackReport causes UnpackTo to fill in rpt with the action it took for
+// every path it unpacked, skipped or deleted.
+func WithUnpackReport(rpt *UnpackReport) UnpackOption {
+	return func(o *unpackOptionData) {
+		o.report = rpt
+	}
+}
+
+// WithAtomic causes UnpackTo to unpack into a staging directory next to root,
+// and to only move it into place once the whole archive has been written (and
+// its checksum verified, unless the archive was opened with VerifyNever). If
+// UnpackTo fails, the staging directory is removed and root is untouched.
+//
+// root must be missing or empty, unless WithAtomicBackup is also supplied.
+// This may not be combined with WithExistingPolicy.
+func WithAtomic(val bool) UnpackOption {
+	return func(o *unpackOptionData) {
+		o.atomic = val
+	}
+}
+
+// WithAtomicBackup implies WithAtomic, and allows root to be non-empty. Once the
+// staging directory is complete, the existing root is renamed to backup (which
+// must not exist, and must be on the same filesystem as root) and the staging
+// directory is renamed to root.
+func WithAtomicBackup(backup string) UnpackOption {
+	return func(o *unpackOptionData) {
+		o.atomic = true
+		o.backup = backup
+	}
+}
+
+// unpackOptions is the parsed form of unpackOptionData.
+type unpackOptions struct {
+	include []globPattern
+	exclude []globPattern
+	filter  func(path []string, ent *toc.Entry) bool
+
+	existing        ExistingPolicy
+	compareContents bool
+	report          *UnpackReport
+
+	atomic bool
+	backup string
+
+	symlinks SymlinkPolicy
+}
+
+func parseUnpackOptions(options []UnpackOption) (ret unpackOptions, err error) {
+	opts := unpackOptionData{}
+	for _, o := range options {
+		o(&opts)
+	}
+	parse := func(patterns []string) ([]globPattern, error) {
+		ret := make([]globPattern, len(patterns))
+		for i, p := range patterns {
+			if ret[i], err = parseGlob(p); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	if ret.include, err = parse(opts.include); err != nil {
+		return
+	}
+	if ret.exclude, err = parse(opts.exclude); err != nil {
+		return
+	}
+	if opts.existing < ExistingFail || opts.existing > ExistingMirror {
+		err = errors.Reason("unknown ExistingPolicy %(p)d").D("p", opts.existing).Err()
+		return
+	}
+	if opts.symlinks < SymlinksAllow || opts.symlinks > SymlinksReject {
+		err = errors.Reason("unknown SymlinkPolicy %(p)d").D("p", opts.symlinks).Err()
+		return
+	}
+	if opts.atomic && opts.existing != ExistingFail {
+		err = errors.New("WithAtomic may not be combined with WithExistingPolicy")
+		return
+	}
+	if opts.backup != "" {
+		if ret.backup, err = filepath.Abs(opts.backup); err != nil {
+			err = errors.Annotate(err).Reason("making backup abspath").Err()
+			return
+		}
+	}
+	ret.filter = opts.filter
+	ret.existing = opts.existing
+	ret.compareContents = opts.compareContents
+	ret.report = opts.report
+	ret.atomic = opts.atomic
+	ret.symlinks = opts.symlinks
+	return
+}
+
+// selected returns true iff the entry at path should be written.
+func (o *unpackOptions) selected(path []string, ent *toc.Entry) bool {
+	if o.symlinks == SymlinksSkip && ent.GetSymlink() != nil {
+		return false
+	}
+	if len(o.include) > 0 && !matchAny(o.include, path) {
+		return false
+	}
+	if matchAny(o.exclude, path) {
+		return false
+	}
+	return o.filter == nil || o.filter(path, ent)
+}
+
+// unpacker holds the state of a single UnpackTo call.
+type unpacker struct {
+	ctx      context.Context
+	root     string
+	opts     unpackOptions
+	progress *progressTracker
+
+	// dir is used to create all entries, so that nothing is written outside of
+	// root.
+	dir *rootDir
+
+	// curRel is the rel path of the entry currently being unpacked.
+	curRel string
+
+	r       io.Reader
+	syncBuf []byte
+
+	// wg and ech track the chmod/close goroutines. Errors which are sent
+	// to ech are collected into the *UnpackError which UnpackTo returns, but
+	// don't stop the unpack.
+	wg  sync.WaitGroup
+	ech chan<- error
+
+	// writeSem is non-nil if small files are written concurrently (see
+	// WithUnpackWorkers), and limits the number of files being written at once.
+	writeSem chan struct{}
+
+	// madeDirs is the set of rel paths of directories which exist.
+	madeDirs stringset.Set
+	// skippedDirs is the set of rel paths of directories which ExistingSkip
+	// couldn't create, because a non-directory was in the way.
+	skippedDirs stringset.Set
+	// tocPaths is the set of rel paths of all entries in the TOC, for
+	// ExistingMirror.
+	tocPaths stringset.Set
+}
+
+func (u *unpacker) report(path []string, action UnpackAction) {
+	if u.opts.report != nil {
+		u.opts.report.add(path, action)
+	}
+}
+
+// discard skips over ent's data, if it has any.
+func (u *unpacker) discard(path []string, ent *toc.Entry) error {
+	if file := ent.GetFile(); file != nil {
+		_, err := io.CopyBuffer(ioutil.Discard, io.LimitReader(u.r, int64(file.Size)), u.syncBuf)
+		return entryErr(path, OpWrite, err)
+	}
+	return nil
+}
+
+// copyFileData copies the data for file from the archive to w. The data is
+// consumed from the archive even if writing to w fails, so that the stream
+// stays in sync.
+func (u *unpacker) copyFileData(w io.Writer, file *toc.File) error {
+	lr := &io.LimitedReader{R: u.r, N: int64(file.Size)}
+	_, err := io.CopyBuffer(w, lr, u.syncBuf)
+	if err != nil && lr.N > 0 {
+		io.CopyBuffer(ioutil.Discard, lr, u.syncBuf)
+	}
+	return err
+}
+
+// mkdir ensures that the directory at path exists. skipped is true if the
+// directory couldn't be made due to ExistingSkip.
+//
+// Errors from mkdir immediately stop the unpack.
+func (u *unpacker) mkdir(path []string) (skipped bool, err error) {
+	rel := filepath.Join(path...)
+	if u.madeDirs.Has(rel) {
+		return false, nil
+	}
+	if u.skippedDirs.Has(rel) {
+		return true, nil
+	}
+
+	action := ActionCreated
+	if u.opts.existing != ExistingFail {
+		if err := u.dir.checkParent(path); err != nil {
+			return false, entryErr(path, OpStat, err)
+		}
+		fi, err := u.dir.lstat(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return false, entryErr(path, OpStat, err)
+		case fi.IsDir():
+			u.madeDirs.Add(rel)
+			u.report(path, ActionUnchanged)
+			return false, nil
+		case u.opts.existing == ExistingSkip:
+			u.skippedDirs.Add(rel)
+			u.report(path, ActionSkipped)
+			return true, nil
+		default:
+			if err := u.dir.removeAll(path); err != nil {
+				return false, entryErr(path, OpRemove, err)
+			}
+			action = ActionOverwritten
+		}
+	}
+
+	if err := u.dir.mkdir(path); err != nil {
+		return false, entryErr(path, OpCreate, err)
+	}
+	u.madeDirs.Add(rel)
+	u.report(path, action)
+	return false, nil
+}
+
+// prepExisting checks for an existing entry at path before a file or symlink is
+// written there. If the entry should be written, prepExisting removes any
+// existing entry and returns the action to report. If the entry should not be
+// written, it returns an action of 0 after reporting the action taken.
+//
+// same is called to compare an existing entry when the policy is
+// ExistingReplaceIfDifferent or ExistingMirror.
+func (u *unpacker) prepExisting(path []string, same func(os.FileInfo) bool) (UnpackAction, error) {
+	if u.opts.existing == ExistingFail {
+		return ActionCreated, nil
+	}
+	if err := u.dir.checkParent(path); err != nil {
+		return 0, entryErr(path, OpStat, err)
+	}
+	fi, err := u.dir.lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		return ActionCreated, nil
+	case err != nil:
+		return 0, entryErr(path, OpStat, err)
+	}
+
+	switch u.opts.existing {
+	case ExistingSkip:
+		u.report(path, ActionSkipped)
+		return 0, nil
+	case ExistingReplaceIfDifferent, ExistingMirror:
+		if same(fi) {
+			u.report(path, ActionUnchanged)
+			return 0, nil
+		}
+	}
+	if err := u.dir.removeAll(path); err != nil {
+		return 0, entryErr(path, OpRemove, err)
+	}
+	return ActionOverwritten, nil
+}
+
+func (u *unpacker) ensureSymlink(path []string, s *toc.SymLink) {
 	target := filepath.Join(s.Target...)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := errors.Annotate(os.Symlink(target, abs)).
-			Reason("writing symlink %(rel)q -> %(target)q").
-			D("rel", rel).D("target", target).Err()
-		ech <- err
-	}()
+	action, err := u.prepExisting(path, func(fi os.FileInfo) bool {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+		cur, err := u.dir.readlink(path)
+		return err == nil && cur == target
+	})
+	if err != nil || action == 0 {
+		u.ech <- err
+		return
+	}
+	if err := u.dir.symlink(target, path); err != nil {
+		u.ech <- entryErr(path, OpSymlink, err)
+		return
+	}
+	u.report(path, action)
 }
 
-func ensureFile(syncBuf []byte, wg *sync.WaitGroup, ech chan<- error, abs, rel string, r io.Reader, file *toc.File) {
-	f, err := os.Create(abs)
-	if err != nil {
-		ech <- errors.Annotate(err).Reason("creating file %(rel)q").
-			D("rel", rel).Err()
+func (u *unpacker) ensureFile(path []string, abs string, file *toc.File) {
+	ent := &toc.Entry{Etype: &toc.Entry_File{File: file}}
+	same := func(fi os.FileInfo) bool {
+		return fi.Mode().IsRegular() && fi.Size() == int64(file.Size) && sameFileMode(fi, file)
+	}
+	if u.opts.compareContents && (u.opts.existing == ExistingReplaceIfDifferent || u.opts.existing == ExistingMirror) {
+		// We can't tell if the contents are the same until we've read the data.
+		if err := u.dir.checkParent(path); err != nil {
+			u.ech <- entryErr(path, OpStat, err)
+			u.ech <- u.discard(path, ent)
+			return
+		}
+		if fi, err := u.dir.lstat(path); err == nil && same(fi) {
+			u.ensureFileIfDifferent(path, abs, file)
+			return
+		}
+	}
+	action, err := u.prepExisting(path, same)
+	if err != nil || action == 0 {
+		u.ech <- err
+		u.ech <- u.discard(path, ent)
 		return
 	}
-	st, err := f.Stat()
+
+	f, err := u.dir.create(path)
 	if err != nil {
-		ech <- errors.Annotate(err).Reason("statting file %(rel)q").
-			D("rel", rel).Err()
+		u.ech <- entryErr(path, OpCreate, err)
+		u.ech <- u.discard(path, ent)
+		return
+	}
+	u.report(path, action)
+	path = append([]string(nil), path...)
+	if u.writeSem != nil && file.Size <= maxConcurrentFileSize {
+		u.writeConcurrently(f, path, abs, file)
 		return
 	}
 	// must copy in main goroutine because all files are sequential in
 	// r (and there's no seek method). However, we don't need to
 	// block on stat'ing/closing the file.
-	if _, err := io.CopyBuffer(f, io.LimitReader(r, int64(file.Size)), syncBuf); err != nil {
-		ech <- errors.Annotate(err).Reason("writing file %(rel)q").
-			D("rel", rel).Err()
+	if err := u.copyFileData(f, file); err != nil {
+		f.Close()
+		u.ech <- entryErr(path, OpWrite, err)
+		return
+	}
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		u.finishFile(f, path, abs, file)
+	}()
+}
+
+// maxConcurrentFileSize is the largest file which writeConcurrently will
+// buffer in memory. Larger files are always written by the main goroutine.
+const maxConcurrentFileSize = 1024 * 1024
+
+// writeConcurrently reads the data for file into memory, and then writes it to
+// f and finishes f on another goroutine.
+func (u *unpacker) writeConcurrently(f *os.File, path []string, abs string, file *toc.File) {
+	buf := make([]byte, file.Size)
+	if _, err := io.ReadFull(u.r, buf); err != nil {
+		f.Close()
+		u.ech <- entryErr(path, OpWrite, err)
 		return
 	}
-	wg.Add(1)
+	u.writeSem <- struct{}{}
+	u.wg.Add(1)
 	go func() {
-		defer wg.Done()
-		mode := st.Mode()
-		if file.GetPosixMode().GetExecutable() {
-			mode |= 0111 // ugo+x
+		defer u.wg.Done()
+		defer func() { <-u.writeSem }()
+		if _, err := f.Write(buf); err != nil {
+			f.Close()
+			u.ech <- entryErr(path, OpWrite, err)
+			return
 		}
-		if file.GetCommonMode().GetReadonly() {
-			mode &= 0555 // ugo-r
+		u.finishFile(f, path, abs, file)
+	}()
+}
+
+// createTemp makes a new, uniquely named file next to path, and returns it
+// along with its path.
+//
+// Unlike ioutil.TempFile, the file is made by rootDir.create with the same mode
+// as every other unpacked file (0666, subject to the umask), since it will
+// replace the file at path.
+func (u *unpacker) createTemp(path []string) (*os.File, []string, error) {
+	tmp := append([]string(nil), path...)
+	for i := 0; i < 10000; i++ {
+		tmp[len(tmp)-1] = ".sar-" + strconv.FormatUint(uint64(rand.Uint32()), 36)
+		f, err := u.dir.create(tmp)
+		if err == nil {
+			return f, tmp, nil
 		}
-		if err := f.Chmod(mode); err != nil {
-			ech <- errors.Annotate(err).Reason("setting mode %(rel)q").
-				D("rel", rel).Err()
+		if !os.IsExist(err) {
+			return nil, nil, err
 		}
-		if err := setWinFileAttributes(abs, file.GetWinMode()); err != nil {
-			ech <- errors.Annotate(err).Reason("setting windows mode %(rel)q").
-				D("rel", rel).Err()
+	}
+	return nil, nil, errors.New("could not find an unused temporary file name")
+}
+
+// ensureFileIfDifferent writes the archived file to a temporary file next to
+// abs, and then replaces abs with it iff their contents differ.
+func (u *unpacker) ensureFileIfDifferent(path []string, abs string, file *toc.File) {
+	f, tmp, err := u.createTemp(path)
+	if err != nil {
+		u.ech <- entryErr(path, OpCreate, err)
+		u.ech <- u.discard(path, &toc.Entry{Etype: &toc.Entry_File{File: file}})
+		return
+	}
+
+	h := sha256.New()
+	if err := u.copyFileData(io.MultiWriter(f, h), file); err != nil {
+		f.Close()
+		u.dir.removeAll(tmp)
+		u.ech <- entryErr(path, OpWrite, err)
+		return
+	}
+	same, err := u.sameFileContent(path, h.Sum(nil))
+	if err != nil || same {
+		f.Close()
+		u.dir.removeAll(tmp)
+		if err != nil {
+			u.ech <- entryErr(path, OpCompare, err)
+		} else {
+			u.report(path, ActionUnchanged)
 		}
-		ech <- errors.Annotate(f.Close()).Reason("closing file %(rel)q").
-			D("rel", rel).Err()
-	}()
+		return
+	}
+
+	// The file must be closed before it can be renamed on windows, so this
+	// can't be done asynchronously like in ensureFile.
+	if !u.finishFile(f, path, f.Name(), file) {
+		u.dir.removeAll(tmp)
+		return
+	}
+	if err := u.dir.rename(tmp, path); err != nil {
+		u.dir.removeAll(tmp)
+		u.ech <- entryErr(path, OpRename, err)
+		return
+	}
+	u.report(path, ActionOverwritten)
 }
 
-func (a *OpenedArchive) prepReader() (io.Reader, io.Closer, error) {
-	dataReader := io.Reader(a.r)
-	checksumCloser := io.Closer(a.r)
-	if a.opts.unpackBufferSize > 0 {
-		rd, wr := io.Pipe()
-		go func(r io.Reader) {
-			_, err := bufio.NewReaderSize(r, a.opts.unpackBufferSize).WriteTo(wr)
-			wr.CloseWithError(err)
-		}(dataReader)
-		dataReader = rd
+// finishFile sets the modes of the file f, which is at abs, and closes it.
+// Returns true iff there were no errors.
+func (u *unpacker) finishFile(f *os.File, path []string, abs string, file *toc.File) (ok bool) {
+	ok = true
+	send := func(op UnpackOp, err error) {
+		if err != nil {
+			ok = false
+			u.ech <- entryErr(path, op, err)
+		}
 	}
 
-	return dataReader, checksumCloser, nil
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		send(OpChmod, err)
+		return
+	}
+	mode := st.Mode()
+	if file.GetPosixMode().GetExecutable() {
+		mode |= 0111 // ugo+x
+	}
+	if file.GetCommonMode().GetReadonly() {
+		mode &= 0555 // ugo-r
+	}
+	send(OpChmod, f.Chmod(mode))
+	send(OpWinAttrs, setWinFileAttributes(abs, file.GetWinMode()))
+	send(OpClose, f.Close())
+	return
+}
+
+// entry unpacks a single entry from the TOC.
+func (u *unpacker) entry(path []string, ent *toc.Entry) error {
+	rel := filepath.Join(path...)
+	abs := filepath.Join(u.root, rel)
+
+	u.curRel = rel
+	u.progress.entry(path)
+	if err := u.ctx.Err(); err != nil {
+		// this immediately quits the loop; UnpackTo will report the error.
+		return err
+	}
+
+	if u.tocPaths != nil {
+		u.tocPaths.Add(rel)
+	}
+	if !u.opts.selected(path, ent) {
+		return u.discard(path, ent)
+	}
+
+	for i := 1; i < len(path); i++ {
+		skipped, err := u.mkdir(path[:i])
+		if err != nil {
+			return err
+		}
+		if skipped {
+			return u.discard(path, ent)
+		}
+	}
+
+	switch x := ent.Etype.(type) {
+	case *toc.Entry_Tree:
+		_, err := u.mkdir(path)
+		return err
+
+	case *toc.Entry_Symlink:
+		u.ensureSymlink(path, x.Symlink)
+
+	case *toc.Entry_File:
+		u.ensureFile(path, abs, x.File)
+
+	default:
+		panic("impossible!")
+	}
+	// If ctx was canceled while writing this entry, stop here.
+	return u.ctx.Err()
+}
+
+// mirror deletes every entry under root which isn't in the TOC.
+func (u *unpacker) mirror() error {
+	return filepath.Walk(u.root, func(abs string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := u.ctx.Err(); err != nil {
+			return err
+		}
+		if abs == u.root {
+			return nil
+		}
+		rel, err := filepath.Rel(u.root, abs)
+		if err != nil {
+			return err
+		}
+		if u.tocPaths.Has(rel) {
+			return nil
+		}
+		path := strings.Split(filepath.ToSlash(rel), "/")
+		if err := u.dir.removeAll(path); err != nil {
+			return errors.Annotate(err).Reason("deleting %(rel)q").D("rel", rel).Err()
+		}
+		u.report(path, ActionDeleted)
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
 }
 
 // UnpackTo does a streaming unpack of the entire Archive to the provided
 // location.
 //
-// root must be either a non-existant path, or a path to an empty directory.
+// root must be either a non-existant path, or a path to an empty directory,
+// unless WithExistingPolicy is supplied.
+//
+// If options select a subset of the entries (see WithInclude, WithExclude and
+// WithFilter), the data for the other files is still read (so that the
+// checksum may be verified), but is discarded. The parent directories of every
+// selected entry are created, even if the directories themselves are not
+// selected.
+//
+// If ctx is canceled, UnpackTo stops as soon as possible and returns
+// ctx.Err(), annotated with the path that was being unpacked. The rest of the
+// archive is not read, so its checksum is not verified.
+//
+// If any entries can't be unpacked, UnpackTo continues with the rest of the
+// archive and then returns an *UnpackError. However, if the archive's checksum
+// doesn't match, the *sardata.ErrMismatchedChecksum is returned instead.
+//
+// Without WithAtomic, a failed UnpackTo may leave root partially populated.
+//
+// UnpackTo never writes outside of root. Entries are created relative to their
+// parent directories without following symlinks (see WithSymlinkPolicy), so an
+// archive can't write through a symlink that it, or anything else, put inside
+// of root.
 //
 // It is invalid to call UnpackTo twice, or to call it on a Close()'d Archive.
-func (a *OpenedArchive) UnpackTo(ctx context.Context, root string) error {
-	if a.didClose {
-		return errors.New("can only unpack once/cannot unpack closed Archive")
+func (a *OpenedArchive) UnpackTo(ctx context.Context, root string, options ...UnpackOption) error {
+	if a.didClose || a.iter != nil {
+		return errors.New("can only unpack once/cannot unpack closed or iterated Archive")
+	}
+
+	opts, err := parseUnpackOptions(options)
+	if err != nil {
+		return err
+	}
+	if opts.symlinks == SymlinksReject {
+		if err := rejectSymlinks(a.TOC); err != nil {
+			return err
+		}
 	}
 	a.didClose = true
 
-	root, err := filepath.Abs(root)
+	root, err = filepath.Abs(root)
 	if err != nil {
 		return errors.Annotate(err).Reason("making abspath").Err()
 	}
 
-	if err := ensureRoot(root); err != nil {
+	if opts.atomic {
+		return a.unpackAtomic(ctx, root, opts)
+	}
+	return a.unpackTo(ctx, root, opts)
+}
+
+// unpackTo implements UnpackTo after the options have been parsed.
+func (a *OpenedArchive) unpackTo(ctx context.Context, root string, opts unpackOptions) error {
+	if err := ensureRoot(root, opts.existing != ExistingFail); err != nil {
 		return errors.Annotate(err).Reason("checking root").Err()
 	}
 
-	dataReader, checksumCloser, err := a.prepReader()
+	dir, err := openRootDir(root)
 	if err != nil {
-		return errors.Annotate(err).Reason("prepping reader").Err()
+		return errors.Annotate(err).Reason("opening root").Err()
+	}
+	// mirror needs dir too, so it's closed once it's done.
+	defer dir.Close()
+
+	dataReader, checksumCloser, abort := a.prepReader(ctx)
+	if p := a.opts.progress; p != nil {
+		size, entries := tocTotals(a.TOC)
+		p.start(StageUnpack, 0, size, entries)
+		dataReader = uncompressedReader{dataReader, p}
 	}
 
 	ech := make(chan error, 1)
+	u := &unpacker{
+		ctx:         ctx,
+		root:        root,
+		dir:         dir,
+		progress:    a.opts.progress,
+		opts:        opts,
+		r:           dataReader,
+		syncBuf:     make([]byte, 32*1024),
+		ech:         ech,
+		madeDirs:    stringset.New(0),
+		skippedDirs: stringset.New(0),
+	}
+	if opts.existing == ExistingMirror {
+		u.tocPaths = stringset.New(0)
+	}
+	if a.chunks != nil && a.opts.unpackWorkers > 1 {
+		u.writeSem = make(chan struct{}, a.opts.unpackWorkers)
+	}
 	go func() {
 		defer close(ech)
+		defer u.wg.Wait()
 
-		wg := &sync.WaitGroup{}
-		defer wg.Wait()
-
-		syncBuf := make([]byte, 32*1024)
-
-		ech <- a.TOC.LoopItems(func(path []string, ent *toc.Entry) error {
-			rel := filepath.Join(path...)
-			abs := filepath.Join(root, rel)
-
-			switch x := ent.Etype.(type) {
-			case *toc.Entry_Tree:
-				if err := os.Mkdir(abs, 0777); err != nil {
-					// this immediately quits the loop
-					return errors.Annotate(err).Reason("FATAL: making dir %(rel)q").
-						D("rel", rel).Err()
-				}
-
-			case *toc.Entry_Symlink:
-				ensureSymlink(wg, ech, abs, rel, x.Symlink)
-
-			case *toc.Entry_File:
-				ensureFile(syncBuf, wg, ech, abs, rel, dataReader, x.File)
-
-			default:
-				panic("impossible!")
-			}
-			return nil
-		})
+		ech <- a.TOC.LoopData(u.entry)
 	}()
 
-	hadError := false
+	uerr := &UnpackError{}
 	for err := range ech {
-		if err == nil {
+		// Once ctx is done, most errors will just be due to the cancellation.
+		if err == nil || ctx.Err() != nil {
 			continue
 		}
-		if !hadError {
-			logging.Errorf(ctx, "errors while unpacking to %q:", root)
-			hadError = true
+		ee, ok := err.(*EntryError)
+		if !ok {
+			ee = &EntryError{Err: err}
 		}
-		logging.Errorf(ctx, "  %s", err)
+		uerr.Entries = append(uerr.Entries, ee)
 	}
-	if hadError {
-		return errors.New("errors while unpacking (see log)")
+	if err := ctx.Err(); err != nil {
+		abort()
+		return errors.Annotate(err).Reason("unpacking %(rel)q").D("rel", u.curRel).Err()
 	}
 
-	return checksumCloser.Close()
+	csumErr := checksumCloser.Close()
+	if _, ok := csumErr.(*sardata.ErrMismatchedChecksum); ok {
+		// A corrupt archive is the most likely cause of any other errors.
+		return csumErr
+	}
+	if len(uerr.Entries) > 0 {
+		return uerr
+	}
+	if csumErr != nil {
+		return csumErr
+	}
+	if u.tocPaths != nil {
+		if err := u.mirror(); err != nil {
+			return errors.Annotate(err).Reason("mirroring").Err()
+		}
+	}
+	u.progress.done()
+	return nil
 }
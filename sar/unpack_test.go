@@ -0,0 +1,320 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/luci/luci-go/common/testing/assertions"
+
+	"github.com/riannucci/sarchive/sar/sardata"
+	"github.com/riannucci/sarchive/sar/sardata/toc"
+)
+
+// readTree returns the contents of every file and symlink under dir. Symlinks
+// have their targets prefixed with "->", as in mkTree.
+func readTree(dir string) map[string]string {
+	ret := map[string]string{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			ret[filepath.ToSlash(rel)] = "->" + filepath.ToSlash(target)
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		ret[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func TestUnpackExisting(tst *testing.T) {
+	tst.Parallel()
+
+	if runtime.GOOS == "windows" {
+		tst.Skip("symlinks require privileges on windows")
+	}
+
+	Convey("UnpackTo with existing files", tst, func() {
+		buf := &bytes.Buffer{}
+		b, err := NewBuilder(buf)
+		So(err, ShouldBeNil)
+		addFile := func(path, data string) {
+			So(b.AddFile(strings.Split(path, "/"), uint64(len(data)), 0644,
+				strings.NewReader(data)), ShouldBeNil)
+		}
+		addFile("same", "same data")
+		addFile("sameSize", "new data!")
+		addFile("changed", "new changed data")
+		So(b.AddDir([]string{"dir"}), ShouldBeNil)
+		addFile("dir/new", "dir/new data")
+		So(b.AddSymlink([]string{"link"}, []string{"same"}), ShouldBeNil)
+		So(b.Finish(), ShouldBeNil)
+
+		dst, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dst)
+		mkTree(dst, map[string]string{
+			"same":     "same data",
+			"sameSize": "old data!",
+			"changed":  "old data",
+			"extra":    "extra data",
+			"link":     "->changed",
+		})
+
+		unpack := func(opts ...UnpackOption) (map[string]UnpackAction, error) {
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+			So(err, ShouldBeNil)
+			rpt := &UnpackReport{}
+			err = ar.UnpackTo(context.Background(), dst, append(opts, WithUnpackReport(rpt))...)
+			actions := map[string]UnpackAction{}
+			for _, e := range rpt.Entries {
+				actions[strings.Join(e.Path, "/")] = e.Action
+			}
+			return actions, err
+		}
+
+		Convey("fail", func() {
+			_, err := unpack()
+			So(err, ShouldErrLike, "dir not empty")
+		})
+
+		Convey("overwrite", func() {
+			actions, err := unpack(WithExistingPolicy(ExistingOverwrite))
+			So(err, ShouldBeNil)
+			So(actions, ShouldResemble, map[string]UnpackAction{
+				"same":     ActionOverwritten,
+				"sameSize": ActionOverwritten,
+				"changed":  ActionOverwritten,
+				"dir":      ActionCreated,
+				"dir/new":  ActionCreated,
+				"link":     ActionOverwritten,
+			})
+			So(readTree(dst), ShouldResemble, map[string]string{
+				"same":     "same data",
+				"sameSize": "new data!",
+				"changed":  "new changed data",
+				"dir/new":  "dir/new data",
+				"extra":    "extra data",
+				"link":     "->same",
+			})
+		})
+
+		Convey("skip", func() {
+			actions, err := unpack(WithExistingPolicy(ExistingSkip))
+			So(err, ShouldBeNil)
+			So(actions, ShouldResemble, map[string]UnpackAction{
+				"same":     ActionSkipped,
+				"sameSize": ActionSkipped,
+				"changed":  ActionSkipped,
+				"dir":      ActionCreated,
+				"dir/new":  ActionCreated,
+				"link":     ActionSkipped,
+			})
+			So(readTree(dst), ShouldResemble, map[string]string{
+				"same":     "same data",
+				"sameSize": "old data!",
+				"changed":  "old data",
+				"dir/new":  "dir/new data",
+				"extra":    "extra data",
+				"link":     "->changed",
+			})
+		})
+
+		Convey("replace if different", func() {
+			actions, err := unpack(WithExistingPolicy(ExistingReplaceIfDifferent))
+			So(err, ShouldBeNil)
+			So(actions["same"], ShouldEqual, ActionUnchanged)
+			So(actions["sameSize"], ShouldEqual, ActionUnchanged)
+			So(actions["changed"], ShouldEqual, ActionOverwritten)
+			So(actions["link"], ShouldEqual, ActionOverwritten)
+			So(readTree(dst)["sameSize"], ShouldEqual, "old data!")
+
+			Convey("comparing contents", func() {
+				actions, err := unpack(WithExistingPolicy(ExistingReplaceIfDifferent),
+					WithCompareContents(true))
+				So(err, ShouldBeNil)
+				So(actions["same"], ShouldEqual, ActionUnchanged)
+				So(actions["sameSize"], ShouldEqual, ActionOverwritten)
+				So(actions["changed"], ShouldEqual, ActionUnchanged)
+				So(actions["link"], ShouldEqual, ActionUnchanged)
+				So(actions["dir"], ShouldEqual, ActionUnchanged)
+				So(readTree(dst), ShouldResemble, map[string]string{
+					"same":     "same data",
+					"sameSize": "new data!",
+					"changed":  "new changed data",
+					"dir/new":  "dir/new data",
+					"extra":    "extra data",
+					"link":     "->same",
+				})
+
+				// sameSize was replaced, and dir/new was freshly created.
+				replaced, err := os.Stat(filepath.Join(dst, "sameSize"))
+				So(err, ShouldBeNil)
+				created, err := os.Stat(filepath.Join(dst, "dir", "new"))
+				So(err, ShouldBeNil)
+				So(replaced.Mode().Perm(), ShouldEqual, created.Mode().Perm())
+			})
+		})
+
+		Convey("mirror", func() {
+			mkTree(dst, map[string]string{"extraDir/sub/file": "data"})
+			actions, err := unpack(WithExistingPolicy(ExistingMirror), WithExclude("dir"))
+			So(err, ShouldBeNil)
+			So(actions["extra"], ShouldEqual, ActionDeleted)
+			So(actions["extraDir"], ShouldEqual, ActionDeleted)
+			_, hasSub := actions["extraDir/sub"]
+			So(hasSub, ShouldBeFalse)
+
+			files := []string{}
+			for k := range readTree(dst) {
+				files = append(files, k)
+			}
+			sort.Strings(files)
+			So(files, ShouldResemble, []string{"changed", "link", "same", "sameSize"})
+		})
+
+		Convey("bad policy", func() {
+			_, err := unpack(WithExistingPolicy(ExistingPolicy(100)))
+			So(err, ShouldErrLike, "unknown ExistingPolicy")
+		})
+	})
+}
+
+func TestUnpackCancel(tst *testing.T) {
+	tst.Parallel()
+
+	Convey("UnpackTo with a canceled context", tst, func() {
+		buf := &bytes.Buffer{}
+		b, err := NewBuilder(buf)
+		So(err, ShouldBeNil)
+		for _, name := range []string{"a", "b", "c"} {
+			data := strings.Repeat(name, 100*1024)
+			So(b.AddFile([]string{name}, uint64(len(data)), 0644, strings.NewReader(data)), ShouldBeNil)
+		}
+		So(b.Finish(), ShouldBeNil)
+
+		dst, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dst)
+
+		for _, bufSize := range []int{0, 1024} {
+			Convey(fmt.Sprintf("buffer size %d", bufSize), func() {
+				ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())},
+					WithUnpackBufferSize(bufSize))
+				So(err, ShouldBeNil)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				err = ar.UnpackTo(ctx, dst, WithFilter(func(path []string, _ *toc.Entry) bool {
+					if path[0] == "b" {
+						cancel()
+					}
+					return true
+				}))
+				So(err, ShouldErrLike, `unpacking "b"`, context.Canceled.Error())
+
+				// "b" was created before the cancellation was noticed.
+				files := readTree(dst)
+				So(len(files), ShouldEqual, 2)
+				So(files["a"] == strings.Repeat("a", 100*1024), ShouldBeTrue)
+				So(files["b"], ShouldEqual, "")
+			})
+		}
+	})
+}
+
+func TestUnpackErrors(tst *testing.T) {
+	tst.Parallel()
+
+	Convey("UnpackTo with failing entries", tst, func() {
+		// This name is too long for most filesystems.
+		longName := strings.Repeat("x", 300)
+
+		buf := &bytes.Buffer{}
+		b, err := NewBuilder(buf)
+		So(err, ShouldBeNil)
+		for _, name := range []string{"first", longName, "last"} {
+			So(b.AddFile([]string{name}, 9, 0644, strings.NewReader(name[:4]+" data")), ShouldBeNil)
+		}
+		So(b.Finish(), ShouldBeNil)
+
+		dst, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dst)
+
+		Convey("reports the failed entries", func() {
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(buf.Bytes())})
+			So(err, ShouldBeNil)
+			err = ar.UnpackTo(context.Background(), dst)
+			So(err, ShouldHaveSameTypeAs, &UnpackError{})
+			uerr := err.(*UnpackError)
+			So(len(uerr.Entries), ShouldEqual, 1)
+			So(uerr.Entries[0].Path, ShouldResemble, []string{longName})
+			So(uerr.Entries[0].Op, ShouldEqual, OpCreate)
+			So(uerr.Entries[0].Err, ShouldNotBeNil)
+
+			var ee *EntryError
+			So(errors.As(err, &ee), ShouldBeTrue)
+			So(ee, ShouldEqual, uerr.Entries[0])
+			var perr *os.PathError
+			So(errors.As(err, &perr), ShouldBeTrue)
+			So(perr, ShouldEqual, uerr.Entries[0].Err)
+
+			// The other files are unaffected.
+			So(readTree(dst), ShouldResemble, map[string]string{
+				"first": "firs data",
+				"last":  "last data",
+			})
+		})
+
+		Convey("unwraps to the entries' errors", func() {
+			uerr := &UnpackError{Entries: []*EntryError{
+				{Path: []string{"a"}, Op: OpCreate, Err: errors.New("other")},
+				{Path: []string{"b"}, Op: OpCreate,
+					Err: &os.PathError{Op: "open", Path: "b", Err: fs.ErrPermission}},
+			}}
+			So(errors.Is(uerr, fs.ErrPermission), ShouldBeTrue)
+			So(errors.Is(uerr.Entries[1], fs.ErrPermission), ShouldBeTrue)
+			So(errors.Is(uerr.Entries[0], fs.ErrPermission), ShouldBeFalse)
+			So(errors.Is(uerr, fs.ErrNotExist), ShouldBeFalse)
+		})
+
+		Convey("prefers the checksum error", func() {
+			newBytes := make([]byte, buf.Len())
+			copy(newBytes, buf.Bytes())
+			newBytes[len(newBytes)-10]++ // break the checksum
+
+			ar, err := Open(nullReadSeekCloser{bytes.NewReader(newBytes)})
+			So(err, ShouldBeNil)
+			err = ar.UnpackTo(context.Background(), dst)
+			So(err, ShouldHaveSameTypeAs, &sardata.ErrMismatchedChecksum{})
+		})
+	})
+}
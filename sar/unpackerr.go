@@ -0,0 +1,103 @@
+// Copyright 2017 Robert Iannucci Jr. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnpackOp identifies the operation which failed in an EntryError.
+type UnpackOp string
+
+// These are the operations which UnpackTo performs for each entry.
+const (
+	// OpCreate is creating a file or directory.
+	OpCreate UnpackOp = "create"
+
+	// OpWrite is copying a file's data from the archive (including skipping
+	// over the data of files which aren't written).
+	OpWrite UnpackOp = "write"
+
+	// OpChmod is setting a file's mode.
+	OpChmod UnpackOp = "chmod"
+
+	// OpSymlink is creating a symlink.
+	OpSymlink UnpackOp = "symlink"
+
+	// OpWinAttrs is setting a file's windows attributes.
+	OpWinAttrs UnpackOp = "win-attrs"
+
+	// OpClose is closing a file.
+	OpClose UnpackOp = "close"
+
+	// OpStat is checking for an existing entry (see WithExistingPolicy).
+	OpStat UnpackOp = "stat"
+
+	// OpRemove is removing an existing entry (see WithExistingPolicy).
+	OpRemove UnpackOp = "remove"
+
+	// OpCompare is comparing the contents of an existing file (see
+	// WithCompareContents).
+	OpCompare UnpackOp = "compare"
+
+	// OpRename is moving a file into place (see WithCompareContents).
+	OpRename UnpackOp = "rename"
+)
+
+// EntryError is a failure to unpack a single entry.
+type EntryError struct {
+	// Path is relative to the unpack root.
+	Path []string
+	Op   UnpackOp
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s %q: %s", e.Op, strings.Join(e.Path, "/"), e.Err)
+}
+
+// Unwrap returns e.Err, so that errors.Is and errors.As see the underlying
+// error (e.g. fs.ErrPermission).
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// entryErr returns an *EntryError for err, or nil if err is nil.
+func entryErr(path []string, op UnpackOp, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &EntryError{append([]string(nil), path...), op, err}
+}
+
+// UnpackError is returned by UnpackTo if any entries could not be unpacked.
+type UnpackError struct {
+	// Entries are the individual failures. Failures for different entries may
+	// not be in TOC order.
+	Entries []*EntryError
+}
+
+func (e *UnpackError) Error() string {
+	switch len(e.Entries) {
+	case 0:
+		return "errors while unpacking"
+	case 1:
+		return e.Entries[0].Error()
+	case 2:
+		return fmt.Sprintf("%s (and 1 other error)", e.Entries[0])
+	}
+	return fmt.Sprintf("%s (and %d other errors)", e.Entries[0], len(e.Entries)-1)
+}
+
+// Unwrap returns every EntryError in e, so that errors.Is and errors.As match
+// if any of the entries does.
+func (e *UnpackError) Unwrap() []error {
+	ret := make([]error, len(e.Entries))
+	for i, ee := range e.Entries {
+		ret[i] = ee
+	}
+	return ret
+}